@@ -1,7 +1,10 @@
 package main
 
 import (
+	"bytes"
+	"encoding/gob"
 	"encoding/hex"
+	"fmt"
 	bolt "go.etcd.io/bbolt"
 	"log"
 )
@@ -12,10 +15,20 @@ type UTXOSet struct {
 	Blockchain *Blockchain
 }
 
-// 从 address 中找到至少 amount 的 UTXO
+// 从 address 中找到至少 amount 的 UTXO，跳过还未成熟的 coinbase 输出
 func (u UTXOSet) FindSpendableOutputs(pubkeyHash []byte, amount int) (int, map[string][]int) {
+	return u.findSpendable(func(out TXOutput) bool { return out.IsLockedWithKey(pubkeyHash) }, amount)
+}
+
+// 找到锁定脚本为script的至少 amount 的 UTXO，用于花费多重签名等非标准地址的输出
+func (u UTXOSet) FindSpendableScriptOutputs(script []byte, amount int) (int, map[string][]int) {
+	return u.findSpendable(func(out TXOutput) bool { return bytes.Equal(out.ScriptPubKey, script) }, amount)
+}
+
+func (u UTXOSet) findSpendable(match func(out TXOutput) bool, amount int) (int, map[string][]int) {
 	unspentOutputs := make(map[string][]int)
 	accumulated := 0
+	height := u.Blockchain.GetBestHeight() + 1
 	db := u.Blockchain.db
 	db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(utxoBucket))
@@ -23,8 +36,11 @@ func (u UTXOSet) FindSpendableOutputs(pubkeyHash []byte, amount int) (int, map[s
 		for k, v := c.First(); k != nil; k, v = c.Next() {
 			txID := hex.EncodeToString(k)
 			outs := DeserializeOutputs(v)
+			if !outs.IsMature(height) {
+				continue
+			}
 			for outIdx, out := range outs.Outputs {
-				if out.IsLockedWithKey(pubkeyHash) && accumulated < amount {
+				if match(out) && accumulated < amount {
 					accumulated += out.Value
 					unspentOutputs[txID] = append(unspentOutputs[txID], outIdx)
 				}
@@ -35,41 +51,170 @@ func (u UTXOSet) FindSpendableOutputs(pubkeyHash []byte, amount int) (int, map[s
 	return accumulated, unspentOutputs
 }
 
-//当有区块被挖出需要更新UTXO集
-func (u UTXOSet) Update(block *Block) {
-	db := u.Blockchain.db
-	db.Update(func(tx *bolt.Tx) error {
+// 在UTXO集中查找一个未花费的输出
+func (u UTXOSet) FindOutput(txid []byte, vout int) (TXOutput, bool) {
+	var out TXOutput
+	found := false
+	u.Blockchain.db.View(func(tx *bolt.Tx) error {
+		outsBytes := tx.Bucket([]byte(utxoBucket)).Get(txid)
+		if outsBytes != nil {
+			out, found = DeserializeOutputs(outsBytes).Outputs[vout]
+		}
+		return nil
+	})
+	return out, found
+}
+
+// 在UTXO集中查找交易剩下的未花费输出(包括输出所在区块的高度)
+func (u UTXOSet) FindOutputs(txid []byte) (TXOutputs, bool) {
+	var outs TXOutputs
+	found := false
+	u.Blockchain.db.View(func(tx *bolt.Tx) error {
+		outsBytes := tx.Bucket([]byte(utxoBucket)).Get(txid)
+		if outsBytes != nil {
+			outs, found = DeserializeOutputs(outsBytes), true
+		}
+		return nil
+	})
+	return outs, found
+}
+
+// 检查交易花费的 coinbase 输出在高度为height的区块中是否已经成熟
+func (u UTXOSet) CheckMaturity(transaction *Transaction, height int) error {
+	var err error
+	u.Blockchain.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(utxoBucket))
-		for _, tx := range block.Transactions {
-			if tx.IsCoinbase() == false {
-				for _, vin := range tx.Vin {
-					updateOuts := TXOutputs{}
-					outsBytes := b.Get(vin.Txid)
-					outs := DeserializeOutputs(outsBytes)
-
-					for outIdx, out := range outs.Outputs {
-						if outIdx != vin.Vout {
-							updateOuts.Outputs = append(updateOuts.Outputs, out)
-						}
-					}
-
-					if len(updateOuts.Outputs) == 0 {
-						b.Delete(vin.Txid)
-					} else {
-						b.Put(vin.Txid, updateOuts.Serialize())
-					}
-				}
+		for _, vin := range transaction.Vin {
+			outsBytes := b.Get(vin.Txid)
+			if outsBytes == nil {
+				continue
 			}
-
-			newOutputs := TXOutputs{}
-			for _, out := range tx.Vout {
-				newOutputs.Outputs = append(newOutputs.Outputs, out)
+			if outs := DeserializeOutputs(outsBytes); !outs.IsMature(height) {
+				err = fmt.Errorf("%w: output %x:%d created at height %d", ErrImmatureSpend, vin.Txid, vin.Vout, outs.Height)
+				return nil
 			}
-
-			b.Put(tx.ID, newOutputs.Serialize())
 		}
 		return nil
 	})
+	return err
+}
+
+// 计算交易的手续费(输入金额减去输出金额)，交易的输入必须都在UTXO集中
+func (u UTXOSet) TransactionFee(transaction *Transaction) (int, error) {
+	inputValue := 0
+	for _, vin := range transaction.Vin {
+		out, ok := u.FindOutput(vin.Txid, vin.Vout)
+		if !ok {
+			return 0, fmt.Errorf("output %x:%d is missing or spent", vin.Txid, vin.Vout)
+		}
+		inputValue += out.Value
+	}
+	fee := inputValue - transaction.OutputValue()
+	if fee < 0 {
+		return 0, fmt.Errorf("outputs exceed inputs by %d", -fee)
+	}
+	return fee, nil
+}
+
+// 被区块花费掉的输出，断开区块时用来恢复UTXO集(包括输出所在区块的高度和是否为 coinbase)
+type SpentOutput struct {
+	Txid     []byte
+	Vout     int
+	Output   TXOutput
+	Height   int
+	Coinbase bool
+}
+
+// 区块的撤销数据，按交易和输入的顺序记录被花费的输出
+type BlockUndo struct {
+	Spent []SpentOutput
+}
+
+func (undo BlockUndo) Serialize() []byte {
+	var buff bytes.Buffer
+	enc := gob.NewEncoder(&buff)
+	err := enc.Encode(undo)
+	if err != nil {
+		log.Panic(err)
+	}
+	return buff.Bytes()
+}
+
+func DeserializeBlockUndo(data []byte) BlockUndo {
+	var undo BlockUndo
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	err := dec.Decode(&undo)
+	if err != nil {
+		log.Panic(err)
+	}
+	return undo
+}
+
+// 在事务tx中把区块的交易应用到UTXO集，返回撤销数据
+func (u UTXOSet) applyBlock(tx *bolt.Tx, block *Block) (*BlockUndo, error) {
+	b := tx.Bucket([]byte(utxoBucket))
+	undo := &BlockUndo{}
+	for _, transaction := range block.Transactions {
+		if transaction.IsCoinbase() == false {
+			for _, vin := range transaction.Vin {
+				outsBytes := b.Get(vin.Txid)
+				if outsBytes == nil {
+					return nil, fmt.Errorf("output %x:%d is missing or spent", vin.Txid, vin.Vout)
+				}
+				outs := DeserializeOutputs(outsBytes)
+				out, ok := outs.Outputs[vin.Vout]
+				if !ok {
+					return nil, fmt.Errorf("output %x:%d is missing or spent", vin.Txid, vin.Vout)
+				}
+				if !outs.IsMature(block.Height) {
+					return nil, fmt.Errorf("%w: output %x:%d created at height %d", ErrImmatureSpend, vin.Txid, vin.Vout, outs.Height)
+				}
+				undo.Spent = append(undo.Spent, SpentOutput{vin.Txid, vin.Vout, out, outs.Height, outs.Coinbase})
+
+				delete(outs.Outputs, vin.Vout)
+				if len(outs.Outputs) == 0 {
+					b.Delete(vin.Txid)
+				} else {
+					b.Put(vin.Txid, outs.Serialize())
+				}
+			}
+		}
+
+		newOutputs := TXOutputs{make(map[int]TXOutput), block.Height, transaction.IsCoinbase()}
+		for outIdx, out := range transaction.Vout {
+			newOutputs.Outputs[outIdx] = out
+		}
+		b.Put(transaction.ID, newOutputs.Serialize())
+	}
+	return undo, nil
+}
+
+// 在事务tx中撤销区块对UTXO集的修改(区块必须是当前链尖)
+func (u UTXOSet) revertBlock(tx *bolt.Tx, block *Block, undo BlockUndo) error {
+	b := tx.Bucket([]byte(utxoBucket))
+	spent := undo.Spent
+	//逆序处理交易，这样区块内交易之间的花费也能正确恢复
+	for i := len(block.Transactions) - 1; i >= 0; i-- {
+		transaction := block.Transactions[i]
+		b.Delete(transaction.ID)
+		if transaction.IsCoinbase() {
+			continue
+		}
+		if len(spent) < len(transaction.Vin) {
+			return fmt.Errorf("undo data of block %x is incomplete", block.Hash)
+		}
+		restore := spent[len(spent)-len(transaction.Vin):]
+		spent = spent[:len(spent)-len(transaction.Vin)]
+		for _, s := range restore {
+			outs := TXOutputs{make(map[int]TXOutput), s.Height, s.Coinbase}
+			if outsBytes := b.Get(s.Txid); outsBytes != nil {
+				outs = DeserializeOutputs(outsBytes)
+			}
+			outs.Outputs[s.Vout] = s.Output
+			b.Put(s.Txid, outs.Serialize())
+		}
+	}
+	return nil
 }
 
 // 查找并返回所有未使用的交易输出
@@ -92,6 +237,39 @@ func (u UTXOSet) FindUTXO(pubKeyHash []byte) []TXOutput {
 	return UTXOs
 }
 
+// 返回公钥哈希拥有的余额，分为可以花费的和还未成熟的 coinbase 输出
+func (u UTXOSet) GetBalance(pubKeyHash []byte) (int, int) {
+	return u.getBalance(func(out TXOutput) bool { return out.IsLockedWithKey(pubKeyHash) })
+}
+
+// 返回锁定脚本为script的输出的余额，用于 P2SH 等不属于单个公钥的地址
+func (u UTXOSet) GetScriptBalance(script []byte) (int, int) {
+	return u.getBalance(func(out TXOutput) bool { return bytes.Equal(out.ScriptPubKey, script) })
+}
+
+func (u UTXOSet) getBalance(match func(out TXOutput) bool) (int, int) {
+	balance, immature := 0, 0
+	height := u.Blockchain.GetBestHeight() + 1
+	u.Blockchain.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(utxoBucket)).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			outs := DeserializeOutputs(v)
+			for _, out := range outs.Outputs {
+				if !match(out) {
+					continue
+				}
+				if outs.IsMature(height) {
+					balance += out.Value
+				} else {
+					immature += out.Value
+				}
+			}
+		}
+		return nil
+	})
+	return balance, immature
+}
+
 //初始化UTXO集
 func (u UTXOSet) Reindex() {
 	db := u.Blockchain.db
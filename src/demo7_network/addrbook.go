@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"log"
+	"sort"
+	"time"
+)
+
+// 保存已知节点地址的bucket，键为地址，节点重启后从这里恢复
+const peersBucket = "peers"
+
+// 地址传播参数
+const (
+	//一条 addr 消息最多携带的地址数
+	maxAddrPerMsg = 1000
+	//最多主动连接多少个节点
+	maxOutboundPeers = 8
+	//只转发最近见过的地址，并且只转发给几个节点，避免在网络中无限传播
+	addrRelayWindow = 10 * time.Minute
+	addrRelayPeers  = 2
+	//超过这个时间没有见过的地址会被丢弃
+	addrExpiry = 7 * 24 * time.Hour
+)
+
+// 已知节点的地址，Timestamp 为最后一次见到它在线的时间(Unix秒)，种子节点在连接成功之前为0
+type peerAddress struct {
+	Addr      string
+	Services  uint64
+	Timestamp int64
+}
+
+// 节点之间交换的地址列表
+type addr struct {
+	AddrList []peerAddress
+}
+
+func (pa peerAddress) Serialize() []byte {
+	var buff bytes.Buffer
+	enc := gob.NewEncoder(&buff)
+	err := enc.Encode(pa)
+	if err != nil {
+		log.Panic(err)
+	}
+	return buff.Bytes()
+}
+
+func DeserializePeerAddress(data []byte) peerAddress {
+	var pa peerAddress
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	err := dec.Decode(&pa)
+	if err != nil {
+		log.Panic(err)
+	}
+	return pa
+}
+
+func (pa peerAddress) expired(now int64) bool {
+	return pa.Timestamp > 0 && now-pa.Timestamp > int64(addrExpiry/time.Second)
+}
+
+// 从数据库恢复已知节点地址，过期的地址被删除
+func (n *Node) loadAddresses() {
+	now := time.Now().Unix()
+	err := n.bc.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(peersBucket))
+		if err != nil {
+			return err
+		}
+		var expired [][]byte
+		b.ForEach(func(k, v []byte) error {
+			pa := DeserializePeerAddress(v)
+			if pa.expired(now) {
+				expired = append(expired, append([]byte{}, k...))
+			} else {
+				n.addrs[pa.Addr] = pa
+			}
+			return nil
+		})
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// 在数据库中保存或删除一个地址
+func (n *Node) storeAddress(pa peerAddress, remove bool) {
+	err := n.bc.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(peersBucket))
+		if remove {
+			return b.Delete([]byte(pa.Addr))
+		}
+		return b.Put([]byte(pa.Addr), pa.Serialize())
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// 把地址加入已知节点，已经存在时更新最后见到的时间，是新地址时返回 true
+func (n *Node) addAddress(pa peerAddress) bool {
+	if pa.Addr == "" || pa.Addr == n.Address {
+		return false
+	}
+	n.mu.Lock()
+	old, known := n.addrs[pa.Addr]
+	if known && old.Timestamp >= pa.Timestamp {
+		n.mu.Unlock()
+		return false
+	}
+	n.addrs[pa.Addr] = pa
+	n.mu.Unlock()
+	n.storeAddress(pa, false)
+	return !known
+}
+
+func (n *Node) removeKnownNode(addr string) {
+	n.mu.Lock()
+	pa, ok := n.addrs[addr]
+	delete(n.addrs, addr)
+	n.mu.Unlock()
+	if ok {
+		n.storeAddress(pa, true)
+	}
+}
+
+// 返回已知节点的地址，最近见过的排在前面
+func (n *Node) knownAddresses() []peerAddress {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	addrs := make([]peerAddress, 0, len(n.addrs))
+	for _, pa := range n.addrs {
+		addrs = append(addrs, pa)
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		if addrs[i].Timestamp != addrs[j].Timestamp {
+			return addrs[i].Timestamp > addrs[j].Timestamp
+		}
+		return addrs[i].Addr < addrs[j].Addr
+	})
+	return addrs
+}
+
+// 返回已知节点列表，最近见过的排在前面
+func (n *Node) KnownNodes() []string {
+	var nodes []string
+	for _, pa := range n.knownAddresses() {
+		nodes = append(nodes, pa.Addr)
+	}
+	return nodes
+}
+
+// 主动连接的数量不足 maxOutboundPeers 时连接更多的已知节点
+func (n *Node) connectMore() {
+	connected := make(map[string]bool)
+	outbound := 0
+	for _, p := range n.Peers() {
+		connected[p.Addr()] = true
+		if !p.inbound {
+			outbound++
+		}
+	}
+	for _, pa := range n.knownAddresses() {
+		if outbound >= maxOutboundPeers {
+			return
+		}
+		if connected[pa.Addr] {
+			continue
+		}
+		if n.peerByAddr(pa.Addr) != nil {
+			outbound++
+		}
+	}
+}
+
+func (n *Node) sendAddr(p *Peer, addrs []peerAddress) {
+	p.Send("addr", addr{addrs})
+}
+
+func (n *Node) sendGetAddr(p *Peer) {
+	p.Send("getaddr", nil)
+}
+
+// 回复最多 maxAddrPerMsg 个最近见过的地址，不包括请求方自己
+func (n *Node) handleGetAddr(p *Peer) {
+	now := time.Now().Unix()
+	addrs := []peerAddress{{n.Address, n.services, now}}
+	for _, pa := range n.knownAddresses() {
+		if len(addrs) >= maxAddrPerMsg {
+			break
+		}
+		if pa.Addr != p.Addr() && pa.Timestamp > 0 {
+			addrs = append(addrs, pa)
+		}
+	}
+	n.sendAddr(p, addrs)
+}
+
+// 记录收到的地址，把新的、最近见过的地址转发给几个其他节点，然后补足主动连接
+func (n *Node) handleAddr(p *Peer, request []byte) {
+	var buff bytes.Buffer
+	var payload addr
+
+	buff.Write(request)
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		n.misbehaving(p, banScoreMalformed, fmt.Sprintf("malformed addr: %v", err))
+		return
+	}
+	if len(payload.AddrList) > maxAddrPerMsg {
+		n.misbehaving(p, banScoreOversizedAddr, fmt.Sprintf("%d addresses in one message", len(payload.AddrList)))
+		return
+	}
+
+	now := time.Now().Unix()
+	var fresh []peerAddress
+	for _, pa := range payload.AddrList {
+		//对方的时钟可能超前
+		if pa.Timestamp > now {
+			pa.Timestamp = now
+		}
+		if pa.Timestamp <= 0 || pa.expired(now) {
+			continue
+		}
+		if n.addAddress(pa) && now-pa.Timestamp < int64(addrRelayWindow/time.Second) {
+			fresh = append(fresh, pa)
+		}
+	}
+	fmt.Printf("There are %d known nodes now!\n", len(n.KnownNodes()))
+
+	//只转发少量地址的消息(通常是节点广播自己的地址)，对 getaddr 的回复不再转发
+	if len(fresh) > 0 && len(payload.AddrList) <= 10 {
+		relayed := 0
+		for _, other := range n.Peers() {
+			if relayed >= addrRelayPeers {
+				break
+			}
+			if other == p || !other.handshakeDone() || other.RemoteVersion().Services&SFNodeFull == 0 {
+				continue
+			}
+			n.sendAddr(other, fresh)
+			relayed++
+		}
+	}
+	//建立连接可能要等待 dialTimeout，在 chainMu 之外进行，不阻塞消息处理
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		n.connectMore()
+	}()
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"log"
+	"net"
+	"sort"
+	"time"
+)
+
+// 保存被封禁节点的bucket，键见 banKey，节点重启后封禁仍然有效
+const bannedBucket = "banned"
+
+// 封禁参数，可以通过 startnode 的参数修改
+var (
+	//连接的违规分数达到这个值时断开并封禁对方
+	banThreshold = 100
+	//封禁的时长
+	banDuration = 24 * time.Hour
+)
+
+// 各种违规行为增加的分数
+const (
+	//消息无法解码
+	banScoreMalformed = 100
+	//区块或区块头不符合共识规则
+	banScoreInvalidBlock = 100
+	//区块时间戳超前太多，可能只是双方的时钟不一致
+	banScoreFutureBlock = 20
+	//交易不符合共识规则
+	banScoreInvalidTx = 10
+	//一条 addr 消息中的地址太多
+	banScoreOversizedAddr = 20
+	//发送了本节点不会请求的消息
+	banScoreUnrequested = 20
+)
+
+// 一条封禁记录，Until 为解除封禁的时间(Unix秒)
+type banEntry struct {
+	Addr   string
+	Until  int64
+	Reason string
+}
+
+func (e banEntry) Serialize() []byte {
+	var buff bytes.Buffer
+	enc := gob.NewEncoder(&buff)
+	err := enc.Encode(e)
+	if err != nil {
+		log.Panic(err)
+	}
+	return buff.Bytes()
+}
+
+func DeserializeBanEntry(data []byte) banEntry {
+	var e banEntry
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	err := dec.Decode(&e)
+	if err != nil {
+		log.Panic(err)
+	}
+	return e
+}
+
+func (e banEntry) expired(now int64) bool {
+	return now >= e.Until
+}
+
+// 返回addr的封禁记录的键
+// 封禁一般按IP记录，对方换一个端口重新连接也会被拒绝；
+// 同一台机器上的节点都是回环地址，按IP封禁会封掉所有本地节点，所以回环地址按"localhost:端口"记录
+func banKey(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if !isLoopback(host) {
+		return host
+	}
+	return net.JoinHostPort("localhost", port)
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// 连接对方的封禁记录的键：按远端IP，回环地址的远端端口是临时的，改用对方报告的监听地址
+func peerBanKey(p *Peer) string {
+	remote := p.conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(remote); err == nil && isLoopback(host) {
+		if addr := p.Addr(); addr != "" {
+			return banKey(addr)
+		}
+	}
+	return banKey(remote)
+}
+
+// 违反共识规则的区块或区块头的违规分数，时间戳超前的分数较低
+func blockBanScore(err error) int {
+	if errors.Is(err, ErrTimeTooNew) {
+		return banScoreFutureBlock
+	}
+	return banScoreInvalidBlock
+}
+
+// 从数据库读取封禁列表，已经到期的记录被删除，结果按地址排序
+func loadBans(db *bolt.DB) []banEntry {
+	var bans []banEntry
+	now := time.Now().Unix()
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bannedBucket))
+		if err != nil {
+			return err
+		}
+		var expired [][]byte
+		b.ForEach(func(k, v []byte) error {
+			e := DeserializeBanEntry(v)
+			if e.expired(now) {
+				expired = append(expired, append([]byte{}, k...))
+			} else {
+				bans = append(bans, e)
+			}
+			return nil
+		})
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Addr < bans[j].Addr
+	})
+	return bans
+}
+
+// 在数据库中保存一条封禁记录
+func storeBan(db *bolt.DB, e banEntry) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bannedBucket)).Put([]byte(e.Addr), e.Serialize())
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// 从数据库中删除addr的封禁记录，记录存在时返回 true，addr 可以带端口
+func deleteBan(db *bolt.DB, addr string) bool {
+	addr = banKey(addr)
+	found := false
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bannedBucket))
+		if err != nil {
+			return err
+		}
+		found = b.Get([]byte(addr)) != nil
+		return b.Delete([]byte(addr))
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	return found
+}
+
+// 从数据库恢复封禁列表
+func (n *Node) loadBans() {
+	for _, e := range loadBans(n.bc.db) {
+		n.banned[e.Addr] = e
+	}
+}
+
+// addr是否在封禁期内，addr 可以带端口
+func (n *Node) isBanned(addr string) bool {
+	key := banKey(addr)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	e, ok := n.banned[key]
+	if ok && e.expired(time.Now().Unix()) {
+		delete(n.banned, key)
+		return false
+	}
+	return ok
+}
+
+// 封禁key banDuration 时长，并断开来自它的所有连接
+func (n *Node) ban(key, reason string) {
+	e := banEntry{key, time.Now().Add(banDuration).Unix(), reason}
+	n.mu.Lock()
+	n.banned[key] = e
+	n.mu.Unlock()
+	storeBan(n.bc.db, e)
+	for _, p := range n.Peers() {
+		if peerBanKey(p) == key {
+			p.Close()
+		}
+	}
+}
+
+// 连接的对方违规时调用，增加它的违规分数，超过 banThreshold 时封禁对方(见 peerBanKey)
+// 对方报告的监听地址从已知节点中移除
+func (n *Node) misbehaving(p *Peer, score int, reason string) {
+	total := p.addBanScore(score)
+	fmt.Printf("Peer %s misbehaving (+%d -> %d): %s\n", p, score, total, reason)
+	if total < banThreshold {
+		return
+	}
+	key := peerBanKey(p)
+	fmt.Printf("Banning %s (%s) for %v\n", key, p, banDuration)
+	n.ban(key, reason)
+	if addr := p.Addr(); addr != "" {
+		n.removeKnownNode(addr)
+	}
+}
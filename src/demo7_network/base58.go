@@ -20,8 +20,11 @@ func Base58Encode(input []byte) []byte {
 		x.DivMod(x, base, mod)
 		result = append(result, b58Alphabet[mod.Int64()])
 	}
-	//0x00版本
-	if input[0] == 0x00 {
+	//每个前导0x00字节编码为一个'1'(0x00版本以及以0开头的公钥哈希)
+	for _, b := range input {
+		if b != 0x00 {
+			break
+		}
 		result = append(result, b58Alphabet[0])
 	}
 	//反转字符串
@@ -41,7 +44,10 @@ func Base58Decode(input []byte) []byte {
 	}
 	decoded := result.Bytes()
 	//返回zeroBytes个byte串联形成的新的切片
-	if input[0] == b58Alphabet[0] {
+	for _, b := range input {
+		if b != b58Alphabet[0] {
+			break
+		}
 		decoded = append([]byte{0x00}, decoded...)
 	}
 
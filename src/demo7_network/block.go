@@ -7,25 +7,34 @@ import (
 	"time"
 )
 
+// 区块头，区块哈希只由区块头计算，交易通过默克尔根与区块头绑定
+type BlockHeader struct {
+	Timestamp     int64  //时间戳
+	PrevBlockHash []byte //前面区块的哈希值
+	MerkleRoot    []byte //所有交易的默克尔根
+	Nonce         int    //用于找到pow
+	Height        int    //区块高度
+	Bits          uint32 //难度目标(压缩格式)
+}
+
 // 区块
 type Block struct {
-	Timestamp     int64          //时间戳
-	Transactions  []*Transaction //存储交易
-	PrevBlockHash []byte         //前面区块的哈希值
-	Hash          []byte         //哈希值
-	Nonce         int            //用于找到pow
-	Height        int            //区块高度
+	BlockHeader
+	Transactions []*Transaction //存储交易
+	Hash         []byte         //哈希值
 }
 
 // 设置创世区块
 func NewGenesisBlock(coinbase *Transaction) *Block {
-	return NewBlock([]*Transaction{coinbase}, []byte{}, 0)
+	return NewBlock([]*Transaction{coinbase}, []byte{}, 0, initialBits, time.Now().Unix())
 }
 
 // 创建区块
-func NewBlock(transactions []*Transaction, prevBlockHash []byte, height int) *Block {
-	block := &Block{time.Now().Unix(), transactions, prevBlockHash, []byte{}, 0, height}
-	pow := NewProofOfWork(block)
+func NewBlock(transactions []*Transaction, prevBlockHash []byte, height int, bits uint32, timestamp int64) *Block {
+	header := BlockHeader{timestamp, prevBlockHash, nil, 0, height, bits}
+	block := &Block{header, transactions, []byte{}}
+	block.MerkleRoot = block.HashTransactions()
+	pow := NewProofOfWork(&block.BlockHeader)
 	nonce, hash := pow.Run()
 	block.Hash = hash[:]
 	block.Nonce = nonce
@@ -71,3 +80,32 @@ func DeserializeBlock(d []byte) *Block {
 	}
 	return &block
 }
+
+// 计算区块头的哈希
+func (h *BlockHeader) Hash() []byte {
+	return NewProofOfWork(h).CalculateHash(h.Nonce)
+}
+
+// 对区块头进行序列化
+func (h *BlockHeader) Serialize() []byte {
+	var result bytes.Buffer
+	encoder := gob.NewEncoder(&result)
+	err := encoder.Encode(h)
+	if err != nil {
+		fmt.Println("Encode file")
+		return nil
+	}
+	return result.Bytes()
+}
+
+// 对区块头进行解序列化
+func DeserializeHeader(d []byte) *BlockHeader {
+	var header BlockHeader
+	decoder := gob.NewDecoder(bytes.NewReader(d))
+	err := decoder.Decode(&header)
+	if err != nil {
+		fmt.Println("Decode file")
+		return nil
+	}
+	return &header
+}
@@ -3,18 +3,38 @@ package main
 import (
 	"bytes"
 	"crypto/ecdsa"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	bolt "go.etcd.io/bbolt"
 	"log"
+	"math/big"
 	"os"
+	"time"
 )
 
 const dbFile = "blockchain_%s.db"
 const blocksBucket = "blocks"
+const sideBlocksBucket = "sideblocks"
+const chainWorkBucket = "chainwork"
+const undoBucket = "undo"
+const metaBucket = "meta"
 const genesisCoinbaseData = "Yaoqi's Blockchain"
 
+// 数据库格式的版本，区块、交易或索引的编码改变时增加
+// 旧版本的区块使用不同的编码和共识规则，无法转换，只能重新创建区块链
+const dbFormatVersion = 1
+
+// 等待数据库文件锁的时间，运行中的节点一直持有这个锁
+const dbOpenTimeout = time.Second
+
+// 侧链区块比链尖低这么多个区块之后删除区块体，只保留区块头
+var sideBlockKeepDepth = 100
+
+// 数据库中没有请求的区块
+var ErrBlockNotFound = errors.New("block is not found")
+
 // 保存区块链
 type Blockchain struct {
 	//数据库中存储的最后一个块的哈希
@@ -32,7 +52,7 @@ func CreateBlockchain(address, nodeID string) *Blockchain {
 	}
 	var tip []byte
 	//构建coinbase交易
-	cbtx := NewCoinbaseTX(address, genesisCoinbaseData)
+	cbtx := NewCoinbaseTX(address, genesisCoinbaseData, 0, 0)
 	genesis := NewGenesisBlock(cbtx)
 	//打开一个 BoltDB 文件
 	db, _ := bolt.Open(dbFile, 0600, nil)
@@ -44,6 +64,13 @@ func CreateBlockchain(address, nodeID string) *Blockchain {
 		//存入键为“l”的表示为最后一个区块的hash
 		b.Put([]byte("l"), genesis.Hash)
 		tip = genesis.Hash
+		for _, name := range []string{sideBlocksBucket, headersBucket, chainWorkBucket, undoBucket, mainChainBucket, metaBucket} {
+			tx.CreateBucket([]byte(name))
+		}
+		tx.Bucket([]byte(metaBucket)).Put([]byte("version"), IntToHex(dbFormatVersion))
+		//存入创世区块的区块头，它的累计工作量就是它自身的工作量
+		storeHeader(tx, genesis.Hash, &genesis.BlockHeader)
+		tx.Bucket([]byte(mainChainBucket)).Put(IntToHex(0), genesis.Hash)
 		return nil
 	})
 	bc := Blockchain{tip, db}
@@ -59,18 +86,43 @@ func PositioningBlockchain(nodeID string) *Blockchain {
 	}
 	var tip []byte
 	//打开一个 BoltDB 文件
-	db, err := bolt.Open(dbFile, 0600, nil)
+	db, err := bolt.Open(dbFile, 0600, &bolt.Options{Timeout: dbOpenTimeout})
+	if err == bolt.ErrTimeout {
+		fmt.Printf("%s is locked by a running node. Stop the node first.\n", dbFile)
+		os.Exit(1)
+	}
 	if err != nil {
 		fmt.Println("Open fail")
 		return nil
 	}
-	//打开一个读写事务
-	db.Update(func(tx *bolt.Tx) error {
+	//旧版本创建的数据库没有格式版本
+	version := int64(0)
+	db.View(func(tx *bolt.Tx) error {
 		//获取了存储区块的 bucket
 		b := tx.Bucket([]byte(blocksBucket))
-		tip = b.Get([]byte("l"))
+		if b != nil {
+			tip = append([]byte{}, b.Get([]byte("l"))...)
+		}
+		if meta := tx.Bucket([]byte(metaBucket)); meta != nil {
+			if v := meta.Get([]byte("version")); v != nil {
+				version = int64(binary.BigEndian.Uint64(v))
+			}
+		}
 		return nil
 	})
+	if version != dbFormatVersion {
+		db.Close()
+		fmt.Printf("%s has format version %d, this program needs version %d. Delete it and recreate the chain with createblockchain (or copy a new blockchain_genesis.db).\n", dbFile, version, dbFormatVersion)
+		os.Exit(1)
+	}
+	//之前创建的数据库可能还没有侧链区块的bucket
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(sideBlocksBucket))
+		return err
+	})
+	if err != nil {
+		log.Panic(err)
+	}
 	//创建 Blockchain
 	bc := Blockchain{tip, db}
 	return &bc
@@ -86,35 +138,30 @@ func dbExists(dbFile string) bool {
 
 // 添加区块
 func (bc *Blockchain) MineBlock(transactions []*Transaction) *Block {
-	var lastHash []byte
-	var lastHeight int
 	//在一笔交易被放入一个块之前进行验证
 	for _, tx := range transactions {
 		if bc.VerifyTransaction(tx) != true {
 			log.Panic("ERROR:Invalid transaction")
 		}
 	}
-	//获取最后一个块的哈希
-	bc.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-		lastHash = b.Get([]byte("l"))
-		blockData := b.Get(lastHash)
-		block := DeserializeBlock(blockData)
-		lastHeight = block.Height
-		return nil
-	})
-	//挖出一个新的块
-	newBlock := NewBlock(transactions, lastHash, lastHeight+1)
-	bc.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-		b.Put(newBlock.Hash, newBlock.Serialize())
-		b.Put([]byte("l"), newBlock.Hash)
-		bc.tip = newBlock.Hash
-		return nil
-	})
+	//挖出一个新的块，并通过 AddBlock 连接到主链上(同时更新UTXO集)
+	newBlock := bc.NewBlockOn(bc.findHeader(bc.tip), transactions)
+	if _, err := bc.AddBlock(newBlock); err != nil {
+		log.Panic(err)
+	}
 	return newBlock
 }
 
+// 在prev之上挖出一个新区块(不写入数据库)
+// 难度按调整规则计算，时间戳必须大于过去中位时间
+func (bc *Blockchain) NewBlockOn(prev *BlockHeader, transactions []*Transaction) *Block {
+	timestamp := time.Now().Unix()
+	if mtp := bc.medianTimePast(prev); timestamp <= mtp {
+		timestamp = mtp + 1
+	}
+	return NewBlock(transactions, prev.Hash(), prev.Height+1, bc.CalcNextRequiredBits(prev), timestamp)
+}
+
 // 通过交易ID查找交易
 func (bc *Blockchain) FindTransaction(ID []byte) (Transaction, error) {
 	bci := bc.Iterator()
@@ -163,7 +210,10 @@ func (bc *Blockchain) FindUTXO() map[string]TXOutputs {
 					}
 				}
 				outs := UTXO[txID]
-				outs.Outputs = append(outs.Outputs, out)
+				if outs.Outputs == nil {
+					outs = TXOutputs{make(map[int]TXOutput), block.Height, tx.IsCoinbase()}
+				}
+				outs.Outputs[outIdx] = out
 				UTXO[txID] = outs
 			}
 			if tx.IsCoinbase() == false {
@@ -265,7 +315,13 @@ func (bc *Blockchain) VerifyTransaction(tx *Transaction) bool {
 	}
 	prevTXs := make(map[string]Transaction)
 	for _, vin := range tx.Vin {
-		prevTX, _ := bc.FindTransaction(vin.Txid)
+		prevTX, err := bc.FindTransaction(vin.Txid)
+		if err != nil {
+			return false
+		}
+		if vin.Vout < 0 || vin.Vout >= len(prevTX.Vout) {
+			return false
+		}
 		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
 	}
 	return tx.Verify(prevTXs)
@@ -280,15 +336,7 @@ func (bc *Blockchain) Iterator() *BlockchainIterator {
 
 //从最新的区块返回区块高度
 func (bc *Blockchain) GetBestHeight() int {
-	var lastBlock Block
-	bc.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-		lastHash := b.Get([]byte("l"))
-		blockData := b.Get(lastHash)
-		lastBlock = *DeserializeBlock(blockData)
-		return nil
-	})
-	return lastBlock.Height
+	return bc.findHeader(bc.tip).Height
 }
 
 //返回链中所有块的哈希表
@@ -296,53 +344,343 @@ func (bc *Blockchain) GetBlockHashes() [][]byte {
 	var blocks [][]byte
 	bci := bc.Iterator()
 	for {
-		block := bci.Next()
-		blocks = append(blocks, block.Hash)
-		if len(block.PrevBlockHash) == 0 {
+		hash := bci.currentHash
+		header := bci.NextHeader()
+		blocks = append(blocks, hash)
+		if len(header.PrevBlockHash) == 0 {
 			break
 		}
 	}
 	return blocks
 }
 
-// 获得块发现一块散列并返回它
-func (bc *Blockchain) GetBlock(blockHash []byte) Block {
+// 获得块发现一块散列并返回它，没有这个区块时返回 ErrBlockNotFound
+// 只返回主链上的区块，侧链区块的交易没有验证过，不提供给其他节点
+func (bc *Blockchain) GetBlock(blockHash []byte) (Block, error) {
 	var block Block
-	bc.db.View(func(tx *bolt.Tx) error {
+	err := bc.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(blocksBucket))
 		blockData := b.Get(blockHash)
 		if blockData == nil {
-			return errors.New("Block is not found.")
+			return fmt.Errorf("%w: %x", ErrBlockNotFound, blockHash)
+		}
+		decoded := DeserializeBlock(blockData)
+		if decoded == nil {
+			return fmt.Errorf("block %x is corrupted", blockHash)
+		}
+		block = *decoded
+		return nil
+	})
+	return block, err
+}
+
+// 检查区块体是否已经存在(主链或侧链)
+func (bc *Blockchain) hasBlock(blockHash []byte) bool {
+	found := false
+	bc.db.View(func(tx *bolt.Tx) error {
+		found = blockData(tx, blockHash) != nil
+		return nil
+	})
+	return found
+}
+
+// 按哈希查找主链或侧链上的区块，不存在时返回 nil
+func (bc *Blockchain) findBlock(blockHash []byte) *Block {
+	var block *Block
+	bc.db.View(func(tx *bolt.Tx) error {
+		if data := blockData(tx, blockHash); data != nil {
+			block = DeserializeBlock(data)
 		}
-		block = *DeserializeBlock(blockData)
 		return nil
 	})
 	return block
 }
 
-//添加区块
-func (bc *Blockchain) AddBlock(block *Block) {
-	bc.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-		blockInDb := b.Get(block.Hash)
-		if blockInDb != nil {
-			return nil
+// 在事务tx中读取区块体，先查主链再查侧链
+func blockData(tx *bolt.Tx, blockHash []byte) []byte {
+	if data := tx.Bucket([]byte(blocksBucket)).Get(blockHash); data != nil {
+		return data
+	}
+	return tx.Bucket([]byte(sideBlocksBucket)).Get(blockHash)
+}
+
+// 新区块加入后主链的变化
+// Disconnected: 从原链尖开始被断开的区块
+// Connected: 按高度顺序新连接到主链的区块
+type ChainUpdate struct {
+	Disconnected []*Block
+	Connected    []*Block
+}
+
+//添加区块，如果新区块所在分叉的累计工作量比当前主链大，就切换到该分叉
+func (bc *Blockchain) AddBlock(block *Block) (*ChainUpdate, error) {
+	if block != nil && bc.hasBlock(block.Hash) {
+		return &ChainUpdate{}, nil
+	}
+	if err := bc.ValidateBlock(block); err != nil {
+		return nil, err
+	}
+	//接在链尖之后的区块在同一个事务中验证并保存，无效区块不会写入数据库
+	if bytes.Equal(block.PrevBlockHash, bc.tip) {
+		if err := bc.connectBlock(block); err != nil {
+			bc.removeBranch(block.Hash)
+			return nil, err
 		}
-		blockData := block.Serialize()
-		err := b.Put(block.Hash, blockData)
+		bc.pruneSideBlocks()
+		return &ChainUpdate{nil, []*Block{block}}, nil
+	}
+	//侧链上的区块要等切换主链时才能验证交易，先单独保存下来用于计算累计工作量，连接到主链之前不提供给其他节点
+	var work *big.Int
+	err := bc.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(sideBlocksBucket))
+		err := b.Put(block.Hash, block.Serialize())
 		if err != nil {
+			return err
+		}
+		work, err = storeHeader(tx, block.Hash, &block.BlockHeader)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if work.Cmp(bc.chainWork(bc.tip)) <= 0 {
+		return &ChainUpdate{}, nil
+	}
+	update, err := bc.reorganize(block)
+	if err != nil {
+		return nil, err
+	}
+	bc.pruneSideBlocks()
+	return update, nil
+}
+
+// 返回以hash结尾的链的累计工作量
+func (bc *Blockchain) chainWork(hash []byte) *big.Int {
+	var work *big.Int
+	bc.db.View(func(tx *bolt.Tx) error {
+		work = chainWorkOf(tx, hash)
+		return nil
+	})
+	return work
+}
+
+// 在事务tx中读取累计工作量，旧数据库中缺失的部分沿父区块头回溯补算
+func chainWorkOf(tx *bolt.Tx, hash []byte) *big.Int {
+	works := tx.Bucket([]byte(chainWorkBucket))
+	headers := tx.Bucket([]byte(headersBucket))
+	total := big.NewInt(0)
+	var missing []*BlockHeader
+	for len(hash) > 0 {
+		if w := works.Get(hash); w != nil {
+			total.SetBytes(w)
+			break
+		}
+		headerData := headers.Get(hash)
+		if headerData == nil {
+			break
+		}
+		header := DeserializeHeader(headerData)
+		missing = append(missing, header)
+		hash = header.PrevBlockHash
+	}
+	for _, header := range missing {
+		total.Add(total, NewProofOfWork(header).Work())
+	}
+	return total
+}
+
+// 把主链切换到以newTip结尾的分叉：先断开原链上分叉点之后的区块，再依次连接新分支
+func (bc *Blockchain) reorganize(newTip *Block) (*ChainUpdate, error) {
+	detach, attach, err := bc.findFork(newTip)
+	if err != nil {
+		return nil, err
+	}
+	if len(detach) > 0 {
+		fmt.Printf("Reorganizing: disconnecting %d blocks, connecting %d blocks\n", len(detach), len(attach))
+	}
+	for _, block := range detach {
+		if err := bc.disconnectBlock(block); err != nil {
 			log.Panic(err)
 		}
-		lastHash := b.Get([]byte("l"))
-		lastBlockData := b.Get(lastHash)
-		lastBlock := DeserializeBlock(lastBlockData)
-		if block.Height > lastBlock.Height {
-			err = b.Put([]byte("l"), block.Hash)
-			if err != nil {
-				log.Panic(err)
+	}
+	for i, block := range attach {
+		if err := bc.connectBlock(block); err != nil {
+			//新分支上有无效区块：恢复原来的主链，并删除无效区块及其后代
+			for j := i - 1; j >= 0; j-- {
+				if err := bc.disconnectBlock(attach[j]); err != nil {
+					log.Panic(err)
+				}
+			}
+			for j := len(detach) - 1; j >= 0; j-- {
+				if err := bc.connectBlock(detach[j]); err != nil {
+					log.Panic(err)
+				}
+			}
+			bc.removeBranch(block.Hash)
+			return nil, err
+		}
+	}
+	return &ChainUpdate{detach, attach}, nil
+}
+
+// 找到当前主链与newTip所在分叉的分叉点
+// 返回需要断开的区块(从链尖往回)和需要连接的区块(从分叉点往后)
+func (bc *Blockchain) findFork(newTip *Block) ([]*Block, []*Block, error) {
+	var detach, attach []*Block
+	oldBlock := bc.findBlock(bc.tip)
+	newBlock := newTip
+	for oldBlock != nil && newBlock != nil && !bytes.Equal(oldBlock.Hash, newBlock.Hash) {
+		if oldBlock.Height >= newBlock.Height {
+			detach = append(detach, oldBlock)
+			oldBlock = bc.findBlock(oldBlock.PrevBlockHash)
+		} else {
+			attach = append([]*Block{newBlock}, attach...)
+			newBlock = bc.findBlock(newBlock.PrevBlockHash)
+		}
+	}
+	if oldBlock == nil || newBlock == nil {
+		return nil, nil, fmt.Errorf("no common ancestor with block %x", newTip.Hash)
+	}
+	return detach, attach, nil
+}
+
+// 验证区块中的交易并把区块连接到链尖(区块的父区块必须是当前链尖)
+// 区块体和区块头与UTXO集在同一个事务中保存，验证失败时都不会写入；侧链上的区块体移到主链
+func (bc *Blockchain) connectBlock(block *Block) error {
+	if !bytes.Equal(block.PrevBlockHash, bc.tip) {
+		return fmt.Errorf("block %x does not extend tip %x", block.Hash, bc.tip)
+	}
+	if err := bc.validateTransactions(block); err != nil {
+		return err
+	}
+	err := bc.db.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket([]byte(blocksBucket)).Put(block.Hash, block.Serialize())
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket([]byte(sideBlocksBucket)).Delete(block.Hash)
+		if err != nil {
+			return err
+		}
+		if _, err := storeHeader(tx, block.Hash, &block.BlockHeader); err != nil {
+			return err
+		}
+		undo, err := UTXOSet{bc}.applyBlock(tx, block)
+		if errors.Is(err, ErrImmatureSpend) {
+			return ruleError(block, ErrImmatureSpend, "%v", err)
+		}
+		if err != nil {
+			return ruleError(block, ErrBadTransaction, "%v", err)
+		}
+		err = tx.Bucket([]byte(undoBucket)).Put(block.Hash, undo.Serialize())
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket([]byte(mainChainBucket)).Put(IntToHex(int64(block.Height)), block.Hash)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(blocksBucket)).Put([]byte("l"), block.Hash)
+	})
+	if err != nil {
+		return err
+	}
+	bc.tip = block.Hash
+	return nil
+}
+
+// 从链尖断开区块，用撤销数据恢复UTXO集，区块体移到侧链
+func (bc *Blockchain) disconnectBlock(block *Block) error {
+	if !bytes.Equal(block.Hash, bc.tip) {
+		return fmt.Errorf("block %x is not the tip", block.Hash)
+	}
+	err := bc.db.Update(func(tx *bolt.Tx) error {
+		undoData := tx.Bucket([]byte(undoBucket)).Get(block.Hash)
+		if undoData == nil {
+			return fmt.Errorf("no undo data for block %x", block.Hash)
+		}
+		err := UTXOSet{bc}.revertBlock(tx, block, DeserializeBlockUndo(undoData))
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket([]byte(undoBucket)).Delete(block.Hash)
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket([]byte(mainChainBucket)).Delete(IntToHex(int64(block.Height)))
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket([]byte(sideBlocksBucket)).Put(block.Hash, block.Serialize())
+		if err != nil {
+			return err
+		}
+		b := tx.Bucket([]byte(blocksBucket))
+		err = b.Delete(block.Hash)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("l"), block.PrevBlockHash)
+	})
+	if err != nil {
+		return err
+	}
+	bc.tip = block.PrevBlockHash
+	return nil
+}
+
+// 删除无效的区块hash及其所有已保存的后代(区块体和区块头)，如果最佳区块头被删除，则退回到当前链尖
+func (bc *Blockchain) removeBranch(hash []byte) {
+	bc.db.Update(func(tx *bolt.Tx) error {
+		h := tx.Bucket([]byte(headersBucket))
+		children := make(map[string][][]byte)
+		h.ForEach(func(k, v []byte) error {
+			if !bytes.Equal(k, []byte("l")) {
+				prev := hex.EncodeToString(DeserializeHeader(v).PrevBlockHash)
+				children[prev] = append(children[prev], append([]byte{}, k...))
+			}
+			return nil
+		})
+		best := append([]byte{}, h.Get([]byte("l"))...)
+		queue := [][]byte{hash}
+		for len(queue) > 0 {
+			hash := queue[0]
+			queue = append(queue[1:], children[hex.EncodeToString(hash)]...)
+			tx.Bucket([]byte(blocksBucket)).Delete(hash)
+			tx.Bucket([]byte(sideBlocksBucket)).Delete(hash)
+			tx.Bucket([]byte(chainWorkBucket)).Delete(hash)
+			h.Delete(hash)
+			if bytes.Equal(best, hash) {
+				h.Put([]byte("l"), bc.tip)
 			}
-			bc.tip = block.Hash
 		}
 		return nil
 	})
 }
+
+// 删除比链尖低 sideBlockKeepDepth 个区块以上的侧链区块体，区块头保留
+// 这些分支已经不太可能再成为主链，需要时会按区块头重新下载
+func (bc *Blockchain) pruneSideBlocks() {
+	height := bc.GetBestHeight()
+	err := bc.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(sideBlocksBucket))
+		headers := tx.Bucket([]byte(headersBucket))
+		var stale [][]byte
+		b.ForEach(func(k, v []byte) error {
+			header := DeserializeHeader(headers.Get(k))
+			if header == nil || header.Height+sideBlockKeepDepth <= height {
+				stale = append(stale, append([]byte{}, k...))
+			}
+			return nil
+		})
+		for _, k := range stale {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
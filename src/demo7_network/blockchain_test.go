@@ -0,0 +1,939 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+)
+
+// 在临时目录中创建一条只有创世区块的链
+func newTestBlockchain(t *testing.T) (*Blockchain, *Wallet) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	wallet := NewWallet()
+	bc := CreateBlockchain(string(wallet.GetAddress()), "test")
+	t.Cleanup(func() { bc.db.Close() })
+	UTXOSet{bc}.Reindex()
+	return bc, wallet
+}
+
+func TestAddBlockAcceptsValidBlock(t *testing.T) {
+	bc, wallet := newTestBlockchain(t)
+	utxo := UTXOSet{bc}
+	to := NewWallet()
+	tx := NewUTXOTransaction(wallet, string(to.GetAddress()), 3, 0, &utxo)
+	cbTx := NewCoinbaseTX(string(wallet.GetAddress()), "", 1, 0)
+	block := bc.NewBlockOn(bc.findHeader(bc.tip), []*Transaction{cbTx, tx})
+
+	if _, err := bc.AddBlock(block); err != nil {
+		t.Fatalf("AddBlock: %v", err)
+	}
+	if bc.GetBestHeight() != 1 {
+		t.Fatalf("best height = %d, want 1", bc.GetBestHeight())
+	}
+}
+
+func TestAddBlockRejectsInvalidBlocks(t *testing.T) {
+	bc, wallet := newTestBlockchain(t)
+	address := string(wallet.GetAddress())
+	genesis := bc.findHeader(bc.tip)
+	now := time.Now().Unix() + 1
+
+	tamperedNonce := bc.NewBlockOn(genesis, []*Transaction{NewCoinbaseTX(address, "", 1, 0)})
+	tamperedNonce.Nonce++
+
+	bigCoinbase := NewCoinbaseTX(address, "", 1, 0)
+	bigCoinbase.Vout[0].Value = initialSubsidy + 1
+	bigCoinbase.ID = bigCoinbase.Hash()
+
+	badSignature := NewUTXOTransaction(wallet, string(NewWallet().GetAddress()), 3, 0, &UTXOSet{bc})
+	//解锁脚本的第一个字节是签名的长度
+	badSignature.Vin[0].ScriptSig[1] ^= 0xff
+
+	tests := []struct {
+		name  string
+		block *Block
+		want  error
+	}{
+		{"tampered nonce", tamperedNonce, ErrBadBlockHash},
+		{"wrong height", NewBlock([]*Transaction{NewCoinbaseTX(address, "", 1, 0)}, bc.tip, 2, initialBits, now), ErrBadHeight},
+		{"unknown parent", NewBlock([]*Transaction{NewCoinbaseTX(address, "", 1, 0)}, []byte("unknown"), 1, initialBits, now), ErrOrphanBlock},
+		{"easier target", NewBlock([]*Transaction{NewCoinbaseTX(address, "", 1, 0)}, bc.tip, 1, initialBits+1, now), ErrBadDifficulty},
+		{"old timestamp", NewBlock([]*Transaction{NewCoinbaseTX(address, "", 1, 0)}, bc.tip, 1, initialBits, genesis.Timestamp), ErrBadTimestamp},
+		{"coinbase too large", bc.NewBlockOn(genesis, []*Transaction{bigCoinbase}), ErrBadCoinbase},
+		{"bad signature", bc.NewBlockOn(genesis, []*Transaction{NewCoinbaseTX(address, "", 1, 0), badSignature}), ErrBadTransaction},
+	}
+	for _, tt := range tests {
+		_, err := bc.AddBlock(tt.block)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+		if bc.findBlock(tt.block.Hash) != nil {
+			t.Errorf("%s: rejected block was stored", tt.name)
+		}
+	}
+}
+
+func balanceOf(u UTXOSet, w *Wallet) int {
+	balance := 0
+	for _, out := range u.FindUTXO(HashPubKey(w.PublicKey)) {
+		balance += out.Value
+	}
+	return balance
+}
+
+func TestAddBlockReorganizesToChainWithMoreWork(t *testing.T) {
+	bc, wallet := newTestBlockchain(t)
+	utxo := UTXOSet{bc}
+	genesis := bc.findHeader(bc.tip)
+	miner, receiver := NewWallet(), NewWallet()
+	minerAddress := string(miner.GetAddress())
+
+	spend := NewUTXOTransaction(wallet, string(receiver.GetAddress()), 4, 0, &utxo)
+	a1 := bc.NewBlockOn(genesis, []*Transaction{NewCoinbaseTX(minerAddress, "a1", 1, 0), spend})
+	if _, err := bc.AddBlock(a1); err != nil {
+		t.Fatalf("AddBlock(a1): %v", err)
+	}
+	if balanceOf(utxo, receiver) != 4 {
+		t.Fatalf("receiver balance = %d, want 4", balanceOf(utxo, receiver))
+	}
+
+	//同样工作量的分叉不会切换主链
+	b1 := bc.NewBlockOn(genesis, []*Transaction{NewCoinbaseTX(minerAddress, "b1", 1, 0)})
+	update, err := bc.AddBlock(b1)
+	if err != nil {
+		t.Fatalf("AddBlock(b1): %v", err)
+	}
+	if len(update.Connected) != 0 || !bytes.Equal(bc.tip, a1.Hash) {
+		t.Fatalf("tip switched to a fork with equal work")
+	}
+
+	b2 := bc.NewBlockOn(&b1.BlockHeader, []*Transaction{NewCoinbaseTX(minerAddress, "b2", 2, 0)})
+	update, err = bc.AddBlock(b2)
+	if err != nil {
+		t.Fatalf("AddBlock(b2): %v", err)
+	}
+	if !bytes.Equal(bc.tip, b2.Hash) {
+		t.Fatalf("tip = %x, want %x", bc.tip, b2.Hash)
+	}
+	if len(update.Disconnected) != 1 || !bytes.Equal(update.Disconnected[0].Hash, a1.Hash) {
+		t.Fatalf("disconnected = %v, want [a1]", update.Disconnected)
+	}
+	if len(update.Connected) != 2 || !bytes.Equal(update.Connected[1].Hash, b2.Hash) {
+		t.Fatalf("connected = %v, want [b1 b2]", update.Connected)
+	}
+
+	//a1 中的花费被撤销，创世区块的奖励重新可用
+	if got := balanceOf(utxo, wallet); got != initialSubsidy {
+		t.Errorf("wallet balance = %d, want %d", got, initialSubsidy)
+	}
+	if got := balanceOf(utxo, receiver); got != 0 {
+		t.Errorf("receiver balance = %d, want 0", got)
+	}
+	if got := balanceOf(utxo, miner); got != 2*initialSubsidy {
+		t.Errorf("miner balance = %d, want %d", got, 2*initialSubsidy)
+	}
+}
+
+func TestInvalidSideBranchIsRemoved(t *testing.T) {
+	bc, wallet := newTestBlockchain(t)
+	address := string(wallet.GetAddress())
+	genesis := bc.findHeader(bc.tip)
+
+	a1 := bc.NewBlockOn(genesis, []*Transaction{NewCoinbaseTX(address, "a1", 1, 0)})
+	if _, err := bc.AddBlock(a1); err != nil {
+		t.Fatalf("AddBlock(a1): %v", err)
+	}
+
+	//侧链上签名无效的区块只有在切换主链时才会被发现
+	badSignature := NewUTXOTransaction(wallet, string(NewWallet().GetAddress()), 3, 0, &UTXOSet{bc})
+	badSignature.Vin[0].ScriptSig[1] ^= 0xff
+	b1 := bc.NewBlockOn(genesis, []*Transaction{NewCoinbaseTX(address, "b1", 1, 0), badSignature})
+	if _, err := bc.AddBlock(b1); err != nil {
+		t.Fatalf("AddBlock(b1): %v", err)
+	}
+	b2 := bc.NewBlockOn(&b1.BlockHeader, []*Transaction{NewCoinbaseTX(address, "b2", 2, 0)})
+	c2 := bc.NewBlockOn(&b1.BlockHeader, []*Transaction{NewCoinbaseTX(address, "c2", 2, 0)})
+	if err := bc.AddHeader(&c2.BlockHeader); err != nil {
+		t.Fatalf("AddHeader(c2): %v", err)
+	}
+
+	if _, err := bc.AddBlock(b2); !errors.Is(err, ErrBadTransaction) {
+		t.Fatalf("AddBlock(b2): got %v, want %v", err, ErrBadTransaction)
+	}
+	if !bytes.Equal(bc.tip, a1.Hash) {
+		t.Fatalf("tip = %x, want %x", bc.tip, a1.Hash)
+	}
+	//无效区块和它的所有后代都被删除，最佳区块头退回到链尖
+	for _, block := range []*Block{b1, b2, c2} {
+		if bc.findBlock(block.Hash) != nil || bc.findHeader(block.Hash) != nil {
+			t.Errorf("block %x on the invalid branch was kept", block.Hash)
+		}
+	}
+	if !bytes.Equal(bc.BestHeaderHash(), a1.Hash) {
+		t.Errorf("best header = %x, want %x", bc.BestHeaderHash(), a1.Hash)
+	}
+}
+
+func TestSideBlocksAreNotServedAndPruned(t *testing.T) {
+	bc, wallet := newTestBlockchain(t)
+	address := string(wallet.GetAddress())
+	genesis := bc.findHeader(bc.tip)
+	defer func(depth int) { sideBlockKeepDepth = depth }(sideBlockKeepDepth)
+	sideBlockKeepDepth = 2
+
+	a1 := bc.NewBlockOn(genesis, []*Transaction{NewCoinbaseTX(address, "a1", 1, 0)})
+	b1 := bc.NewBlockOn(genesis, []*Transaction{NewCoinbaseTX(address, "b1", 1, 0)})
+	for _, block := range []*Block{a1, b1} {
+		if _, err := bc.AddBlock(block); err != nil {
+			t.Fatalf("AddBlock(%x): %v", block.Hash, err)
+		}
+	}
+	//侧链区块的交易还没有验证，保存下来但不提供给其他节点
+	if !bc.hasBlock(b1.Hash) {
+		t.Fatal("side block b1 was not stored")
+	}
+	if _, err := bc.GetBlock(b1.Hash); !errors.Is(err, ErrBlockNotFound) {
+		t.Fatalf("GetBlock(b1): got %v, want %v", err, ErrBlockNotFound)
+	}
+
+	//切换主链后 b1 可以提供，被断开的 a1 移到侧链
+	b2 := bc.NewBlockOn(&b1.BlockHeader, []*Transaction{NewCoinbaseTX(address, "b2", 2, 0)})
+	if _, err := bc.AddBlock(b2); err != nil {
+		t.Fatalf("AddBlock(b2): %v", err)
+	}
+	if _, err := bc.GetBlock(b1.Hash); err != nil {
+		t.Fatalf("GetBlock(b1) after reorganization: %v", err)
+	}
+	if _, err := bc.GetBlock(a1.Hash); !errors.Is(err, ErrBlockNotFound) {
+		t.Fatalf("GetBlock(a1) after reorganization: got %v, want %v", err, ErrBlockNotFound)
+	}
+	if !bc.hasBlock(a1.Hash) {
+		t.Fatal("disconnected block a1 was dropped")
+	}
+
+	//链尖比 a1 高出 sideBlockKeepDepth 之后 a1 的区块体被删除，区块头保留
+	bc.MineBlock([]*Transaction{NewCoinbaseTX(address, "", 3, 0)})
+	if bc.hasBlock(a1.Hash) {
+		t.Fatal("stale side block a1 was not pruned")
+	}
+	if bc.findHeader(a1.Hash) == nil {
+		t.Error("header of the pruned side block was removed")
+	}
+}
+
+func TestCalcRetargetBits(t *testing.T) {
+	targetTimespan := int64(retargetInterval) * targetBlockSpacing
+	target := CompactToBig(initialBits)
+	tests := []struct {
+		name     string
+		timespan int64
+		want     *big.Int
+	}{
+		{"on schedule", targetTimespan, target},
+		{"twice as slow", targetTimespan * 2, new(big.Int).Mul(target, big.NewInt(2))},
+		{"twice as fast", targetTimespan / 2, new(big.Int).Div(target, big.NewInt(2))},
+		{"clamped fast", 0, new(big.Int).Div(target, big.NewInt(4))},
+		{"clamped slow", targetTimespan * 100, new(big.Int).Mul(target, big.NewInt(4))},
+	}
+	for _, tt := range tests {
+		got := CompactToBig(CalcRetargetBits(initialBits, tt.timespan))
+		if got.Cmp(tt.want) != 0 {
+			t.Errorf("%s: target = %x, want %x", tt.name, got, tt.want)
+		}
+	}
+	if got := CompactToBig(CalcRetargetBits(BigToCompact(powLimit), targetTimespan*4)); got.Cmp(powLimit) > 0 {
+		t.Errorf("target %x exceeds pow limit", got)
+	}
+}
+
+func TestHeadersFirstSync(t *testing.T) {
+	bc, wallet := newTestBlockchain(t)
+	address := string(wallet.GetAddress())
+	genesis := bc.tip
+
+	//只接收区块头时主链不变，但可以知道缺少哪些区块体
+	var blocks []*Block
+	prev := bc.findHeader(genesis)
+	for i := 0; i < 3; i++ {
+		block := bc.NewBlockOn(prev, []*Transaction{NewCoinbaseTX(address, "", i+1, 0)})
+		if err := bc.AddHeader(&block.BlockHeader); err != nil {
+			t.Fatalf("AddHeader: %v", err)
+		}
+		blocks = append(blocks, block)
+		prev = &block.BlockHeader
+	}
+	if !bytes.Equal(bc.BestHeaderHash(), blocks[2].Hash) {
+		t.Fatalf("best header = %x, want %x", bc.BestHeaderHash(), blocks[2].Hash)
+	}
+	if !bytes.Equal(bc.tip, genesis) {
+		t.Fatalf("tip moved without block bodies")
+	}
+	missing := bc.MissingBlocks()
+	if len(missing) != 3 || !bytes.Equal(missing[0], blocks[0].Hash) {
+		t.Fatalf("missing = %x, want the 3 new blocks in height order", missing)
+	}
+
+	for _, block := range blocks {
+		if _, err := bc.AddBlock(block); err != nil {
+			t.Fatalf("AddBlock: %v", err)
+		}
+	}
+	if len(bc.MissingBlocks()) != 0 {
+		t.Fatalf("still missing blocks after download")
+	}
+
+	//定位器只包含创世区块时，返回创世区块之后的所有主链区块
+	hashes := bc.LocateHashes([][]byte{genesis}, nil, maxHeadersPerMsg)
+	if len(hashes) != 3 || !bytes.Equal(hashes[2], blocks[2].Hash) {
+		t.Fatalf("LocateHashes = %x", hashes)
+	}
+	if hashes := bc.LocateHashes(bc.BlockLocator(), nil, maxHeadersPerMsg); len(hashes) != 0 {
+		t.Fatalf("LocateHashes from own tip = %x, want none", hashes)
+	}
+}
+
+func TestMinerSelectsByFeeRateAndClaimsFees(t *testing.T) {
+	bc, alice := newTestBlockchain(t)
+	utxo := UTXOSet{bc}
+	bob, miner := NewWallet(), NewWallet()
+	minerAddress := string(miner.GetAddress())
+
+	split := NewUTXOTransaction(alice, string(bob.GetAddress()), 5, 0, &utxo)
+	bc.MineBlock([]*Transaction{NewCoinbaseTX(minerAddress, "", 1, 0), split})
+
+	lowFee := NewUTXOTransaction(alice, minerAddress, 2, 1, &utxo)
+	highFee := NewUTXOTransaction(bob, minerAddress, 2, 3, &utxo)
+	txs, fees := selectTransactions(bc, []*Transaction{lowFee, highFee})
+	if len(txs) != 2 || !bytes.Equal(txs[0].ID, highFee.ID) || fees != 4 {
+		t.Fatalf("selected %d txs with fees %d, want high fee first and fees 4", len(txs), fees)
+	}
+
+	prev := bc.findHeader(bc.tip)
+	greedy := bc.NewBlockOn(prev, append([]*Transaction{NewCoinbaseTX(minerAddress, "greedy", 2, fees+1)}, txs...))
+	if _, err := bc.AddBlock(greedy); !errors.Is(err, ErrBadCoinbase) {
+		t.Fatalf("coinbase claiming more than subsidy+fees: got %v, want %v", err, ErrBadCoinbase)
+	}
+	block := bc.NewBlockOn(prev, append([]*Transaction{NewCoinbaseTX(minerAddress, "", 2, fees)}, txs...))
+	if _, err := bc.AddBlock(block); err != nil {
+		t.Fatalf("AddBlock: %v", err)
+	}
+	if got, want := balanceOf(utxo, miner), 2*initialSubsidy+4+4; got != want {
+		t.Errorf("miner balance = %d, want %d", got, want)
+	}
+}
+
+func TestBlockSubsidyHalving(t *testing.T) {
+	tests := []struct {
+		height int
+		want   int
+	}{
+		{0, initialSubsidy},
+		{subsidyHalvingInterval - 1, initialSubsidy},
+		{subsidyHalvingInterval, initialSubsidy / 2},
+		{2 * subsidyHalvingInterval, initialSubsidy / 4},
+		{64 * subsidyHalvingInterval, 0},
+	}
+	for _, tt := range tests {
+		if got := GetBlockSubsidy(tt.height); got != tt.want {
+			t.Errorf("GetBlockSubsidy(%d) = %d, want %d", tt.height, got, tt.want)
+		}
+	}
+	//10 + 5 + 2 + 1
+	if got, want := MaxSupply(), 18*subsidyHalvingInterval; got != want {
+		t.Errorf("MaxSupply() = %d, want %d", got, want)
+	}
+}
+
+func TestCoinbaseMaturity(t *testing.T) {
+	defer func(maturity int) { coinbaseMaturity = maturity }(coinbaseMaturity)
+	coinbaseMaturity = 3
+	bc, alice := newTestBlockchain(t)
+	utxo := UTXOSet{bc}
+	miner := NewWallet()
+	minerAddress := string(miner.GetAddress())
+	pubKeyHash := HashPubKey(miner.PublicKey)
+
+	reward := NewCoinbaseTX(minerAddress, "", 1, 0)
+	bc.MineBlock([]*Transaction{reward})
+	if balance, immature := utxo.GetBalance(pubKeyHash); balance != 0 || immature != initialSubsidy {
+		t.Fatalf("GetBalance = %d, %d, want 0, %d", balance, immature, initialSubsidy)
+	}
+	if acc, _ := utxo.FindSpendableOutputs(pubKeyHash, 1); acc != 0 {
+		t.Fatalf("FindSpendableOutputs found %d in immature coinbase", acc)
+	}
+
+	spend := &Transaction{nil, []TXInput{{reward.ID, 0, nil, sequenceFinal}}, []TXOutput{*NewTXOutput(initialSubsidy, string(alice.GetAddress()))}, 0}
+	spend.ID = spend.Hash()
+	bc.SignTransaction(spend, miner.PrivateKey)
+	premature := bc.NewBlockOn(bc.findHeader(bc.tip), []*Transaction{NewCoinbaseTX(string(alice.GetAddress()), "", 2, 0), spend})
+	if _, err := bc.AddBlock(premature); !errors.Is(err, ErrImmatureSpend) {
+		t.Fatalf("spending coinbase after 1 block: got %v, want %v", err, ErrImmatureSpend)
+	}
+	if txs, _ := selectTransactions(bc, []*Transaction{spend}); len(txs) != 0 {
+		t.Fatalf("miner selected a transaction spending an immature coinbase")
+	}
+
+	for height := 2; height <= 3; height++ {
+		bc.MineBlock([]*Transaction{NewCoinbaseTX(string(alice.GetAddress()), "", height, 0)})
+	}
+	if balance, immature := utxo.GetBalance(pubKeyHash); balance != initialSubsidy || immature != 0 {
+		t.Fatalf("GetBalance after maturity = %d, %d, want %d, 0", balance, immature, initialSubsidy)
+	}
+	txs, _ := selectTransactions(bc, []*Transaction{spend})
+	bc.MineBlock(append([]*Transaction{NewCoinbaseTX(string(alice.GetAddress()), "", 4, 0)}, txs...))
+	if _, ok := utxo.FindOutput(reward.ID, 0); ok {
+		t.Fatalf("matured coinbase output was not spent")
+	}
+}
+
+func TestDoubleSpendRejected(t *testing.T) {
+	bc, alice := newTestBlockchain(t)
+	mempool := NewMempool(bc)
+	utxo := UTXOSet{bc}
+	address := string(alice.GetAddress())
+
+	toBob := NewUTXOTransaction(alice, string(NewWallet().GetAddress()), 3, 0, &utxo)
+	toCarol := NewUTXOTransaction(alice, string(NewWallet().GetAddress()), 3, 0, &utxo)
+	if err := mempool.Add(*toBob); err != nil {
+		t.Fatalf("Mempool.Add: %v", err)
+	}
+	if err := mempool.Add(*toCarol); !errors.Is(err, ErrMempoolConflict) {
+		t.Fatalf("conflicting tx: got %v, want %v", err, ErrMempoolConflict)
+	}
+	if txs, _ := selectTransactions(bc, []*Transaction{toBob, toCarol}); len(txs) != 1 {
+		t.Fatalf("miner selected %d conflicting txs, want 1", len(txs))
+	}
+
+	both := bc.NewBlockOn(bc.findHeader(bc.tip), []*Transaction{NewCoinbaseTX(address, "", 1, 0), toBob, toCarol})
+	if _, err := bc.AddBlock(both); !errors.Is(err, ErrDoubleSpend) {
+		t.Fatalf("block spending an output twice: got %v, want %v", err, ErrDoubleSpend)
+	}
+
+	//区块打包了 toCarol 之后，与之冲突的 toBob 被移出内存池，并且不能再进入
+	block := bc.NewBlockOn(bc.findHeader(bc.tip), []*Transaction{NewCoinbaseTX(address, "", 1, 0), toCarol})
+	update, err := bc.AddBlock(block)
+	if err != nil {
+		t.Fatalf("AddBlock: %v", err)
+	}
+	mempool.UpdateChain(update)
+	if mempool.Count() != 0 || len(mempool.spends) != 0 {
+		t.Fatalf("mempool still has %d txs and %d spends", mempool.Count(), len(mempool.spends))
+	}
+	if err := mempool.Add(*toBob); !errors.Is(err, ErrMissingInputs) {
+		t.Fatalf("tx spending a spent output: got %v, want %v", err, ErrMissingInputs)
+	}
+}
+
+func TestMempoolEvictionExpiryAndPersistence(t *testing.T) {
+	bc, alice := newTestBlockchain(t)
+	utxo := UTXOSet{bc}
+	bob := NewWallet()
+	split := NewUTXOTransaction(alice, string(bob.GetAddress()), 5, 0, &utxo)
+	bc.MineBlock([]*Transaction{NewCoinbaseTX(string(alice.GetAddress()), "", 1, 0), split})
+
+	mempool := NewMempool(bc)
+	lowFee := NewUTXOTransaction(alice, string(NewWallet().GetAddress()), 1, 1, &utxo)
+	highFee := NewUTXOTransaction(bob, string(NewWallet().GetAddress()), 1, 3, &utxo)
+	if err := mempool.Add(*lowFee); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	//内存池只能放下一笔交易时，费率更高的交易挤掉费率低的
+	defer func(size int) { maxMempoolSize = size }(maxMempoolSize)
+	maxMempoolSize = mempool.Size() + 1
+	if err := mempool.Add(*highFee); err != nil {
+		t.Fatalf("Add high fee: %v", err)
+	}
+	if mempool.Has(lowFee.ID) || !mempool.Has(highFee.ID) {
+		t.Fatalf("low fee tx was not evicted")
+	}
+	if err := mempool.Add(*lowFee); !errors.Is(err, ErrMempoolFull) {
+		t.Fatalf("low fee tx into full mempool: got %v, want %v", err, ErrMempoolFull)
+	}
+
+	//重新打开数据库后内存池恢复
+	bc.db.Close()
+	bc = PositioningBlockchain("test")
+	mempool = NewMempool(bc)
+	if mempool.Count() != 1 || !mempool.Has(highFee.ID) {
+		t.Fatalf("mempool after restart has %d txs, want the high fee tx", mempool.Count())
+	}
+	if txs := mempool.Transactions(); len(txs) != 1 || !bytes.Equal(txs[0].ID, highFee.ID) {
+		t.Fatalf("Transactions() = %v", txs)
+	}
+
+	mempool.mu.Lock()
+	mempool.expire(time.Now().Add(mempoolExpiry + time.Minute))
+	mempool.mu.Unlock()
+	if mempool.Count() != 0 || mempool.Size() != 0 {
+		t.Fatalf("expired tx still in mempool")
+	}
+	bc.db.Close()
+	bc = PositioningBlockchain("test")
+	defer bc.db.Close()
+	if NewMempool(bc).Count() != 0 {
+		t.Fatalf("expired tx restored after restart")
+	}
+}
+
+func TestPartialMerkleProof(t *testing.T) {
+	for total := 1; total <= 9; total++ {
+		var data [][]byte
+		for i := 0; i < total; i++ {
+			data = append(data, []byte{byte(i)})
+		}
+		tree := NewMerkleTree(data)
+		//匹配第一笔、最后一笔和下标为3的倍数的交易
+		matches := make([]bool, total)
+		var want [][]byte
+		for i := range matches {
+			matches[i] = i == 0 || i == total-1 || i%3 == 0
+			if matches[i] {
+				leaf := sha256.Sum256(data[i])
+				want = append(want, leaf[:])
+			}
+		}
+		hashes, flags := tree.PartialProof(matches)
+		root, matched, err := VerifyPartialProof(total, hashes, flags)
+		if err != nil {
+			t.Fatalf("%d txs: %v", total, err)
+		}
+		if !bytes.Equal(root, tree.RootNode.Data) {
+			t.Fatalf("%d txs: root mismatch", total)
+		}
+		if len(matched) != len(want) {
+			t.Fatalf("%d txs: matched %d leaves, want %d", total, len(matched), len(want))
+		}
+		for i := range want {
+			if !bytes.Equal(matched[i], want[i]) {
+				t.Fatalf("%d txs: matched leaf %d differs", total, i)
+			}
+		}
+		//篡改一个哈希后根哈希不同
+		hashes[0] = append([]byte{}, hashes[0]...)
+		hashes[0][0] ^= 0xff
+		if root, _, err := VerifyPartialProof(total, hashes, flags); err == nil && bytes.Equal(root, tree.RootNode.Data) {
+			t.Fatalf("%d txs: tampered proof verified", total)
+		}
+	}
+}
+
+func TestScriptInterpreter(t *testing.T) {
+	bc, alice := newTestBlockchain(t)
+	utxo := UTXOSet{bc}
+	bob := NewWallet()
+	pay := NewUTXOTransaction(alice, string(bob.GetAddress()), 3, 0, &utxo)
+	if !bc.VerifyTransaction(pay) {
+		t.Fatal("pay-to-pubkey-hash spend rejected")
+	}
+	genesis, _ := bc.GetBlock(bc.tip)
+	lock := genesis.Transactions[0].Vout[0].ScriptPubKey
+
+	//bob 的签名不能花费 alice 的输出
+	stolen := *pay
+	stolen.Vin = []TXInput{{pay.Vin[0].Txid, pay.Vin[0].Vout, nil, sequenceFinal}}
+	stolen.Vin[0].ScriptSig = P2PKHScriptSig(stolen.SignInput(0, bob.PrivateKey, lock), bob.PublicKey)
+	if err := VerifyScript(stolen.Vin[0].ScriptSig, lock, &stolen, 0); !errors.Is(err, ErrVerifyFailed) {
+		t.Fatalf("spend with the wrong key: got %v, want %v", err, ErrVerifyFailed)
+	}
+
+	//只需要知道原像就能花费的哈希锁
+	secret := []byte("open sesame")
+	hash := sha256.Sum256(secret)
+	hashLock := NewScriptBuilder().AddOp(OP_SHA256).AddData(hash[:]).AddOp(OP_EQUAL).Script()
+	push := func(data []byte) []byte { return NewScriptBuilder().AddData(data).Script() }
+	tests := []struct {
+		name      string
+		scriptSig []byte
+		lock      []byte
+		want      error
+	}{
+		{"hash lock", push(secret), hashLock, nil},
+		{"wrong preimage", push([]byte("guess")), hashLock, ErrScriptFalse},
+		{"empty stack", nil, hashLock, ErrStackUnderflow},
+		{"non-push scriptSig", append(push(secret), OP_DUP), hashLock, ErrScriptSigPush},
+		{"OP_RETURN", push(secret), []byte{OP_RETURN}, ErrEarlyReturn},
+		{"truncated push", []byte{5, 1, 2}, hashLock, ErrMalformedScript},
+		{"unknown opcode", push(secret), []byte{0xff}, ErrBadOpcode},
+		{"large push", push(bytes.Repeat([]byte{1}, 300)), []byte{OP_DROP, OP_TRUE}, nil},
+		{"if branch", []byte{OP_TRUE}, []byte{OP_IF, OP_TRUE, OP_ELSE, OP_RETURN, OP_ENDIF}, nil},
+		{"else branch", []byte{OP_FALSE}, []byte{OP_IF, OP_RETURN, OP_ELSE, OP_TRUE, OP_ENDIF}, nil},
+		{"nested skipped branch", []byte{OP_FALSE}, []byte{OP_IF, OP_IF, OP_RETURN, OP_ENDIF, OP_ELSE, OP_TRUE, OP_ENDIF}, nil},
+		{"notif", []byte{OP_FALSE}, []byte{OP_NOTIF, OP_TRUE, OP_ENDIF}, nil},
+		{"missing endif", []byte{OP_TRUE}, []byte{OP_IF, OP_TRUE}, ErrUnbalancedIf},
+		{"else without if", []byte{OP_TRUE}, []byte{OP_ELSE}, ErrUnbalancedIf},
+	}
+	for _, tt := range tests {
+		if err := VerifyScript(tt.scriptSig, tt.lock, pay, 0); !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+
+	//锁定到哈希锁的输出可以在区块中被花费
+	locked := &Transaction{nil, pay.Vin, []TXOutput{{initialSubsidy, hashLock}}, 0}
+	locked.ID = locked.Hash()
+	bc.SignTransaction(locked, alice.PrivateKey)
+	bc.MineBlock([]*Transaction{NewCoinbaseTX(string(alice.GetAddress()), "", 1, 0), locked})
+	unlock := &Transaction{nil, []TXInput{{locked.ID, 0, push(secret), sequenceFinal}}, []TXOutput{*NewTXOutput(initialSubsidy, string(bob.GetAddress()))}, 0}
+	unlock.ID = unlock.Hash()
+	bc.MineBlock([]*Transaction{NewCoinbaseTX(string(alice.GetAddress()), "", 2, 0), unlock})
+	if balanceOf(utxo, bob) != initialSubsidy {
+		t.Fatalf("bob has %d after unlocking the hash lock", balanceOf(utxo, bob))
+	}
+}
+
+func TestMultisigPartialSigning(t *testing.T) {
+	bc, alice := newTestBlockchain(t)
+	utxo := UTXOSet{bc}
+	a, b, c, bob := NewWallet(), NewWallet(), NewWallet(), NewWallet()
+	multisig, err := MultisigScript(2, [][]byte{a.PublicKey, b.PublicKey, c.PublicKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//alice 把币转入 2-of-3 多重签名
+	fund := NewPartialTransaction(P2PKHScript(HashPubKey(alice.PublicKey)), multisig, 6, 0, &utxo)
+	if n := fund.Sign(alice); n != len(fund.Inputs) {
+		t.Fatalf("alice signed %d of %d inputs", n, len(fund.Inputs))
+	}
+	fundTx, err := fund.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc.MineBlock([]*Transaction{NewCoinbaseTX(string(alice.GetAddress()), "", 1, 0), fundTx})
+
+	//每个签名方拿到一份副本，分别签名后合并
+	spend := NewPartialTransaction(multisig, P2PKHScript(HashPubKey(bob.PublicKey)), 4, 1, &utxo)
+	copyA := DeserializePartialTransaction(spend.Serialize())
+	copyC := DeserializePartialTransaction(spend.Serialize())
+	if copyA.Sign(a) != 1 || copyC.Sign(c) != 1 || spend.Sign(bob) != 0 {
+		t.Fatal("unexpected number of signatures")
+	}
+	if _, err := copyA.Finalize(); !errors.Is(err, ErrNotEnoughSigs) {
+		t.Fatalf("finalize with one signature: got %v, want %v", err, ErrNotEnoughSigs)
+	}
+	if err := copyA.Combine(copyC); err != nil {
+		t.Fatal(err)
+	}
+	spendTx, err := copyA.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//签名必须按公钥的顺序排列，同一个签名不能使用两次
+	sigA := copyA.Inputs[0].Signatures[hex.EncodeToString(a.PublicKey)]
+	sigC := copyA.Inputs[0].Signatures[hex.EncodeToString(c.PublicKey)]
+	for _, sigs := range [][][]byte{{sigC, sigA}, {sigA, sigA}} {
+		if err := VerifyScript(MultisigScriptSig(sigs), multisig, spendTx, 0); !errors.Is(err, ErrScriptFalse) {
+			t.Fatalf("bad multisig scriptSig: got %v, want %v", err, ErrScriptFalse)
+		}
+	}
+
+	bc.MineBlock([]*Transaction{NewCoinbaseTX(string(alice.GetAddress()), "", 2, 1), spendTx})
+	if balanceOf(utxo, bob) != 4 {
+		t.Fatalf("bob has %d, want 4", balanceOf(utxo, bob))
+	}
+	if change, _ := utxo.FindSpendableScriptOutputs(multisig, 10); change != 1 {
+		t.Fatalf("multisig change = %d, want 1", change)
+	}
+}
+
+func TestPayToScriptHash(t *testing.T) {
+	bc, alice := newTestBlockchain(t)
+	utxo := UTXOSet{bc}
+	a, b, bob := NewWallet(), NewWallet(), NewWallet()
+	redeem, _ := MultisigScript(2, [][]byte{a.PublicKey, b.PublicKey})
+	address := string(ScriptAddress(redeem))
+	if !ValidateAddress(address) || !ValidateAddress(string(alice.GetAddress())) {
+		t.Fatal("valid address rejected")
+	}
+	if version, hash := decodeAddress(address); version != version_p2sh || !bytes.Equal(hash, HashPubKey(redeem)) {
+		t.Fatalf("P2SH address decodes to version %x hash %x", version, hash)
+	}
+	if ValidateAddress(string(encodeAddress(0x42, HashPubKey(redeem)))) {
+		t.Fatal("address with unknown version accepted")
+	}
+
+	//send 按地址的版本选择锁定脚本
+	pay := NewUTXOTransaction(alice, address, 6, 0, &utxo)
+	lock := P2SHScript(HashPubKey(redeem))
+	if !bytes.Equal(pay.Vout[0].ScriptPubKey, lock) {
+		t.Fatalf("output to P2SH address has script %x", pay.Vout[0].ScriptPubKey)
+	}
+	bc.MineBlock([]*Transaction{NewCoinbaseTX(string(alice.GetAddress()), "", 1, 0), pay})
+	if balance, _ := utxo.GetScriptBalance(lock); balance != 6 {
+		t.Fatalf("P2SH balance = %d, want 6", balance)
+	}
+
+	spend := NewPartialTransaction(lock, P2PKHScript(HashPubKey(bob.PublicKey)), 5, 1, &utxo)
+	if _, err := spend.Finalize(); !errors.Is(err, ErrNoRedeemScript) {
+		t.Fatalf("finalize without redeem script: got %v, want %v", err, ErrNoRedeemScript)
+	}
+	other, _ := MultisigScript(1, [][]byte{a.PublicKey})
+	if spend.AddRedeemScript(other) != 0 || spend.AddRedeemScript(redeem) != 1 {
+		t.Fatal("redeem script matched the wrong inputs")
+	}
+	spend.Sign(a)
+	spend.Sign(b)
+	spendTx, err := spend.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//公开的赎回脚本必须与地址中的哈希一致
+	sigs := [][]byte{spend.Inputs[0].Signatures[hex.EncodeToString(a.PublicKey)]}
+	forged := append(MultisigScriptSig(sigs), NewScriptBuilder().AddData(other).Script()...)
+	if err := VerifyScript(forged, lock, spendTx, 0); !errors.Is(err, ErrScriptFalse) {
+		t.Fatalf("spend with a different redeem script: got %v, want %v", err, ErrScriptFalse)
+	}
+
+	bc.MineBlock([]*Transaction{NewCoinbaseTX(string(alice.GetAddress()), "", 2, 1), spendTx})
+	if balanceOf(utxo, bob) != 5 {
+		t.Fatalf("bob has %d, want 5", balanceOf(utxo, bob))
+	}
+}
+
+func TestTimelockedTransactions(t *testing.T) {
+	bc, alice := newTestBlockchain(t)
+	mempool := NewMempool(bc)
+	utxo := UTXOSet{bc}
+	bob, carol := NewWallet(), NewWallet()
+	address := string(alice.GetAddress())
+
+	//锁定到高度 2 的交易只能打包进高度 3 及以上的区块
+	locked := NewTimelockedTransaction(alice, string(bob.GetAddress()), 3, 0, 2, &utxo)
+	if err := mempool.Add(*locked); !errors.Is(err, ErrNonFinalTx) {
+		t.Fatalf("locked tx in mempool: got %v, want %v", err, ErrNonFinalTx)
+	}
+	if txs, _ := selectTransactions(bc, []*Transaction{locked}); len(txs) != 0 {
+		t.Fatalf("miner selected a transaction before its lock time")
+	}
+	early := bc.NewBlockOn(bc.findHeader(bc.tip), []*Transaction{NewCoinbaseTX(address, "", 1, 0), locked})
+	if _, err := bc.AddBlock(early); !errors.Is(err, ErrNonFinalTx) {
+		t.Fatalf("block with locked tx: got %v, want %v", err, ErrNonFinalTx)
+	}
+	//所有输入的序列号都为 sequenceFinal 时锁定时间不生效
+	final := *locked
+	final.Vin = []TXInput{locked.Vin[0]}
+	final.Vin[0].Sequence = sequenceFinal
+	if !final.IsFinal(1, 0) {
+		t.Fatalf("transaction with final sequences is not final")
+	}
+
+	for height := 1; height <= 2; height++ {
+		bc.MineBlock([]*Transaction{NewCoinbaseTX(address, "", height, 0)})
+	}
+	if err := mempool.Add(*locked); err != nil {
+		t.Fatalf("locked tx after lock time: %v", err)
+	}
+	txs, _ := selectTransactions(bc, []*Transaction{locked})
+	bc.MineBlock(append([]*Transaction{NewCoinbaseTX(address, "", 3, 0)}, txs...))
+	if balance, _ := utxo.GetBalance(HashPubKey(bob.PublicKey)); balance != 3 {
+		t.Fatalf("bob balance = %d, want 3", balance)
+	}
+
+	//相对锁定 2 个区块：高度 3 的输出只能被高度 5 及以上的区块花费
+	relative := NewUTXOTransaction(bob, string(carol.GetAddress()), 3, 0, &utxo)
+	relative.Vin[0].Sequence = SequenceBlocks(2)
+	relative.ID = relative.Hash()
+	bc.SignTransaction(relative, bob.PrivateKey)
+	if err := mempool.Add(*relative); !errors.Is(err, ErrSequenceLocked) {
+		t.Fatalf("sequence locked tx in mempool: got %v, want %v", err, ErrSequenceLocked)
+	}
+	early = bc.NewBlockOn(bc.findHeader(bc.tip), []*Transaction{NewCoinbaseTX(address, "", 4, 0), relative})
+	if _, err := bc.AddBlock(early); !errors.Is(err, ErrSequenceLocked) {
+		t.Fatalf("block with sequence locked tx: got %v, want %v", err, ErrSequenceLocked)
+	}
+	bc.MineBlock([]*Transaction{NewCoinbaseTX(address, "", 4, 0)})
+	if err := mempool.Add(*relative); err != nil {
+		t.Fatalf("sequence locked tx after lock time: %v", err)
+	}
+
+	//以 512 秒为单位的相对锁定时间从输出所在区块的父区块的时间中位数开始计算
+	timed := *relative
+	timed.Vin = []TXInput{relative.Vin[0]}
+	timed.Vin[0].Sequence = SequenceSeconds(3600)
+	if err := bc.checkTransactionLocks(&timed, bc.findHeader(bc.tip)); !errors.Is(err, ErrSequenceLocked) {
+		t.Fatalf("time locked input: got %v, want %v", err, ErrSequenceLocked)
+	}
+}
+
+func TestSendLockedTransactionWithMine(t *testing.T) {
+	bc, alice := newTestBlockchain(t)
+	bc.db.Close()
+	bob := NewWallet()
+	cli := CLI{wallets: &Wallets{map[string]*Wallet{string(alice.GetAddress()): alice}}}
+	aliceAddress, bobAddress := string(alice.GetAddress()), string(bob.GetAddress())
+
+	//锁定时间还没有到的交易不能打包，send -mine 打印错误而不是崩溃
+	cli.send(aliceAddress, bobAddress, 3, 0, 1, "test", true, "")
+	cli.send(aliceAddress, bobAddress, 3, 0, 0, "test", true, "")
+	cli.send(aliceAddress, bobAddress, 3, 0, 1, "test", true, "")
+
+	bc = PositioningBlockchain("test")
+	defer bc.db.Close()
+	if bc.GetBestHeight() != 2 {
+		t.Fatalf("best height = %d, want 2", bc.GetBestHeight())
+	}
+	if got := balanceOf(UTXOSet{bc}, bob); got != 6 {
+		t.Fatalf("bob balance = %d, want 6", got)
+	}
+}
+
+func TestAtomicSwapBetweenChains(t *testing.T) {
+	//两条创世区块不同的链：alice 在链A上有币，bob 在链B上有币
+	chainA, alice := newTestBlockchain(t)
+	bob := NewWallet()
+	chainB := CreateBlockchain(string(bob.GetAddress()), "swap")
+	t.Cleanup(func() { chainB.db.Close() })
+	UTXOSet{chainB}.Reindex()
+	if bytes.Equal(chainA.mainChainHash(0), chainB.mainChainHash(0)) {
+		t.Fatal("chains share a genesis block")
+	}
+	utxoA, utxoB := UTXOSet{chainA}, UTXOSet{chainB}
+	mempoolB := NewMempool(chainB)
+	aliceB, bobA := NewWallet(), NewWallet()
+
+	//alice 选择原像，在链A上锁定给 bob，超时时间比 bob 的合约长
+	secret := []byte("alice's swap secret")
+	hash := sha256.Sum256(secret)
+	contractA := &HTLC{hash[:], HashPubKey(bobA.PublicKey), HashPubKey(alice.PublicKey), 10}
+	fundA := NewUTXOTransaction(alice, string(contractA.Address()), 5, 0, &utxoA)
+	chainA.MineBlock([]*Transaction{NewCoinbaseTX(string(alice.GetAddress()), "", 1, 0), fundA})
+
+	//bob 检查合约后用同一个哈希在链B上锁定给 alice
+	if h, ok := extractHTLC(contractA.Script()); !ok || !bytes.Equal(h.Recipient, HashPubKey(bobA.PublicKey)) || h.LockTime != 10 {
+		t.Fatalf("extractHTLC = %+v, %v", h, ok)
+	}
+	contractB := &HTLC{hash[:], HashPubKey(aliceB.PublicKey), HashPubKey(bob.PublicKey), 5}
+	fundB := NewUTXOTransaction(bob, string(contractB.Address()), 5, 0, &utxoB)
+	chainB.MineBlock([]*Transaction{NewCoinbaseTX(string(bob.GetAddress()), "", 1, 0), fundB})
+
+	//超时之前 bob 不能取回
+	refund, err := NewHTLCSpendTransaction(bob, contractB.Script(), nil, string(bob.GetAddress()), 0, &utxoB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mempoolB.Add(*refund); !errors.Is(err, ErrNonFinalTx) {
+		t.Fatalf("early refund: got %v, want %v", err, ErrNonFinalTx)
+	}
+	//交易的锁定时间早于合约的锁定时间时脚本验证失败
+	forged := *refund
+	forged.LockTime = contractB.LockTime - 1
+	if err := VerifyScript(refund.Vin[0].ScriptSig, P2SHScript(HashPubKey(contractB.Script())), &forged, 0); !errors.Is(err, ErrLockTime) {
+		t.Fatalf("refund before contract lock time: got %v, want %v", err, ErrLockTime)
+	}
+
+	//alice 用原像在链B上领取，原像随交易公开
+	if _, err := NewHTLCSpendTransaction(aliceB, contractB.Script(), []byte("wrong"), string(aliceB.GetAddress()), 0, &utxoB); !errors.Is(err, ErrBadPreimage) {
+		t.Fatalf("claim with wrong preimage: got %v, want %v", err, ErrBadPreimage)
+	}
+	if _, err := NewHTLCSpendTransaction(bob, contractB.Script(), secret, string(bob.GetAddress()), 0, &utxoB); !errors.Is(err, ErrNotHTLCParty) {
+		t.Fatalf("claim by sender: got %v, want %v", err, ErrNotHTLCParty)
+	}
+	claimB, err := NewHTLCSpendTransaction(aliceB, contractB.Script(), secret, string(aliceB.GetAddress()), 1, &utxoB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mempoolB.Add(*claimB); err != nil {
+		t.Fatalf("claim on chain B: %v", err)
+	}
+	chainB.MineBlock([]*Transaction{NewCoinbaseTX(string(bob.GetAddress()), "", 2, 1), claimB})
+	if balanceOf(utxoB, aliceB) != 4 {
+		t.Fatalf("alice has %d on chain B, want 4", balanceOf(utxoB, aliceB))
+	}
+
+	//bob 从链B上找到原像，在链A上领取
+	found, ok := chainB.FindHTLCSecret(contractB.Script())
+	if !ok || !bytes.Equal(found, secret) {
+		t.Fatalf("FindHTLCSecret = %q, %v", found, ok)
+	}
+	claimA, err := NewHTLCSpendTransaction(bobA, contractA.Script(), found, string(bobA.GetAddress()), 0, &utxoA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chainA.MineBlock([]*Transaction{NewCoinbaseTX(string(alice.GetAddress()), "", 2, 0), claimA})
+	if balanceOf(utxoA, bobA) != 5 {
+		t.Fatalf("bob has %d on chain A, want 5", balanceOf(utxoA, bobA))
+	}
+	if _, err := NewHTLCSpendTransaction(alice, contractA.Script(), nil, string(alice.GetAddress()), 0, &utxoA); !errors.Is(err, ErrNoHTLCOutputs) {
+		t.Fatalf("refund of claimed contract: got %v, want %v", err, ErrNoHTLCOutputs)
+	}
+
+	//没有被领取的合约在超时后由发送方取回
+	contractR := &HTLC{hash[:], HashPubKey(aliceB.PublicKey), HashPubKey(bob.PublicKey), 4}
+	fundR := NewUTXOTransaction(bob, string(contractR.Address()), 2, 0, &utxoB)
+	chainB.MineBlock([]*Transaction{NewCoinbaseTX(string(bob.GetAddress()), "", 3, 0), fundR})
+	refund, err = NewHTLCSpendTransaction(bob, contractR.Script(), nil, string(bob.GetAddress()), 0, &utxoB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mempoolB.Add(*refund); !errors.Is(err, ErrNonFinalTx) {
+		t.Fatalf("refund at height 4: got %v, want %v", err, ErrNonFinalTx)
+	}
+	chainB.MineBlock([]*Transaction{NewCoinbaseTX(string(aliceB.GetAddress()), "", 4, 0)})
+	if err := mempoolB.Add(*refund); err != nil {
+		t.Fatalf("refund after lock time: %v", err)
+	}
+	before := balanceOf(utxoB, bob)
+	chainB.MineBlock([]*Transaction{NewCoinbaseTX(string(aliceB.GetAddress()), "", 5, 0), refund})
+	if balanceOf(utxoB, bob) != before+2 {
+		t.Fatalf("bob has %d after refund, want %d", balanceOf(utxoB, bob), before+2)
+	}
+}
+
+func TestHTLCCommands(t *testing.T) {
+	bc, alice := newTestBlockchain(t)
+	bc.db.Close()
+	bob, carol := NewWallet(), NewWallet()
+	wallets := &Wallets{make(map[string]*Wallet)}
+	for _, w := range []*Wallet{alice, bob, carol} {
+		wallets.Wallets[string(w.GetAddress())] = w
+	}
+	cli := CLI{wallets: wallets}
+	aliceAddress, bobAddress := string(alice.GetAddress()), string(bob.GetAddress())
+	secret := []byte("atomic swap secret")
+	hash := sha256.Sum256(secret)
+	secretHash := hex.EncodeToString(hash[:])
+
+	//alice 锁定4个币，bob 出示原像领取后付给 carol
+	claimable := &HTLC{hash[:], HashPubKey(bob.PublicKey), HashPubKey(alice.PublicKey), 100}
+	cli.htlcCreate(aliceAddress, bobAddress, 4, 0, 100, secretHash, "test", true, "")
+	cli.htlcSpend(hex.EncodeToString(claimable.Script()), hex.EncodeToString(secret), string(carol.GetAddress()), 1, "test", true, "")
+
+	//锁定到高度3的合约在高度4的区块中由 alice 取回
+	refundable := &HTLC{hash[:], HashPubKey(bob.PublicKey), HashPubKey(alice.PublicKey), 3}
+	cli.htlcCreate(aliceAddress, bobAddress, 2, 0, 3, secretHash, "test", true, "")
+	cli.htlcSpend(hex.EncodeToString(refundable.Script()), "", aliceAddress, 0, "test", true, "")
+
+	bc = PositioningBlockchain("test")
+	defer bc.db.Close()
+	utxo := UTXOSet{bc}
+	if bc.GetBestHeight() != 4 {
+		t.Fatalf("best height = %d, want 4", bc.GetBestHeight())
+	}
+	for _, h := range []*HTLC{claimable, refundable} {
+		if balance, _ := utxo.GetScriptBalance(P2SHScript(HashPubKey(h.Script()))); balance != 0 {
+			t.Errorf("contract with lock time %d still holds %d", h.LockTime, balance)
+		}
+	}
+	if found, ok := bc.FindHTLCSecret(claimable.Script()); !ok || !bytes.Equal(found, secret) {
+		t.Errorf("FindHTLCSecret = %q, %v", found, ok)
+	}
+	if _, ok := bc.FindHTLCSecret(refundable.Script()); ok {
+		t.Errorf("refund revealed a secret")
+	}
+}
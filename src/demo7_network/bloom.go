@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"math"
+)
+
+// 布隆过滤器的大小限制，超过限制的 filterload/filteradd 被视为违规
+const (
+	maxBloomFilterSize = 36000
+	maxBloomHashFuncs  = 50
+	maxFilterAddSize   = 520
+)
+
+// 轻节点加载到全节点的布隆过滤器，全节点只把与过滤器匹配的交易发给轻节点
+// Filter 为位数组，HashFuncs 为哈希函数的个数，Tweak 用来改变哈希函数的种子
+type bloomFilter struct {
+	Filter    []byte
+	HashFuncs uint32
+	Tweak     uint32
+}
+
+// 请求对方使用过滤器
+type filterload struct {
+	AddrFrom string
+	Filter   bloomFilter
+}
+
+// 向对方已经加载的过滤器中添加一个元素
+type filteradd struct {
+	AddrFrom string
+	Data     []byte
+}
+
+// 创建能容纳elements个元素、误判率约为fpRate的过滤器
+func newBloomFilter(elements int, fpRate float64, tweak uint32) *bloomFilter {
+	if elements < 1 {
+		elements = 1
+	}
+	size := int(-1 / (math.Ln2 * math.Ln2) * float64(elements) * math.Log(fpRate) / 8)
+	if size < 1 {
+		size = 1
+	}
+	if size > maxBloomFilterSize {
+		size = maxBloomFilterSize
+	}
+	funcs := uint32(float64(size*8) / float64(elements) * math.Ln2)
+	if funcs < 1 {
+		funcs = 1
+	}
+	if funcs > maxBloomHashFuncs {
+		funcs = maxBloomHashFuncs
+	}
+	return &bloomFilter{make([]byte, size), funcs, tweak}
+}
+
+// 第i个哈希函数在位数组中的位置
+func (f *bloomFilter) bit(i uint32, data []byte) uint32 {
+	return murmur3(i*0xfba4c795+f.Tweak, data) % uint32(len(f.Filter)*8)
+}
+
+func (f *bloomFilter) Add(data []byte) {
+	if len(f.Filter) == 0 {
+		return
+	}
+	for i := uint32(0); i < f.HashFuncs; i++ {
+		b := f.bit(i, data)
+		f.Filter[b>>3] |= 1 << (b & 7)
+	}
+}
+
+// 过滤器中是否可能有data，没有加入过的数据也可能返回 true
+func (f *bloomFilter) Contains(data []byte) bool {
+	if len(f.Filter) == 0 {
+		return false
+	}
+	for i := uint32(0); i < f.HashFuncs; i++ {
+		b := f.bit(i, data)
+		if f.Filter[b>>3]&(1<<(b&7)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// 交易是否与过滤器匹配：交易ID、输出锁定脚本中的数据(如公钥哈希)、输入引用的输出或解锁脚本中的数据(如公钥)在过滤器中
+// 输出匹配时把这个输出加入过滤器，这样以后花费它的交易也能匹配
+func (f *bloomFilter) MatchTx(tx *Transaction) bool {
+	matched := f.Contains(tx.ID)
+	for i, out := range tx.Vout {
+		for _, data := range scriptPushes(out.ScriptPubKey) {
+			if f.Contains(data) {
+				matched = true
+				f.Add(outpointKey(tx.ID, i))
+				break
+			}
+		}
+	}
+	if matched || tx.IsCoinbase() {
+		return matched
+	}
+	for _, vin := range tx.Vin {
+		if f.Contains(outpointKey(vin.Txid, vin.Vout)) {
+			return true
+		}
+		for _, data := range scriptPushes(vin.ScriptSig) {
+			if f.Contains(data) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 输出在过滤器中的表示：交易ID加上4字节小端序的输出索引
+func outpointKey(txid []byte, vout int) []byte {
+	key := make([]byte, len(txid)+4)
+	copy(key, txid)
+	binary.LittleEndian.PutUint32(key[len(txid):], uint32(vout))
+	return key
+}
+
+// 32位 MurmurHash3，与比特币的布隆过滤器使用的哈希函数相同
+func murmur3(seed uint32, data []byte) uint32 {
+	const c1, c2 = 0xcc9e2d51, 0x1b873593
+	h := seed
+	n := len(data) / 4
+	for i := 0; i < n; i++ {
+		k := binary.LittleEndian.Uint32(data[i*4:])
+		k *= c1
+		k = k<<15 | k>>17
+		k *= c2
+		h ^= k
+		h = h<<13 | h>>19
+		h = h*5 + 0xe6546b64
+	}
+	var k uint32
+	tail := data[n*4:]
+	switch len(tail) {
+	case 3:
+		k ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		k ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		k ^= uint32(tail[0])
+		k *= c1
+		k = k<<15 | k>>17
+		k *= c2
+		h ^= k
+	}
+	h ^= uint32(len(data))
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
+
+// 对方加载过滤器之后，只接收与过滤器匹配的交易和区块
+func (n *Node) handleFilterLoad(p *Peer, request []byte) {
+	var buff bytes.Buffer
+	var payload filterload
+
+	buff.Write(request)
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		n.misbehaving(p, banScoreMalformed, fmt.Sprintf("malformed filterload: %v", err))
+		return
+	}
+
+	f := payload.Filter
+	if len(f.Filter) > maxBloomFilterSize || f.HashFuncs > maxBloomHashFuncs {
+		n.misbehaving(p, banScoreMalformed, fmt.Sprintf("bloom filter too large: %d bytes, %d hash functions", len(f.Filter), f.HashFuncs))
+		return
+	}
+	p.setFilter(&f)
+}
+
+func (n *Node) handleFilterAdd(p *Peer, request []byte) {
+	var buff bytes.Buffer
+	var payload filteradd
+
+	buff.Write(request)
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		n.misbehaving(p, banScoreMalformed, fmt.Sprintf("malformed filteradd: %v", err))
+		return
+	}
+
+	if len(payload.Data) > maxFilterAddSize {
+		n.misbehaving(p, banScoreMalformed, fmt.Sprintf("filteradd data too large: %d bytes", len(payload.Data)))
+		return
+	}
+	if !p.addToFilter(payload.Data) {
+		n.misbehaving(p, banScoreMalformed, "filteradd without filterload")
+	}
+}
@@ -5,10 +5,13 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 )
 
 type CLI struct {
 	bc *Blockchain
+	//命令使用的钱包，为 nil 时从节点的钱包文件读取
+	wallets *Wallets
 }
 
 func (cli *CLI) Run() {
@@ -22,21 +25,74 @@ func (cli *CLI) Run() {
 
 	//创建子命令(NewFlagSet创建一个新的、名为name，采用errorHandling为错误处理策略的FlagSet)
 	getBalanceCmd := flag.NewFlagSet("getbalance", flag.ExitOnError)
+	getSupplyCmd := flag.NewFlagSet("getsupply", flag.ExitOnError)
+	broadcastCmd := flag.NewFlagSet("broadcast", flag.ExitOnError)
+	combineCmd := flag.NewFlagSet("combine", flag.ExitOnError)
 	createBlockchainCmd := flag.NewFlagSet("createblockchain", flag.ExitOnError)
+	createMultisigCmd := flag.NewFlagSet("createmultisig", flag.ExitOnError)
 	createWalletCmd := flag.NewFlagSet("createwallet", flag.ExitOnError)
+	htlcClaimCmd := flag.NewFlagSet("htlc-claim", flag.ExitOnError)
+	htlcCreateCmd := flag.NewFlagSet("htlc-create", flag.ExitOnError)
+	htlcRefundCmd := flag.NewFlagSet("htlc-refund", flag.ExitOnError)
 	listAddressesCmd := flag.NewFlagSet("listaddresses", flag.ExitOnError)
+	listBannedCmd := flag.NewFlagSet("listbanned", flag.ExitOnError)
+	listMempoolCmd := flag.NewFlagSet("listmempool", flag.ExitOnError)
 	printChainCmd := flag.NewFlagSet("printchain", flag.ExitOnError)
 	reindexUTXOCmd := flag.NewFlagSet("reindexutxo", flag.ExitOnError)
 	sendCmd := flag.NewFlagSet("send", flag.ExitOnError)
+	signPartialCmd := flag.NewFlagSet("signpartial", flag.ExitOnError)
 	startNodeCmd := flag.NewFlagSet("startnode", flag.ExitOnError)
+	unbanCmd := flag.NewFlagSet("unban", flag.ExitOnError)
 	//用指定的名称、默认值、使用信息注册一个int/string类型flag。返回一个保存了该flag的值的指针。
 	getBalanceAddress := getBalanceCmd.String("address", "", "The address to get balance for")
+	getBalanceSPV := getBalanceCmd.Bool("spv", false, "Read the balance tracked by a light client node")
 	createBlockchainAddress := createBlockchainCmd.String("address", "", "The address to send genesis block reward to")
+	broadcastIn := broadcastCmd.String("in", "", "Partially signed transaction file with enough signatures")
+	broadcastNode := broadcastCmd.String("node", defaultSeed, "Node to send the transaction to")
+	combineIn := combineCmd.String("in", "", "Comma-separated partially signed transaction files")
+	combineOut := combineCmd.String("out", "", "File to write the combined transaction to")
+	createMultisigRequired := createMultisigCmd.Int("m", 0, "Number of signatures required")
+	createMultisigPubKeys := createMultisigCmd.String("pubkeys", "", "Comma-separated hex public keys")
+	htlcClaimContract := htlcClaimCmd.String("contract", "", "Hex contract script")
+	htlcClaimSecret := htlcClaimCmd.String("secret", "", "Hex preimage of the contract's secret hash")
+	htlcClaimTo := htlcClaimCmd.String("to", "", "Address to pay the claimed coins to")
+	htlcClaimFee := htlcClaimCmd.Int("fee", 0, "Fee paid to the miner")
+	htlcClaimMine := htlcClaimCmd.Bool("mine", false, "Mine immediately on the same node")
+	htlcClaimNode := htlcClaimCmd.String("node", defaultSeed, "Node to send the transaction to")
+	htlcCreateFrom := htlcCreateCmd.String("from", "", "Source wallet address, can refund after the lock time")
+	htlcCreateTo := htlcCreateCmd.String("to", "", "Recipient address, can claim with the secret")
+	htlcCreateAmount := htlcCreateCmd.Int("amount", 0, "Amount to lock in the contract")
+	htlcCreateFee := htlcCreateCmd.Int("fee", 0, "Fee paid to the miner")
+	htlcCreateLockTime := htlcCreateCmd.Int64("locktime", 0, "Block height (or unix time when >= 500000000) after which the sender can refund")
+	htlcCreateHash := htlcCreateCmd.String("hash", "", "Hex SHA-256 secret hash, a new secret is generated when empty")
+	htlcCreateMine := htlcCreateCmd.Bool("mine", false, "Mine immediately on the same node")
+	htlcCreateNode := htlcCreateCmd.String("node", defaultSeed, "Node to send the transaction to")
+	htlcRefundContract := htlcRefundCmd.String("contract", "", "Hex contract script")
+	htlcRefundTo := htlcRefundCmd.String("to", "", "Address to pay the refunded coins to")
+	htlcRefundFee := htlcRefundCmd.Int("fee", 0, "Fee paid to the miner")
+	htlcRefundMine := htlcRefundCmd.Bool("mine", false, "Mine immediately on the same node")
+	htlcRefundNode := htlcRefundCmd.String("node", defaultSeed, "Node to send the transaction to")
+	listAddressesPubKeys := listAddressesCmd.Bool("pubkeys", false, "Also print the public key of each address")
 	sendFrom := sendCmd.String("from", "", "Source wallet address")
 	sendTo := sendCmd.String("to", "", "Destination wallet address")
 	sendAmount := sendCmd.Int("amount", 0, "Amount to send")
+	sendFee := sendCmd.Int("fee", 0, "Fee paid to the miner")
 	sendMine := sendCmd.Bool("mine", false, "Mine immediately on the same node")
+	sendLockTime := sendCmd.Int64("locktime", 0, "Only mine the transaction in blocks above this height (or after this unix time when >= 500000000)")
+	sendNode := sendCmd.String("node", defaultSeed, "Node to send the transaction to")
+	signPartialIn := signPartialCmd.String("in", "", "Partially signed transaction file, omit to create a new transaction")
+	signPartialOut := signPartialCmd.String("out", "", "File to write the signed transaction to, defaults to -in")
+	signPartialFrom := signPartialCmd.String("from", "", "Source address or multisig script of a new transaction")
+	signPartialTo := signPartialCmd.String("to", "", "Destination address or multisig script of a new transaction")
+	signPartialAmount := signPartialCmd.Int("amount", 0, "Amount to send in a new transaction")
+	signPartialFee := signPartialCmd.Int("fee", 0, "Fee paid to the miner by a new transaction")
+	signPartialRedeem := signPartialCmd.String("redeem", "", "Hex redeem script of the P2SH address a new transaction spends from")
 	startNodeMiner := startNodeCmd.String("miner", "", "Enable mining mode and send reward to ADDRESS")
+	startNodeSeeds := startNodeCmd.String("seeds", defaultSeed, "Comma-separated seed nodes to connect to on startup")
+	startNodeBanScore := startNodeCmd.Int("banscore", banThreshold, "Disconnect and ban peers whose misbehavior score reaches this value")
+	startNodeBanTime := startNodeCmd.Duration("bantime", banDuration, "How long misbehaving peers stay banned")
+	startNodeSPV := startNodeCmd.Bool("spv", false, "Run as a light client that only syncs headers and tracks the wallet's own outputs")
+	unbanAddr := unbanCmd.String("addr", "", "The banned address to remove from the ban list: an IP (a port is ignored), or HOST:PORT for a node on this machine")
 	//检查用户提供的命令
 	//Parse():从arguments中解析注册的flag
 	switch os.Args[1] {
@@ -45,21 +101,66 @@ func (cli *CLI) Run() {
 		if err != nil {
 			log.Panic(err)
 		}
+	case "broadcast":
+		err := broadcastCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "combine":
+		err := combineCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "getsupply":
+		err := getSupplyCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "createblockchain":
 		err := createBlockchainCmd.Parse(os.Args[2:])
 		if err != nil {
 			log.Panic(err)
 		}
+	case "createmultisig":
+		err := createMultisigCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "createwallet":
 		err := createWalletCmd.Parse(os.Args[2:])
 		if err != nil {
 			log.Panic(err)
 		}
+	case "htlc-claim":
+		err := htlcClaimCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "htlc-create":
+		err := htlcCreateCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "htlc-refund":
+		err := htlcRefundCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "listaddresses":
 		err := listAddressesCmd.Parse(os.Args[2:])
 		if err != nil {
 			log.Panic(err)
 		}
+	case "listbanned":
+		err := listBannedCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "listmempool":
+		err := listMempoolCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "printchain":
 		err := printChainCmd.Parse(os.Args[2:])
 		if err != nil {
@@ -75,11 +176,21 @@ func (cli *CLI) Run() {
 		if err != nil {
 			log.Panic(err)
 		}
+	case "signpartial":
+		err := signPartialCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "startnode":
 		err := startNodeCmd.Parse(os.Args[2:])
 		if err != nil {
 			log.Panic(err)
 		}
+	case "unban":
+		err := unbanCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	default:
 		cli.printUsage()
 		os.Exit(1)
@@ -91,7 +202,27 @@ func (cli *CLI) Run() {
 			getBalanceCmd.Usage()
 			os.Exit(1)
 		}
-		cli.getBalance(*getBalanceAddress, nodeID)
+		cli.getBalance(*getBalanceAddress, nodeID, *getBalanceSPV)
+	}
+
+	if broadcastCmd.Parsed() {
+		if *broadcastIn == "" {
+			broadcastCmd.Usage()
+			os.Exit(1)
+		}
+		cli.broadcast(*broadcastIn, *broadcastNode)
+	}
+
+	if combineCmd.Parsed() {
+		if *combineIn == "" || *combineOut == "" {
+			combineCmd.Usage()
+			os.Exit(1)
+		}
+		cli.combinePartial(strings.Split(*combineIn, ","), *combineOut)
+	}
+
+	if getSupplyCmd.Parsed() {
+		cli.getSupply(nodeID)
 	}
 
 	if createBlockchainCmd.Parsed() {
@@ -102,12 +233,52 @@ func (cli *CLI) Run() {
 		cli.createBlockchain(*createBlockchainAddress, nodeID)
 	}
 
+	if createMultisigCmd.Parsed() {
+		if *createMultisigRequired <= 0 || *createMultisigPubKeys == "" {
+			createMultisigCmd.Usage()
+			os.Exit(1)
+		}
+		cli.createMultisig(*createMultisigRequired, strings.Split(*createMultisigPubKeys, ","))
+	}
+
 	if createWalletCmd.Parsed() {
 		cli.createWallet(nodeID)
 	}
 
+	if htlcClaimCmd.Parsed() {
+		if *htlcClaimContract == "" || *htlcClaimSecret == "" || *htlcClaimTo == "" || *htlcClaimFee < 0 {
+			htlcClaimCmd.Usage()
+			os.Exit(1)
+		}
+		cli.htlcSpend(*htlcClaimContract, *htlcClaimSecret, *htlcClaimTo, *htlcClaimFee, nodeID, *htlcClaimMine, *htlcClaimNode)
+	}
+
+	if htlcCreateCmd.Parsed() {
+		if *htlcCreateFrom == "" || *htlcCreateTo == "" || *htlcCreateAmount <= 0 || *htlcCreateFee < 0 || *htlcCreateLockTime <= 0 {
+			htlcCreateCmd.Usage()
+			os.Exit(1)
+		}
+		cli.htlcCreate(*htlcCreateFrom, *htlcCreateTo, *htlcCreateAmount, *htlcCreateFee, *htlcCreateLockTime, *htlcCreateHash, nodeID, *htlcCreateMine, *htlcCreateNode)
+	}
+
+	if htlcRefundCmd.Parsed() {
+		if *htlcRefundContract == "" || *htlcRefundTo == "" || *htlcRefundFee < 0 {
+			htlcRefundCmd.Usage()
+			os.Exit(1)
+		}
+		cli.htlcSpend(*htlcRefundContract, "", *htlcRefundTo, *htlcRefundFee, nodeID, *htlcRefundMine, *htlcRefundNode)
+	}
+
 	if listAddressesCmd.Parsed() {
-		cli.listAddresses(nodeID)
+		cli.listAddresses(nodeID, *listAddressesPubKeys)
+	}
+
+	if listBannedCmd.Parsed() {
+		cli.listBanned(nodeID)
+	}
+
+	if listMempoolCmd.Parsed() {
+		cli.listMempool(nodeID)
 	}
 
 	if printChainCmd.Parsed() {
@@ -119,12 +290,30 @@ func (cli *CLI) Run() {
 	}
 
 	if sendCmd.Parsed() {
-		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 {
+		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 || *sendFee < 0 || *sendLockTime < 0 {
 			sendCmd.Usage()
 			os.Exit(1)
 		}
 
-		cli.send(*sendFrom, *sendTo, *sendAmount, nodeID, *sendMine)
+		cli.send(*sendFrom, *sendTo, *sendAmount, *sendFee, *sendLockTime, nodeID, *sendMine, *sendNode)
+	}
+
+	if signPartialCmd.Parsed() {
+		//没有 -in 时由第一个签名者用 -from/-to/-amount 创建交易
+		if *signPartialIn == "" && (*signPartialFrom == "" || *signPartialTo == "" || *signPartialAmount <= 0 || *signPartialFee < 0 || *signPartialOut == "") {
+			signPartialCmd.Usage()
+			os.Exit(1)
+		}
+		if *signPartialOut == "" {
+			*signPartialOut = *signPartialIn
+		}
+		var pt *PartialTransaction
+		if *signPartialIn != "" {
+			pt = readPartial(*signPartialIn)
+		} else {
+			pt = cli.createPartial(*signPartialFrom, *signPartialTo, *signPartialAmount, *signPartialFee, *signPartialRedeem, nodeID)
+		}
+		cli.signPartial(pt, *signPartialOut, nodeID)
 	}
 
 	if startNodeCmd.Parsed() {
@@ -133,20 +322,50 @@ func (cli *CLI) Run() {
 			startNodeCmd.Usage()
 			os.Exit(1)
 		}
-		cli.startNode(nodeID, *startNodeMiner)
+		var seeds []string
+		if *startNodeSeeds != "" {
+			seeds = strings.Split(*startNodeSeeds, ",")
+		}
+		banThreshold = *startNodeBanScore
+		banDuration = *startNodeBanTime
+		if *startNodeSPV && *startNodeMiner != "" {
+			startNodeCmd.Usage()
+			os.Exit(1)
+		}
+		cli.startNode(nodeID, *startNodeMiner, seeds, *startNodeSPV)
+	}
+
+	if unbanCmd.Parsed() {
+		if *unbanAddr == "" {
+			unbanCmd.Usage()
+			os.Exit(1)
+		}
+		cli.unban(*unbanAddr, nodeID)
 	}
 }
 
 func (cli *CLI) printUsage() {
 	fmt.Println("Usage:")
+	fmt.Println("  broadcast -in FILE -node ADDR - Finalize a partially signed transaction with enough signatures and send it to the node at ADDR")
+	fmt.Println("  combine -in FILE,FILE,... -out FILE - Merge the signatures of partially signed copies of the same transaction")
 	fmt.Println("  createblockchain -address ADDRESS - Create a blockchain and send genesis block reward to ADDRESS")
+	fmt.Println("  createmultisig -m M -pubkeys PUBKEY,PUBKEY,... - Print the M-of-N multisig address of hex public keys and its redeem script")
 	fmt.Println("  createwallet - Generates a new key-pair and saves it into the wallet file")
-	fmt.Println("  getbalance -address ADDRESS - Get balance of ADDRESS")
-	fmt.Println("  listaddresses - Lists all addresses from the wallet file")
+	fmt.Println("  getbalance -address ADDRESS -spv - Get balance of ADDRESS, -spv reads the balance tracked by a light client node")
+	fmt.Println("  getsupply - Print the number of coins issued so far and the maximum supply")
+	fmt.Println("  htlc-claim -contract SCRIPT -secret SECRET -to ADDRESS -fee FEE -mine -node ADDR - Claim the coins locked in a hash time locked contract with the preimage SECRET and pay them to ADDRESS")
+	fmt.Println("  htlc-create -from FROM -to TO -amount AMOUNT -fee FEE -locktime LOCKTIME -hash HASH -mine -node ADDR - Lock AMOUNT of coins in a contract that TO can claim with the preimage of HASH and FROM can refund after LOCKTIME. A new secret is generated and printed when -hash is not set")
+	fmt.Println("  htlc-refund -contract SCRIPT -to ADDRESS -fee FEE -mine -node ADDR - Refund the coins locked in an expired hash time locked contract to ADDRESS")
+	fmt.Println("  listaddresses -pubkeys - Lists all addresses from the wallet file, -pubkeys also prints their public keys")
+	fmt.Println("  listbanned - Print the addresses banned for misbehaving and when their bans expire (IPs, or localhost:PORT for nodes on this machine); stop the node first")
+	fmt.Println("  listmempool - Print the pending transactions saved in the node's mempool")
 	fmt.Println("  printchain - Print all the blocks of the blockchain")
 	fmt.Println("  reindexutxo - Rebuilds the UTXO set")
-	fmt.Println("  send -from FROM -to TO -amount AMOUNT -mine - Send AMOUNT of coins from FROM address to TO. Mine on the same node, when -mine is set.")
-	fmt.Println("  startnode -miner ADDRESS - Start a node with ID specified in NODE_ID env. var. -miner enables mining")
+	fmt.Println("  send -from FROM -to TO -amount AMOUNT -fee FEE -locktime LOCKTIME -mine -node ADDR - Send AMOUNT of coins from FROM address to TO, paying FEE to the miner. When LOCKTIME is set, the transaction can only be mined in blocks above that height (after that unix time when >= 500000000). Mine on the same node, when -mine is set, otherwise send to the node at ADDR.")
+	fmt.Println("  signpartial -in FILE -out FILE - Sign the inputs of a partially signed transaction with the keys in the wallet file")
+	fmt.Println("  signpartial -from FROM -to TO -amount AMOUNT -fee FEE -redeem SCRIPT -out FILE - Create a transaction from FROM to TO (addresses or multisig scripts) for co-signing and sign it, -redeem is required to spend from a P2SH address")
+	fmt.Println("  startnode -miner ADDRESS -spv -seeds HOST:PORT,... -banscore SCORE -bantime DURATION - Start a node with ID specified in NODE_ID env. var. -miner enables mining, -seeds sets the nodes to connect to first, peers reaching -banscore are banned for -bantime, -spv runs a light client that syncs headers and only the wallet's own transactions")
+	fmt.Println("  unban -addr IP|HOST:PORT - Remove an address from the ban list; stop the node first")
 }
 
 // 判断是否含有参数
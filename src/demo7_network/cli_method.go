@@ -1,28 +1,38 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"strconv"
+	"time"
 )
 
-// 获取账户余额
-func (cli *CLI) getBalance(address, nodeID string) {
+// 获取账户余额，spv 为 true 时读取轻节点记录的余额
+func (cli *CLI) getBalance(address, nodeID string, spv bool) {
 	if !ValidateAddress(address) {
 		log.Panic("ERROR: Address is not valid")
 	}
 	bc := PositioningBlockchain(nodeID)
 	UTXOSet := UTXOSet{bc}
 	defer bc.db.Close()
-	balance := 0
 	//对address解码
-	pubKeyHash := Base58Decode([]byte(address))
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
-	UTXOs := UTXOSet.FindUTXO(pubKeyHash)
-	for _, out := range UTXOs {
-		balance += out.Value
+	version, pubKeyHash := decodeAddress(address)
+	if spv {
+		fmt.Printf("Balance of '%s': %d\n", address, spvBalance(bc.db, pubKeyHash))
+		return
+	}
+	balance, immature := UTXOSet.GetBalance(pubKeyHash)
+	if version == version_p2sh {
+		balance, immature = UTXOSet.GetScriptBalance(NewTXOutput(0, address).ScriptPubKey)
 	}
 	fmt.Printf("Balance of '%s': %d\n", address, balance)
+	if immature > 0 {
+		fmt.Printf("Immature: %d (spendable after %d confirmations)\n", immature, coinbaseMaturity)
+	}
 }
 
 // 创建区块链
@@ -46,19 +56,23 @@ func (cli *CLI) createWallet(nodeID string) {
 }
 
 // 打印所有钱包地址
-func (cli *CLI) listAddresses(nodeID string) {
+func (cli *CLI) listAddresses(nodeID string, pubKeys bool) {
 	wallets, err := NewWallets(nodeID)
 	if err != nil {
 		log.Panic(err)
 	}
 	addresses := wallets.GetAddresses()
 	for _, address := range addresses {
+		if pubKeys {
+			fmt.Printf("%s %x\n", address, wallets.GetWallet(address).PublicKey)
+			continue
+		}
 		fmt.Println(address)
 	}
 }
 
-// 发送交易
-func (cli *CLI) send(from, to string, amount int, nodeID string, mineNow bool) {
+// 发送交易，lockTime 不为 0 时交易在锁定时间之前不能被打包
+func (cli *CLI) send(from, to string, amount, fee int, lockTime int64, nodeID string, mineNow bool, node string) {
 	if !ValidateAddress(from) {
 		log.Panic("ERROR: Sender address is not valid")
 	}
@@ -68,23 +82,66 @@ func (cli *CLI) send(from, to string, amount int, nodeID string, mineNow bool) {
 	bc := PositioningBlockchain(nodeID)
 	UTXOSet := UTXOSet{bc}
 	defer bc.db.Close()
-	wallets, err := NewWallets(nodeID)
-	if err != nil {
-		log.Panic(err)
+	wallet := cli.walletFor(from, nodeID)
+	tnx := NewTimelockedTransaction(&wallet, to, amount, fee, lockTime, &UTXOSet)
+	if err := submitTransaction(bc, tnx, from, fee, mineNow, node); err != nil {
+		fmt.Printf("ERROR: %v\n", err)
+		return
 	}
-	wallet := wallets.GetWallet(from)
-	tx := NewUTXOTransaction(&wallet, to, amount, &UTXOSet)
-	if mineNow {
-		cbTX := NewCoinbaseTX(from, "")
-		txs := []*Transaction{cbTX, tx}
 
-		newBlock := bc.MineBlock(txs)
-		UTXOSet.Update(newBlock)
-	} else {
-		sendTx(knownNodes[0], tx)
+	fmt.Println("Success!")
+}
+
+// mineNow 时在本节点把交易打包进新区块(奖励和手续费给miner)，否则发送给node
+// 锁定时间还没有到的交易不能打包进下一个区块，返回错误
+func submitTransaction(bc *Blockchain, tnx *Transaction, miner string, fee int, mineNow bool, node string) error {
+	if !mineNow {
+		return sendMessage(node, "tx", tx{"", tnx.Serialize()})
+	}
+	if err := bc.checkTransactionLocks(tnx, bc.findHeader(bc.tip)); err != nil {
+		return err
 	}
+	cbTX := NewCoinbaseTX(miner, "", bc.GetBestHeight()+1, fee)
+	txs := []*Transaction{cbTX, tnx}
 
-	fmt.Println("Success!")
+	bc.MineBlock(txs)
+	return nil
+}
+
+// 打印节点保存的内存池交易(按手续费率从高到低)
+func (cli *CLI) listMempool(nodeID string) {
+	bc := PositioningBlockchain(nodeID)
+	defer bc.db.Close()
+	mempool := NewMempool(bc)
+	fmt.Printf("Transactions: %d\n", mempool.Count())
+	fmt.Printf("Size: %d/%d bytes\n", mempool.Size(), maxMempoolSize)
+	for _, entry := range mempool.Entries() {
+		age := time.Since(time.Unix(entry.Time, 0)).Truncate(time.Second)
+		fmt.Printf("%x fee: %d size: %d age: %s\n", entry.Tx.ID, entry.Fee, entry.Size, age)
+	}
+}
+
+// 打印节点保存的封禁列表(节点停止时才能打开数据库)
+func (cli *CLI) listBanned(nodeID string) {
+	bc := PositioningBlockchain(nodeID)
+	defer bc.db.Close()
+	bans := loadBans(bc.db)
+	fmt.Printf("Banned nodes: %d\n", len(bans))
+	for _, e := range bans {
+		until := time.Unix(e.Until, 0).Format(time.RFC3339)
+		fmt.Printf("%s until %s: %s\n", e.Addr, until, e.Reason)
+	}
+}
+
+// 从封禁列表中移除一个节点(节点停止时才能打开数据库)
+func (cli *CLI) unban(addr, nodeID string) {
+	bc := PositioningBlockchain(nodeID)
+	defer bc.db.Close()
+	if !deleteBan(bc.db, addr) {
+		fmt.Printf("%s is not banned\n", addr)
+		return
+	}
+	fmt.Printf("Unbanned %s\n", addr)
 }
 
 // 打印区块链
@@ -96,8 +153,15 @@ func (cli *CLI) printChain(nodeID string) {
 		block := bci.Next()
 		fmt.Printf("============ Block %x ============\n", block.Hash)
 		fmt.Printf("Prev.block: %x\n", block.PrevBlockHash)
-		pow := NewProofOfWork(block)
-		fmt.Printf("POW :%s\n", strconv.FormatBool(pow.Validate()))
+		requiredBits := initialBits
+		if len(block.PrevBlockHash) > 0 {
+			requiredBits = bc.CalcNextRequiredBits(bc.findHeader(block.PrevBlockHash))
+		}
+		pow := NewProofOfWork(&block.BlockHeader)
+		fmt.Printf("Height: %d\n", block.Height)
+		fmt.Printf("Merkle root: %x\n", block.MerkleRoot)
+		fmt.Printf("Bits: %08x\n", block.Bits)
+		fmt.Printf("POW :%s\n", strconv.FormatBool(pow.Validate(requiredBits)))
 		fmt.Println("Transactions:")
 		for _, tx := range block.Transactions {
 			fmt.Println(tx)
@@ -108,6 +172,31 @@ func (cli *CLI) printChain(nodeID string) {
 		}
 	}
 }
+
+// 统计已经发行的币(所有主链区块 coinbase 输出之和)
+func (cli *CLI) getSupply(nodeID string) {
+	bc := PositioningBlockchain(nodeID)
+	defer bc.db.Close()
+	issued := 0
+	bci := bc.Iterator()
+	for {
+		block := bci.Next()
+		for _, tx := range block.Transactions {
+			if tx.IsCoinbase() {
+				issued += tx.OutputValue()
+			}
+		}
+		if len(block.PrevBlockHash) == 0 {
+			break
+		}
+	}
+	height := bc.GetBestHeight()
+	fmt.Printf("Height: %d\n", height)
+	fmt.Printf("Issued: %d\n", issued)
+	fmt.Printf("Next block subsidy: %d\n", GetBlockSubsidy(height+1))
+	fmt.Printf("Max supply: %d\n", MaxSupply())
+}
+
 func (cli *CLI) reindexUTXO(nodeID string) {
 	bc := PositioningBlockchain(nodeID)
 	UTXOSet := UTXOSet{bc}
@@ -116,8 +205,21 @@ func (cli *CLI) reindexUTXO(nodeID string) {
 	count := UTXOSet.CountTransactions()
 	fmt.Printf("Done! There are %d transactions in the UTXO set.\n", count)
 }
-func (cli *CLI) startNode(nodeID, minerAddress string) {
+func (cli *CLI) startNode(nodeID, minerAddress string, seeds []string, spv bool) {
 	fmt.Printf("Starting node %s\n", nodeID)
+	if spv {
+		wallets, err := NewWallets(nodeID)
+		if err != nil || len(wallets.Wallets) == 0 {
+			log.Panic("ERROR: SPV mode needs addresses in the wallet file")
+		}
+		var pubKeys [][]byte
+		for _, address := range wallets.GetAddresses() {
+			fmt.Println("SPV mode is on. Tracking address: ", address)
+			pubKeys = append(pubKeys, wallets.GetWallet(address).PublicKey)
+		}
+		StartSPVNode(nodeID, pubKeys, seeds).Wait()
+		return
+	}
 	if len(minerAddress) > 0 {
 		if ValidateAddress(minerAddress) {
 			fmt.Println("Mining is on. Address to receive rewards: ", minerAddress)
@@ -125,5 +227,207 @@ func (cli *CLI) startNode(nodeID, minerAddress string) {
 			log.Panic("Wrong miner address!")
 		}
 	}
-	StartServer(nodeID, minerAddress)
+	node := StartServer(nodeID, minerAddress, seeds)
+	node.Wait()
+}
+
+// 由公钥(十六进制)创建 M-of-N 多重签名地址，花费时把赎回脚本作为 signpartial 的 -redeem
+func (cli *CLI) createMultisig(m int, pubKeys []string) {
+	var keys [][]byte
+	for _, k := range pubKeys {
+		key, err := hex.DecodeString(k)
+		if err != nil || len(key) == 0 {
+			log.Panicf("ERROR: Public key %q is not valid hex", k)
+		}
+		keys = append(keys, key)
+	}
+	script, err := MultisigScript(m, keys)
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Printf("Multisig address (%d-of-%d): %s\n", m, len(keys), ScriptAddress(script))
+	fmt.Printf("Redeem script: %x\n", script)
+}
+
+// 把地址或十六进制的多重签名脚本转换成锁定脚本
+func lockingScript(s string) []byte {
+	if script, err := hex.DecodeString(s); err == nil {
+		if _, _, ok := extractMultisig(script); ok {
+			return script
+		}
+	}
+	if !ValidateAddress(s) {
+		log.Panicf("ERROR: %s is neither an address nor a multisig script", s)
+	}
+	return NewTXOutput(0, s).ScriptPubKey
+}
+
+// 创建未签名的部分签名交易，从 P2SH 地址花费时需要提供赎回脚本
+func (cli *CLI) createPartial(from, to string, amount, fee int, redeem, nodeID string) *PartialTransaction {
+	bc := PositioningBlockchain(nodeID)
+	defer bc.db.Close()
+	UTXOSet := UTXOSet{bc}
+	pt := NewPartialTransaction(lockingScript(from), lockingScript(to), amount, fee, &UTXOSet)
+	if redeem != "" {
+		redeemScript, err := hex.DecodeString(redeem)
+		if err != nil || pt.AddRedeemScript(redeemScript) == 0 {
+			log.Panic("ERROR: Redeem script does not match any input")
+		}
+	}
+	fmt.Printf("Created transaction %x with %d inputs\n", pt.Tx.ID, len(pt.Inputs))
+	return pt
+}
+
+// 用钱包文件中的所有密钥对部分签名交易签名后写入out
+func (cli *CLI) signPartial(pt *PartialTransaction, out, nodeID string) {
+	wallets, err := NewWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	signed := 0
+	for _, address := range wallets.GetAddresses() {
+		wallet := wallets.GetWallet(address)
+		signed += pt.Sign(&wallet)
+	}
+	writePartial(out, pt)
+	fmt.Printf("Added %d signatures to %x in %s\n", signed, pt.Tx.ID, out)
+}
+
+// 合并多个钱包分别签名的同一笔交易
+func (cli *CLI) combinePartial(files []string, out string) {
+	pt := readPartial(files[0])
+	for _, file := range files[1:] {
+		if err := pt.Combine(readPartial(file)); err != nil {
+			log.Panic(err)
+		}
+	}
+	writePartial(out, pt)
+	fmt.Printf("Combined %d files into %s\n", len(files), out)
+}
+
+// 签名足够时生成完整的交易并发送给节点
+func (cli *CLI) broadcast(file, node string) {
+	pt := readPartial(file)
+	tnx, err := pt.Finalize()
+	if err != nil {
+		log.Panic(err)
+	}
+	if err := sendMessage(node, "tx", tx{"", tnx.Serialize()}); err != nil {
+		log.Panic(err)
+	}
+	fmt.Printf("Broadcast transaction %x to %s\n", tnx.ID, node)
+}
+
+func readPartial(file string) *PartialTransaction {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Panic(err)
+	}
+	return DeserializePartialTransaction(data)
+}
+
+func writePartial(file string, pt *PartialTransaction) {
+	err := ioutil.WriteFile(file, pt.Serialize(), 0644)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// 创建哈希时间锁合约并把amount锁定到合约地址
+// secretHash 为空时生成随机的原像并打印，由发起原子交换的一方保存
+func (cli *CLI) htlcCreate(from, to string, amount, fee int, lockTime int64, secretHash, nodeID string, mineNow bool, node string) {
+	if !ValidateAddress(from) {
+		log.Panic("ERROR: Sender address is not valid")
+	}
+	if !ValidateAddress(to) {
+		log.Panic("ERROR: Recipient address is not valid")
+	}
+	if version, _ := decodeAddress(to); version != version_w {
+		log.Panic("ERROR: Recipient address is not valid")
+	}
+	var hash []byte
+	if secretHash == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			log.Panic(err)
+		}
+		sum := sha256.Sum256(secret)
+		hash = sum[:]
+		fmt.Printf("Secret: %x\n", secret)
+	} else {
+		var err error
+		if hash, err = hex.DecodeString(secretHash); err != nil || len(hash) != sha256.Size {
+			log.Panic("ERROR: Secret hash must be 32 hex bytes")
+		}
+	}
+	_, sender := decodeAddress(from)
+	_, recipient := decodeAddress(to)
+	h := &HTLC{hash, recipient, sender, lockTime}
+
+	bc := PositioningBlockchain(nodeID)
+	UTXOSet := UTXOSet{bc}
+	defer bc.db.Close()
+	wallet := cli.walletFor(from, nodeID)
+	tnx := NewUTXOTransaction(&wallet, string(h.Address()), amount, fee, &UTXOSet)
+	if err := submitTransaction(bc, tnx, from, fee, mineNow, node); err != nil {
+		fmt.Printf("ERROR: %v\n", err)
+		return
+	}
+
+	fmt.Printf("Secret hash: %x\n", hash)
+	fmt.Printf("Contract: %x\n", h.Script())
+	fmt.Printf("Contract address: %s\n", h.Address())
+	fmt.Printf("Refundable after: %d\n", lockTime)
+}
+
+// 用原像领取合约(secret 不为空)，或者在超时后取回合约(secret 为空)，付给to
+func (cli *CLI) htlcSpend(contract, secret, to string, fee int, nodeID string, mineNow bool, node string) {
+	if !ValidateAddress(to) {
+		log.Panic("ERROR: Recipient address is not valid")
+	}
+	script, err := hex.DecodeString(contract)
+	if err != nil {
+		log.Panic(err)
+	}
+	h, ok := extractHTLC(script)
+	if !ok {
+		log.Panic(ErrNotHTLC)
+	}
+	var preimage []byte
+	owner := h.Sender
+	if secret != "" {
+		if preimage, err = hex.DecodeString(secret); err != nil {
+			log.Panic(err)
+		}
+		owner = h.Recipient
+	}
+
+	bc := PositioningBlockchain(nodeID)
+	UTXOSet := UTXOSet{bc}
+	defer bc.db.Close()
+	wallet := cli.walletFor(string(encodeAddress(version_w, owner)), nodeID)
+	tnx, err := NewHTLCSpendTransaction(&wallet, script, preimage, to, fee, &UTXOSet)
+	if err != nil {
+		log.Panic(err)
+	}
+	if err := submitTransaction(bc, tnx, to, fee, mineNow, node); err != nil {
+		fmt.Printf("ERROR: %v\n", err)
+		return
+	}
+	fmt.Printf("Spent contract in transaction %x\n", tnx.ID)
+}
+
+// 取出地址的钱包，没有设置 cli.wallets 时从节点的钱包文件读取
+func (cli *CLI) walletFor(address, nodeID string) Wallet {
+	wallets := cli.wallets
+	if wallets == nil {
+		var err error
+		if wallets, err = NewWallets(nodeID); err != nil {
+			log.Panic(err)
+		}
+	}
+	if wallets.Wallets[address] == nil {
+		log.Panicf("ERROR: No wallet for %s", address)
+	}
+	return wallets.GetWallet(address)
 }
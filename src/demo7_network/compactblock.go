@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// 短交易ID的字节数
+const shortIDLength = 6
+
+// 等待 blocktxn 的时间，超时后改为下载完整区块
+var partialBlockTimeout = 10 * time.Second
+
+// 紧凑区块：区块头加上每笔交易的短ID，接收方用自己内存池中的交易还原区块
+// coinbase 交易接收方一定没有，直接放在 Prefilled 中
+type cmpctblock struct {
+	AddrFrom  string
+	Header    []byte
+	ShortIDs  []uint64
+	Prefilled []prefilledTx
+}
+
+// 随紧凑区块一起发送的完整交易，Index 为交易在区块中的位置
+type prefilledTx struct {
+	Index int
+	Tx    []byte
+}
+
+// 请求紧凑区块中本地没有的交易，Indexes 为交易在区块中的位置
+type getblocktxn struct {
+	AddrFrom  string
+	BlockHash []byte
+	Indexes   []int
+}
+
+// 回复 getblocktxn，按请求的顺序排列
+type blocktxn struct {
+	AddrFrom     string
+	BlockHash    []byte
+	Transactions [][]byte
+}
+
+// 正在还原的区块，缺少的交易为 nil，from 为被请求 blocktxn 的连接
+type partialBlock struct {
+	header    BlockHeader
+	txs       []*Transaction
+	from      *Peer
+	requested time.Time
+}
+
+// 计算交易在某个区块中的短ID：区块哈希和交易ID拼接后哈希，取前6个字节
+// 用区块哈希作为盐，同一笔交易在不同区块中的短ID不同，难以构造碰撞
+func shortTxID(blockHash, txID []byte) uint64 {
+	sum := sha256.Sum256(append(append([]byte{}, blockHash...), txID...))
+	var buf [8]byte
+	copy(buf[:], sum[:shortIDLength])
+	return binary.LittleEndian.Uint64(buf[:])
+}
+
+// 由区块构建紧凑区块
+func newCmpctBlock(from string, b *Block) cmpctblock {
+	cb := cmpctblock{AddrFrom: from, Header: b.BlockHeader.Serialize()}
+	for i, tx := range b.Transactions {
+		if tx.IsCoinbase() {
+			cb.Prefilled = append(cb.Prefilled, prefilledTx{i, tx.Serialize()})
+			continue
+		}
+		cb.ShortIDs = append(cb.ShortIDs, shortTxID(b.Hash, tx.ID))
+	}
+	return cb
+}
+
+// 用pool中的交易还原区块的交易列表，返回还原的交易(缺少的为 nil)和缺少的交易位置
+func (cb *cmpctblock) reconstruct(blockHash []byte, pool []*Transaction) ([]*Transaction, []int, error) {
+	count := len(cb.ShortIDs) + len(cb.Prefilled)
+	if count == 0 {
+		return nil, nil, fmt.Errorf("%w: compact block has no transactions", ErrMalformedBlock)
+	}
+	txs := make([]*Transaction, count)
+	for _, pre := range cb.Prefilled {
+		if pre.Index < 0 || pre.Index >= count || txs[pre.Index] != nil {
+			return nil, nil, fmt.Errorf("%w: bad prefilled index %d", ErrMalformedBlock, pre.Index)
+		}
+		tx := DeserializeTransaction(pre.Tx)
+		txs[pre.Index] = &tx
+	}
+
+	byShortID := make(map[uint64]*Transaction)
+	for _, tx := range pool {
+		byShortID[shortTxID(blockHash, tx.ID)] = tx
+	}
+	var missing []int
+	next := 0
+	for i := range txs {
+		if txs[i] != nil {
+			continue
+		}
+		if tx, ok := byShortID[cb.ShortIDs[next]]; ok {
+			txs[i] = tx
+		} else {
+			missing = append(missing, i)
+		}
+		next++
+	}
+	return txs, missing, nil
+}
+
+// 把还原好的交易组装成区块，默克尔根不一致(短ID碰撞)时返回 nil
+func (pb *partialBlock) block(hash []byte) *Block {
+	b := &Block{pb.header, pb.txs, hash}
+	if !bytes.Equal(b.HashTransactions(), pb.header.MerkleRoot) {
+		return nil
+	}
+	return b
+}
+
+// 向链足够新的、支持紧凑区块的全节点发送紧凑区块，其他节点发送 inv
+// 落后太多的节点无法连接这个区块，让它们先通过 inv 同步区块头
+// 加载了过滤器的轻节点也发送 inv，由它们请求过滤后的区块
+func (n *Node) relayBlock(from *Peer, b *Block) {
+	var cb *cmpctblock
+	for _, p := range n.Peers() {
+		if p == from || !p.handshakeDone() {
+			continue
+		}
+		if p.RemoteVersion().Services&SFNodeFull == 0 {
+			if p.hasFilter() {
+				n.sendInv(p, "block", [][]byte{b.Hash})
+			}
+			continue
+		}
+		if p.RemoteVersion().Version < compactBlocksVersion || p.BestHeight() < b.Height-1 {
+			n.sendInv(p, "block", [][]byte{b.Hash})
+			continue
+		}
+		if cb == nil {
+			c := newCmpctBlock(n.Address, b)
+			cb = &c
+		}
+		p.Send("cmpctblock", *cb)
+	}
+}
+
+func (n *Node) handleCmpctBlock(p *Peer, request []byte) {
+	var buff bytes.Buffer
+	var payload cmpctblock
+
+	buff.Write(request)
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		n.misbehaving(p, banScoreMalformed, fmt.Sprintf("malformed cmpctblock: %v", err))
+		return
+	}
+
+	header := DeserializeHeader(payload.Header)
+	if header == nil {
+		n.misbehaving(p, banScoreMalformed, "malformed compact block header")
+		return
+	}
+	hash := header.Hash()
+	fmt.Printf("Recevied compact block %x with %d short IDs\n", hash, len(payload.ShortIDs))
+	if n.bc.hasBlock(hash) {
+		return
+	}
+	p.updateHeight(header.Height)
+	//先验证区块头，不认识父区块时按区块头优先的方式同步
+	if err := n.bc.AddHeader(header); err != nil {
+		fmt.Printf("Rejected compact block from %s: %v\n", p, err)
+		var verr *BlockValidationError
+		if errors.Is(err, ErrOrphanBlock) {
+			n.sendGetHeaders(p)
+		} else if errors.As(err, &verr) {
+			n.misbehaving(p, blockBanScore(err), err.Error())
+		}
+		return
+	}
+
+	txs, missing, err := payload.reconstruct(hash, n.mempool.Transactions())
+	if err != nil {
+		n.misbehaving(p, banScoreMalformed, err.Error())
+		return
+	}
+	pb := &partialBlock{*header, txs, p, time.Now()}
+	if len(missing) > 0 {
+		fmt.Printf("Requesting %d missing transactions of block %x\n", len(missing), hash)
+		n.partialBlocks[hex.EncodeToString(hash)] = pb
+		p.Send("getblocktxn", getblocktxn{n.Address, hash, missing})
+		return
+	}
+	n.completePartialBlock(p, hash, pb)
+}
+
+// 还原出完整区块后按普通区块处理，还原失败时请求完整区块
+func (n *Node) completePartialBlock(p *Peer, hash []byte, pb *partialBlock) {
+	b := pb.block(hash)
+	if b == nil {
+		fmt.Printf("Compact block %x does not match its merkle root, requesting full block\n", hash)
+		n.sendGetData(p, "block", hash)
+		return
+	}
+	n.processBlock(p, b)
+}
+
+func (n *Node) handleGetBlockTxn(p *Peer, request []byte) {
+	var buff bytes.Buffer
+	var payload getblocktxn
+
+	buff.Write(request)
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		n.misbehaving(p, banScoreMalformed, fmt.Sprintf("malformed getblocktxn: %v", err))
+		return
+	}
+
+	b, err := n.bc.GetBlock(payload.BlockHash)
+	if err != nil {
+		n.sendNotFound(p, "block", payload.BlockHash)
+		return
+	}
+	resp := blocktxn{n.Address, payload.BlockHash, nil}
+	for _, i := range payload.Indexes {
+		if i < 0 || i >= len(b.Transactions) {
+			n.misbehaving(p, banScoreMalformed, fmt.Sprintf("getblocktxn index %d out of range", i))
+			return
+		}
+		resp.Transactions = append(resp.Transactions, b.Transactions[i].Serialize())
+	}
+	p.Send("blocktxn", resp)
+}
+
+func (n *Node) handleBlockTxn(p *Peer, request []byte) {
+	var buff bytes.Buffer
+	var payload blocktxn
+
+	buff.Write(request)
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		n.misbehaving(p, banScoreMalformed, fmt.Sprintf("malformed blocktxn: %v", err))
+		return
+	}
+
+	//只接受向其请求过的连接的回复
+	id := hex.EncodeToString(payload.BlockHash)
+	pb, ok := n.partialBlocks[id]
+	if !ok || pb.from != p {
+		fmt.Printf("Ignoring unrequested blocktxn for block %x from %s\n", payload.BlockHash, p)
+		return
+	}
+	delete(n.partialBlocks, id)
+	next := 0
+	for i := range pb.txs {
+		if pb.txs[i] != nil {
+			continue
+		}
+		if next >= len(payload.Transactions) {
+			fmt.Printf("%s sent too few transactions for block %x\n", p, payload.BlockHash)
+			n.sendGetData(p, "block", payload.BlockHash)
+			return
+		}
+		tx := DeserializeTransaction(payload.Transactions[next])
+		pb.txs[i] = &tx
+		next++
+	}
+	n.completePartialBlock(p, payload.BlockHash, pb)
+}
+
+// 丢弃等待 blocktxn 超时的紧凑区块，改为通过下载管理器请求完整区块
+func (n *Node) expirePartialBlocks(now time.Time) {
+	n.chainMu.Lock()
+	defer n.chainMu.Unlock()
+	expired := false
+	for id, pb := range n.partialBlocks {
+		if now.Sub(pb.requested) >= partialBlockTimeout {
+			fmt.Printf("%s did not send the missing transactions of block %s\n", pb.from, id)
+			delete(n.partialBlocks, id)
+			expired = true
+		}
+	}
+	if expired {
+		n.requestMissingBlocks()
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"math/big"
+	"sort"
+)
+
+// 难度调整参数
+var (
+	//难度目标的上限(最低难度)，对应前8位为0
+	powLimit = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 256-8), big.NewInt(1))
+	//创世区块使用的难度目标，对应前16位为0
+	initialBits = BigToCompact(new(big.Int).Lsh(big.NewInt(1), 256-16))
+	//每隔多少个区块调整一次难度
+	retargetInterval = 10
+	//期望的出块间隔(秒)
+	targetBlockSpacing int64 = 10
+)
+
+// 计算过去中位时间所用的区块数
+const medianTimeBlocks = 11
+
+// 计算prev之后的区块应当使用的难度目标
+// 每 retargetInterval 个区块根据上一个周期实际花费的时间调整一次，其余区块沿用prev的难度
+func (bc *Blockchain) CalcNextRequiredBits(prev *BlockHeader) uint32 {
+	if (prev.Height+1)%retargetInterval != 0 {
+		return prev.Bits
+	}
+	//找到本周期的第一个区块
+	first := prev
+	for i := 0; i < retargetInterval-1 && len(first.PrevBlockHash) > 0; i++ {
+		first = bc.findHeader(first.PrevBlockHash)
+		if first == nil {
+			return prev.Bits
+		}
+	}
+	return CalcRetargetBits(prev.Bits, prev.Timestamp-first.Timestamp)
+}
+
+// 按实际花费时间与期望时间的比例调整难度目标，每次最多调整4倍
+func CalcRetargetBits(bits uint32, actualTimespan int64) uint32 {
+	targetTimespan := int64(retargetInterval) * targetBlockSpacing
+	if actualTimespan < targetTimespan/4 {
+		actualTimespan = targetTimespan / 4
+	}
+	if actualTimespan > targetTimespan*4 {
+		actualTimespan = targetTimespan * 4
+	}
+	//新目标 = 旧目标 * 实际时间 / 期望时间
+	newTarget := CompactToBig(bits)
+	newTarget.Mul(newTarget, big.NewInt(actualTimespan))
+	newTarget.Div(newTarget, big.NewInt(targetTimespan))
+	if newTarget.Cmp(powLimit) > 0 {
+		newTarget.Set(powLimit)
+	}
+	return BigToCompact(newTarget)
+}
+
+// 返回区块header及其之前共 medianTimeBlocks 个区块时间戳的中位数
+// 新区块的时间戳必须大于这个值，防止矿工把时间往回拨
+func (bc *Blockchain) medianTimePast(header *BlockHeader) int64 {
+	var timestamps []int64
+	for header != nil && len(timestamps) < medianTimeBlocks {
+		timestamps = append(timestamps, header.Timestamp)
+		if len(header.PrevBlockHash) == 0 {
+			break
+		}
+		header = bc.findHeader(header.PrevBlockHash)
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	return timestamps[len(timestamps)/2]
+}
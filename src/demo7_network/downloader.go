@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/hex"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 区块下载参数
+var (
+	//每个连接上同时请求的区块数上限
+	maxBlocksInFlightPerPeer = 16
+	//请求超过这个时间没有收到区块时换一个连接重试
+	blockDownloadTimeout = 20 * time.Second
+	//缓存的区块超过这个时间还没有等到父区块就被丢弃，之后同步区块头时会重新请求
+	blockBufferTimeout = time.Minute
+)
+
+// 检查下载超时的间隔
+const blockDownloadCheckInterval = time.Second
+
+// 一个待下载的区块，peer 为 nil 时还在等待分配
+type blockRequest struct {
+	hash   []byte
+	height int
+	peer   *Peer
+	sent   time.Time
+	//上一次请求超时或者回复 notfound 的连接，重试时优先选择其他连接
+	failed *Peer
+}
+
+// 收到但父区块还没有区块体的区块，以及发送它的连接和收到的时间
+type bufferedBlock struct {
+	block *Block
+	from  *Peer
+	added time.Time
+}
+
+// 区块下载管理器：先同步区块头，再把缺少的区块体分配给多个连接并行下载
+// 收到的区块可能乱序，父区块还没有连接到链上的区块先缓存起来，保证按高度顺序连接
+type blockDownloader struct {
+	node *Node
+
+	mu sync.Mutex
+	//等待分配的请求，按高度从低到高排列
+	queue    []*blockRequest
+	inFlight map[string]*blockRequest
+	//等待分配和正在下载的所有请求，键为区块哈希
+	requests map[string]*blockRequest
+	//键为区块哈希
+	buffered map[string]*bufferedBlock
+	//键为父区块哈希，值为缓存中以它为父区块的区块哈希，同一个父区块可能有多个相互竞争的子区块
+	children map[string][]string
+}
+
+func newBlockDownloader(node *Node) *blockDownloader {
+	return &blockDownloader{
+		node:     node,
+		inFlight: make(map[string]*blockRequest),
+		requests: make(map[string]*blockRequest),
+		buffered: make(map[string]*bufferedBlock),
+		children: make(map[string][]string),
+	}
+}
+
+// 是否已经在下载或者缓存了这个区块
+func (d *blockDownloader) knownLocked(id string) bool {
+	_, requested := d.requests[id]
+	_, buffered := d.buffered[id]
+	return requested || buffered
+}
+
+// 把需要下载的区块加入队列并分配给连接，已经在下载的区块会被跳过
+func (d *blockDownloader) add(reqs []*blockRequest) {
+	d.mu.Lock()
+	for _, req := range reqs {
+		id := hex.EncodeToString(req.hash)
+		if !d.knownLocked(id) {
+			d.requests[id] = req
+			d.queue = append(d.queue, req)
+		}
+	}
+	d.sortQueueLocked()
+	d.mu.Unlock()
+	d.fill()
+}
+
+func (d *blockDownloader) sortQueueLocked() {
+	sort.SliceStable(d.queue, func(i, j int) bool {
+		return d.queue[i].height < d.queue[j].height
+	})
+}
+
+// 把队列中的请求分配给有空闲名额、并且链足够长的连接，优先选择请求最少的连接
+func (d *blockDownloader) fill() {
+	//在获取 d.mu 之前读取连接的状态，避免与 Peer.mu 形成锁顺序问题
+	var peers []*Peer
+	heights := make(map[*Peer]int)
+	for _, p := range d.node.Peers() {
+		if p.handshakeDone() && p.RemoteVersion().Services&SFNodeFull != 0 {
+			peers = append(peers, p)
+			heights[p] = p.BestHeight()
+		}
+	}
+
+	type assignment struct {
+		peer *Peer
+		hash []byte
+	}
+	var sends []assignment
+	now := time.Now()
+
+	d.mu.Lock()
+	load := make(map[*Peer]int)
+	for _, req := range d.inFlight {
+		load[req.peer]++
+	}
+	var waiting []*blockRequest
+	for _, req := range d.queue {
+		//重试时尽量不选上次超时的连接，其次选请求最少的连接
+		better := func(p, q *Peer) bool {
+			if (p == req.failed) != (q == req.failed) {
+				return q == req.failed
+			}
+			return load[p] < load[q]
+		}
+		var best *Peer
+		for _, p := range peers {
+			if load[p] >= maxBlocksInFlightPerPeer || heights[p] < req.height {
+				continue
+			}
+			//失败的连接要等到超时之后才会再次被选择，避免反复向同一个连接请求
+			if p == req.failed && now.Sub(req.sent) < blockDownloadTimeout {
+				continue
+			}
+			if best == nil || better(p, best) {
+				best = p
+			}
+		}
+		if best == nil {
+			waiting = append(waiting, req)
+			continue
+		}
+		req.peer, req.sent = best, now
+		d.inFlight[hex.EncodeToString(req.hash)] = req
+		load[best]++
+		sends = append(sends, assignment{best, req.hash})
+	}
+	d.queue = waiting
+	d.mu.Unlock()
+
+	//在锁外发送，Peer.Send 可能因为队列已满而断开连接
+	for _, s := range sends {
+		d.node.sendGetData(s.peer, "block", s.hash)
+	}
+}
+
+// 收到一个区块后调用，返回它是否是请求过的区块
+func (d *blockDownloader) received(hash []byte) bool {
+	id := hex.EncodeToString(hash)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	req, ok := d.requests[id]
+	if !ok {
+		return false
+	}
+	delete(d.requests, id)
+	if req.peer != nil {
+		delete(d.inFlight, id)
+		return true
+	}
+	//还没有分配就收到的区块从队列中移除
+	for i, r := range d.queue {
+		if r == req {
+			d.queue = append(d.queue[:i], d.queue[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+// 缓存父区块还没有区块体的区块
+func (d *blockDownloader) buffer(b *Block, from *Peer) {
+	id := hex.EncodeToString(b.Hash)
+	parent := hex.EncodeToString(b.PrevBlockHash)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.buffered[id]; ok {
+		return
+	}
+	d.buffered[id] = &bufferedBlock{b, from, time.Now()}
+	d.children[parent] = append(d.children[parent], id)
+}
+
+// 取出以parent为父区块的所有缓存区块
+func (d *blockDownloader) takeChildren(parent []byte) []*bufferedBlock {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var blocks []*bufferedBlock
+	for _, id := range d.children[hex.EncodeToString(parent)] {
+		blocks = append(blocks, d.unbufferLocked(id))
+	}
+	return blocks
+}
+
+// 从缓存中移除区块id并返回它
+func (d *blockDownloader) unbufferLocked(id string) *bufferedBlock {
+	b := d.buffered[id]
+	delete(d.buffered, id)
+	parent := hex.EncodeToString(b.block.PrevBlockHash)
+	ids := d.children[parent]
+	for i, child := range ids {
+		if child == id {
+			ids = append(ids[:i], ids[i+1:]...)
+			break
+		}
+	}
+	if len(ids) == 0 {
+		delete(d.children, parent)
+	} else {
+		d.children[parent] = ids
+	}
+	return b
+}
+
+// 区块被拒绝后，缓存中它的后代都无法连接，全部丢弃
+func (d *blockDownloader) rejected(hash []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	parents := []string{hex.EncodeToString(hash)}
+	for len(parents) > 0 {
+		ids := d.children[parents[0]]
+		parents = parents[1:]
+		for _, id := range ids {
+			d.unbufferLocked(id)
+			parents = append(parents, id)
+		}
+	}
+}
+
+// 连接断开后把它正在下载的区块和它发来的缓存区块放回队列，由下一次定时检查重新分配
+// 调用者可能持有 Peer.mu，这里不能发送消息
+func (d *blockDownloader) removePeer(p *Peer) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for id, b := range d.buffered {
+		if b.from == p {
+			d.unbufferLocked(id)
+			req := &blockRequest{hash: b.block.Hash, height: b.block.Height}
+			d.requests[id] = req
+			d.queue = append(d.queue, req)
+		}
+	}
+	d.requeueLocked(func(req *blockRequest) bool { return req.peer == p })
+}
+
+// 对方回复没有这个区块，把请求放回队列并立即分配给其他连接
+func (d *blockDownloader) notFound(p *Peer, hash []byte) {
+	id := hex.EncodeToString(hash)
+	d.mu.Lock()
+	req, ok := d.inFlight[id]
+	if !ok || req.peer != p {
+		d.mu.Unlock()
+		return
+	}
+	req.failed = p
+	d.requeueLocked(func(r *blockRequest) bool { return r == req })
+	d.mu.Unlock()
+	d.fill()
+}
+
+// 把超时的请求放回队列，重试时换一个连接，丢弃等待父区块太久的缓存区块
+func (d *blockDownloader) checkTimeouts(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for id, b := range d.buffered {
+		if now.Sub(b.added) >= blockBufferTimeout {
+			d.unbufferLocked(id)
+		}
+	}
+	d.requeueLocked(func(req *blockRequest) bool {
+		if now.Sub(req.sent) < blockDownloadTimeout {
+			return false
+		}
+		req.failed = req.peer
+		return true
+	})
+}
+
+// 把满足条件的在途请求放回队列
+func (d *blockDownloader) requeueLocked(match func(req *blockRequest) bool) {
+	for id, req := range d.inFlight {
+		if match(req) {
+			delete(d.inFlight, id)
+			req.peer = nil
+			d.queue = append(d.queue, req)
+		}
+	}
+	d.sortQueueLocked()
+}
+
+// 是否还有没有完成的下载
+func (d *blockDownloader) idle() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.queue) == 0 && len(d.inFlight) == 0 && len(d.buffered) == 0
+}
+
+// 定期检查下载超时和等待 blocktxn 超时的紧凑区块，并把队列中的请求分配给新的连接，直到节点停止
+func (d *blockDownloader) run() {
+	defer d.node.wg.Done()
+	ticker := time.NewTicker(blockDownloadCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.node.quit:
+			return
+		case now := <-ticker.C:
+			d.node.expirePartialBlocks(now)
+			d.checkTimeouts(now)
+			d.fill()
+		}
+	}
+}
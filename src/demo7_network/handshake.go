@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// 协议版本，低于 minProtocolVersion 的节点使用旧的消息格式，无法通信
+// 版本不低于 compactBlocksVersion 的节点可以接收紧凑区块
+const (
+	nodeVersion          = 3
+	minProtocolVersion   = 2
+	compactBlocksVersion = 3
+)
+
+// 节点在握手时声明的用户代理
+const userAgent = "/SimpleBitcoin:0.7/"
+
+// 连接建立后必须在这段时间内完成握手
+const handshakeTimeout = 30 * time.Second
+
+// 节点提供的服务(version 消息中的 Services 位)
+const (
+	//保存完整区块链，可以提供区块和区块头
+	SFNodeFull uint64 = 1 << iota
+	//挖矿
+	SFNodeMiner
+	//只有钱包功能，不保存区块链，只会发送交易
+	SFNodeWallet
+)
+
+// 握手被拒绝的原因
+var (
+	ErrSelfConnection      = errors.New("connected to self")
+	ErrIncompatibleVersion = errors.New("incompatible protocol version")
+	ErrDuplicateVersion    = errors.New("duplicate version message")
+)
+
+// 生成握手使用的随机数
+func randomNonce() uint64 {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		log.Panic(err)
+	}
+	return binary.LittleEndian.Uint64(b[:])
+}
+
+// 检查对方的 version 消息，返回拒绝的原因
+func (n *Node) checkVersion(p *Peer, v *version) error {
+	if p.RemoteVersion() != nil {
+		return ErrDuplicateVersion
+	}
+	if v.Nonce == n.nonce {
+		return ErrSelfConnection
+	}
+	if v.Version < minProtocolVersion {
+		return fmt.Errorf("%w: %d, need at least %d", ErrIncompatibleVersion, v.Version, minProtocolVersion)
+	}
+	return nil
+}
+
+// 收到 version：被动连接的一方回复自己的 version，双方都回复 verack
+func (n *Node) handleVersion(p *Peer, request []byte) {
+	var buff bytes.Buffer
+	var payload version
+
+	buff.Write(request)
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		n.misbehaving(p, banScoreMalformed, fmt.Sprintf("malformed version: %v", err))
+		return
+	}
+
+	//对方可以随意填写 AddrFrom，按连接的远端IP检查封禁；回环地址的连接只能按报告的监听地址检查
+	banned := n.isBanned(p.conn.RemoteAddr().String())
+	if host, _, err := net.SplitHostPort(p.conn.RemoteAddr().String()); err == nil && isLoopback(host) {
+		banned = payload.AddrFrom != "" && n.isBanned(payload.AddrFrom)
+	}
+	if banned {
+		fmt.Printf("Disconnecting %s: banned\n", p)
+		p.Close()
+		return
+	}
+	if err := n.checkVersion(p, &payload); err != nil {
+		fmt.Printf("Disconnecting %s: %v\n", p, err)
+		p.Close()
+		return
+	}
+	p.setRemoteVersion(&payload)
+	if p.inbound {
+		//被动连接在收到 version 后才知道对方的监听地址
+		if payload.AddrFrom != "" {
+			p.setAddr(payload.AddrFrom)
+		}
+		n.sendVersion(p, n.bc.GetBestHeight())
+	}
+	p.Send("verack", nil)
+}
+
+// 收到 verack，握手完成
+func (n *Node) handleVerack(p *Peer) {
+	if p.RemoteVersion() == nil || p.handshakeDone() {
+		fmt.Printf("Disconnecting %s: unexpected verack\n", p)
+		p.Close()
+		return
+	}
+	p.completeHandshake()
+	n.onHandshake(p)
+}
+
+// 握手完成后记住对方的地址并交换地址，对方的链更长时开始同步区块头
+func (n *Node) onHandshake(p *Peer) {
+	remote := p.RemoteVersion()
+	fmt.Printf("Handshake with %s done: version %d %s services %b height %d\n",
+		p, remote.Version, remote.UserAgent, remote.Services, remote.BestHeight)
+	if remote.Services&SFNodeFull == 0 || remote.AddrFrom == "" {
+		return
+	}
+	now := time.Now().Unix()
+	n.addAddress(peerAddress{remote.AddrFrom, remote.Services, now})
+	//轻节点不提供区块，不广播自己的地址
+	if n.spv != nil {
+		if !p.inbound {
+			n.sendGetAddr(p)
+		}
+		n.spv.onHandshake(p)
+		return
+	}
+	//向主动连接的节点请求地址，并广播自己的地址
+	if !p.inbound {
+		n.sendGetAddr(p)
+		n.sendAddr(p, []peerAddress{{n.Address, n.services, now}})
+	}
+	if n.bc.GetBestHeight() < remote.BestHeight {
+		n.sendGetHeaders(p)
+	}
+}
+
+// 以只有钱包功能的身份与conn另一端的节点握手，用于命令行直接发送消息
+func clientHandshake(conn net.Conn) error {
+	nonce := randomNonce()
+	err := writeMessage(conn, &message{"version", gobEncode(version{nodeVersion, 0, "", SFNodeWallet, userAgent, time.Now().Unix(), nonce})})
+	if err != nil {
+		return err
+	}
+	gotVersion, gotVerack := false, false
+	for !gotVersion || !gotVerack {
+		msg, err := readMessage(conn)
+		if err != nil {
+			return err
+		}
+		switch msg.Command {
+		case "version":
+			var remote version
+			if err := gob.NewDecoder(bytes.NewReader(msg.Payload)).Decode(&remote); err != nil {
+				return err
+			}
+			if remote.Version < minProtocolVersion {
+				return fmt.Errorf("%w: %d", ErrIncompatibleVersion, remote.Version)
+			}
+			gotVersion = true
+			if err := writeMessage(conn, &message{"verack", nil}); err != nil {
+				return err
+			}
+		case "verack":
+			gotVerack = true
+		}
+	}
+	return nil
+}
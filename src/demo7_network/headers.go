@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	bolt "go.etcd.io/bbolt"
+	"math/big"
+)
+
+// 区块头的bucket，键为区块哈希；键“l”为累计工作量最大的区块头的哈希
+const headersBucket = "headers"
+
+// 主链的高度索引，键为高度，值为主链上该高度的区块哈希
+const mainChainBucket = "mainchain"
+
+// 一条 headers 消息最多携带的区块头数量
+const maxHeadersPerMsg = 2000
+
+// 按哈希查找区块头，不存在时返回 nil
+func (bc *Blockchain) findHeader(hash []byte) *BlockHeader {
+	var header *BlockHeader
+	bc.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket([]byte(headersBucket)).Get(hash)
+		if data != nil {
+			header = DeserializeHeader(data)
+		}
+		return nil
+	})
+	return header
+}
+
+// 添加一个区块头(区块体可以稍后下载)，已存在时什么也不做
+func (bc *Blockchain) AddHeader(header *BlockHeader) error {
+	hash := header.Hash()
+	if bc.findHeader(hash) != nil {
+		return nil
+	}
+	if err := bc.ValidateHeader(header); err != nil {
+		return err
+	}
+	return bc.db.Update(func(tx *bolt.Tx) error {
+		_, err := storeHeader(tx, hash, header)
+		return err
+	})
+}
+
+// 在事务tx中保存区块头及其累计工作量，累计工作量更大时更新最佳区块头
+func storeHeader(tx *bolt.Tx, hash []byte, header *BlockHeader) (*big.Int, error) {
+	h := tx.Bucket([]byte(headersBucket))
+	err := h.Put(hash, header.Serialize())
+	if err != nil {
+		return nil, err
+	}
+	work := new(big.Int).Add(chainWorkOf(tx, header.PrevBlockHash), NewProofOfWork(header).Work())
+	err = tx.Bucket([]byte(chainWorkBucket)).Put(hash, work.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if work.Cmp(chainWorkOf(tx, h.Get([]byte("l")))) > 0 {
+		err = h.Put([]byte("l"), hash)
+	}
+	return work, err
+}
+
+// 返回累计工作量最大的区块头的哈希(可能还没有下载区块体)
+func (bc *Blockchain) BestHeaderHash() []byte {
+	var hash []byte
+	bc.db.View(func(tx *bolt.Tx) error {
+		hash = append([]byte{}, tx.Bucket([]byte(headersBucket)).Get([]byte("l"))...)
+		return nil
+	})
+	return hash
+}
+
+// 返回主链上指定高度的区块哈希，超出主链高度时返回 nil
+func (bc *Blockchain) mainChainHash(height int) []byte {
+	var hash []byte
+	bc.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket([]byte(mainChainBucket)).Get(IntToHex(int64(height)))
+		if data != nil {
+			hash = append([]byte{}, data...)
+		}
+		return nil
+	})
+	return hash
+}
+
+// 构建区块定位器：从最佳区块头开始往回取哈希，前10个逐个取，之后间隔每次翻倍，最后是创世区块
+// 对方根据定位器找到双方链的分叉点
+func (bc *Blockchain) BlockLocator() [][]byte {
+	return bc.locatorFrom(bc.BestHeaderHash())
+}
+
+func (bc *Blockchain) locatorFrom(hash []byte) [][]byte {
+	var locator [][]byte
+	header := bc.findHeader(hash)
+	step := 1
+	for header != nil {
+		locator = append(locator, hash)
+		if len(header.PrevBlockHash) == 0 {
+			return locator
+		}
+		if len(locator) >= 10 {
+			step *= 2
+		}
+		for i := 0; i < step && len(header.PrevBlockHash) > 0; i++ {
+			hash = header.PrevBlockHash
+			header = bc.findHeader(hash)
+			if header == nil {
+				return locator
+			}
+		}
+	}
+	return locator
+}
+
+// 根据定位器找到与主链的分叉点，返回分叉点之后最多max个主链区块头的哈希，遇到stopHash时停止
+func (bc *Blockchain) LocateHashes(locator [][]byte, stopHash []byte, max int) [][]byte {
+	start := 1
+	for _, hash := range locator {
+		header := bc.findHeader(hash)
+		if header != nil && bytes.Equal(bc.mainChainHash(header.Height), hash) {
+			start = header.Height + 1
+			break
+		}
+	}
+	var hashes [][]byte
+	for height := start; len(hashes) < max; height++ {
+		hash := bc.mainChainHash(height)
+		if hash == nil {
+			break
+		}
+		hashes = append(hashes, hash)
+		if bytes.Equal(hash, stopHash) {
+			break
+		}
+	}
+	return hashes
+}
+
+// 返回最佳区块头链上还没有区块体的区块哈希，按高度从低到高排列
+func (bc *Blockchain) MissingBlocks() [][]byte {
+	var missing [][]byte
+	hash := bc.BestHeaderHash()
+	for len(hash) > 0 && !bc.hasBlock(hash) {
+		header := bc.findHeader(hash)
+		if header == nil {
+			break
+		}
+		missing = append([][]byte{hash}, missing...)
+		hash = header.PrevBlockHash
+	}
+	return missing
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// 哈希时间锁合约(HTLC)：接收方在超时前出示哈希原像就能领取，超时后发送方可以取回
+// 两条链上用同一个哈希各锁定一笔币就可以原子交换：一方在一条链上领取时公开了原像，另一方用它在另一条链上领取
+type HTLC struct {
+	SecretHash []byte
+	//接收方和发送方的公钥哈希
+	Recipient []byte
+	Sender    []byte
+	//锁定时间之后发送方才能取回，小于 lockTimeThreshold 时为区块高度，否则为 Unix 时间
+	LockTime int64
+}
+
+// 花费合约失败的原因
+var (
+	ErrNotHTLC       = errors.New("script is not a hash time locked contract")
+	ErrBadPreimage   = errors.New("preimage does not match secret hash")
+	ErrNotHTLCParty  = errors.New("wallet cannot spend this branch of the contract")
+	ErrNoHTLCOutputs = errors.New("no spendable outputs locked to contract")
+)
+
+// 合约的赎回脚本，币锁定到它的 P2SH 地址：
+// OP_IF OP_SHA256 <secretHash> OP_EQUALVERIFY OP_DUP OP_HASH160 <recipient>
+// OP_ELSE <lockTime> OP_CHECKLOCKTIMEVERIFY OP_DROP OP_DUP OP_HASH160 <sender>
+// OP_ENDIF OP_EQUALVERIFY OP_CHECKSIG
+func (h *HTLC) Script() []byte {
+	return NewScriptBuilder().
+		AddOp(OP_IF).
+		AddOp(OP_SHA256).AddData(h.SecretHash).AddOp(OP_EQUALVERIFY).
+		AddOp(OP_DUP).AddOp(OP_HASH160).AddData(h.Recipient).
+		AddOp(OP_ELSE).
+		AddInt(h.LockTime).AddOp(OP_CHECKLOCKTIMEVERIFY).AddOp(OP_DROP).
+		AddOp(OP_DUP).AddOp(OP_HASH160).AddData(h.Sender).
+		AddOp(OP_ENDIF).
+		AddOp(OP_EQUALVERIFY).AddOp(OP_CHECKSIG).Script()
+}
+
+// 合约的 P2SH 地址
+func (h *HTLC) Address() []byte {
+	return ScriptAddress(h.Script())
+}
+
+// 赎回脚本是 HTLC 时返回合约的参数
+func extractHTLC(script []byte) (*HTLC, bool) {
+	ops, err := parseScript(script)
+	if err != nil || len(ops) != 17 {
+		return nil, false
+	}
+	lockTime, err := decodeScriptNum(ops[8].Data, 5)
+	if ops[8].Op >= OP_1 && ops[8].Op <= OP_16 {
+		lockTime, err = int64(smallInt(ops[8].Op)), nil
+	}
+	if err != nil {
+		return nil, false
+	}
+	h := &HTLC{ops[2].Data, ops[6].Data, ops[13].Data, lockTime}
+	if len(h.SecretHash) != sha256.Size || len(h.Recipient) != 20 || len(h.Sender) != 20 ||
+		!bytes.Equal(h.Script(), script) {
+		return nil, false
+	}
+	return h, true
+}
+
+// 接收方领取的解锁脚本：<signature> <pubKey> <preimage> OP_TRUE
+func HTLCClaimScriptSig(signature, pubKey, preimage []byte) []byte {
+	return NewScriptBuilder().AddData(signature).AddData(pubKey).AddData(preimage).AddOp(OP_TRUE).Script()
+}
+
+// 发送方超时取回的解锁脚本：<signature> <pubKey> OP_FALSE
+func HTLCRefundScriptSig(signature, pubKey []byte) []byte {
+	return NewScriptBuilder().AddData(signature).AddData(pubKey).AddOp(OP_FALSE).Script()
+}
+
+// 创建把锁定到合约的所有输出付给to的交易，fee 为手续费
+// preimage 不为 nil 时由接收方领取，否则由发送方取回，交易的锁定时间为合约的锁定时间
+func NewHTLCSpendTransaction(wallet *Wallet, contract, preimage []byte, to string, fee int, UTXOSet *UTXOSet) (*Transaction, error) {
+	h, ok := extractHTLC(contract)
+	if !ok {
+		return nil, ErrNotHTLC
+	}
+	pubKeyHash := HashPubKey(wallet.PublicKey)
+	tx := Transaction{}
+	sequence := uint32(sequenceFinal)
+	if preimage != nil {
+		if hash := sha256.Sum256(preimage); !bytes.Equal(hash[:], h.SecretHash) {
+			return nil, ErrBadPreimage
+		}
+		if !bytes.Equal(pubKeyHash, h.Recipient) {
+			return nil, fmt.Errorf("%w: not the recipient", ErrNotHTLCParty)
+		}
+	} else {
+		if !bytes.Equal(pubKeyHash, h.Sender) {
+			return nil, fmt.Errorf("%w: not the sender", ErrNotHTLCParty)
+		}
+		tx.LockTime = h.LockTime
+		sequence = sequenceLockTimeOnly
+	}
+
+	lock := P2SHScript(HashPubKey(contract))
+	balance, _ := UTXOSet.GetScriptBalance(lock)
+	acc, validOutputs := UTXOSet.FindSpendableScriptOutputs(lock, balance)
+	if acc == 0 || acc <= fee {
+		return nil, fmt.Errorf("%w: %d available, fee %d", ErrNoHTLCOutputs, acc, fee)
+	}
+	for txid, outs := range validOutputs {
+		txID, _ := hex.DecodeString(txid)
+		for _, out := range outs {
+			tx.Vin = append(tx.Vin, TXInput{txID, out, nil, sequence})
+		}
+	}
+	tx.Vout = append(tx.Vout, *NewTXOutput(acc-fee, to))
+	tx.ID = tx.Hash()
+
+	//P2SH 输出的签名覆盖赎回脚本，解锁脚本最后公开赎回脚本
+	for inID := range tx.Vin {
+		signature := tx.SignInput(inID, wallet.PrivateKey, contract)
+		scriptSig := HTLCRefundScriptSig(signature, wallet.PublicKey)
+		if preimage != nil {
+			scriptSig = HTLCClaimScriptSig(signature, wallet.PublicKey, preimage)
+		}
+		tx.Vin[inID].ScriptSig = append(scriptSig, NewScriptBuilder().AddData(contract).Script()...)
+	}
+	return &tx, nil
+}
+
+// 在链上查找接收方领取合约时公开的原像，原子交换的另一方用它在另一条链上领取
+func (bc *Blockchain) FindHTLCSecret(contract []byte) ([]byte, bool) {
+	h, ok := extractHTLC(contract)
+	if !ok {
+		return nil, false
+	}
+	bci := bc.Iterator()
+	for {
+		block := bci.Next()
+		for _, tx := range block.Transactions {
+			if tx.IsCoinbase() {
+				continue
+			}
+			for _, vin := range tx.Vin {
+				pushes := scriptPushes(vin.ScriptSig)
+				if len(pushes) != 4 || !bytes.Equal(pushes[3], contract) {
+					continue
+				}
+				if hash := sha256.Sum256(pushes[2]); bytes.Equal(hash[:], h.SecretHash) {
+					return pushes[2], true
+				}
+			}
+		}
+		if len(block.PrevBlockHash) == 0 {
+			break
+		}
+	}
+	return nil, false
+}
@@ -25,3 +25,18 @@ func (bi *BlockchainIterator) Next() *Block {
 	bi.currentHash = block.PrevBlockHash
 	return block
 }
+
+// 返回链中的下一个区块头，只读取区块头而不解码整个区块
+func (bi *BlockchainIterator) NextHeader() *BlockHeader {
+	var header *BlockHeader
+	err := bi.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(headersBucket))
+		header = DeserializeHeader(b.Get(bi.currentHash))
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	bi.currentHash = header.PrevBlockHash
+	return header
+}
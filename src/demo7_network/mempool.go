@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 保存内存池交易的bucket，键为交易ID，节点重启后从这里恢复内存池
+const mempoolBucket = "mempool"
+
+// 内存池参数
+var (
+	//内存池中交易序列化后的总字节数上限
+	maxMempoolSize = 300000
+	//交易在内存池中停留超过这个时间仍未被打包就会被移出
+	mempoolExpiry = 72 * time.Hour
+)
+
+// 交易不能进入内存池的原因
+var (
+	ErrAlreadyInMempool = errors.New("transaction already in mempool")
+	ErrMempoolConflict  = errors.New("transaction conflicts with mempool")
+	ErrMissingInputs    = errors.New("transaction inputs are missing or spent")
+	ErrMempoolFull      = errors.New("mempool is full and fee rate is too low")
+)
+
+// 内存池中的一笔交易
+type MempoolEntry struct {
+	Tx   Transaction
+	Fee  int
+	Size int
+	//进入内存池的时间(Unix秒)
+	Time int64
+}
+
+func (e MempoolEntry) Serialize() []byte {
+	var buff bytes.Buffer
+	enc := gob.NewEncoder(&buff)
+	err := enc.Encode(e)
+	if err != nil {
+		log.Panic(err)
+	}
+	return buff.Bytes()
+}
+
+func DeserializeMempoolEntry(data []byte) MempoolEntry {
+	var entry MempoolEntry
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	err := dec.Decode(&entry)
+	if err != nil {
+		log.Panic(err)
+	}
+	return entry
+}
+
+func (e MempoolEntry) candidate() txCandidate {
+	tx := e.Tx
+	return txCandidate{&tx, e.Fee, e.Size}
+}
+
+// 内存池：等待打包的交易，可以被多个连接同时访问
+type Mempool struct {
+	mu      sync.Mutex
+	bc      *Blockchain
+	entries map[string]*MempoolEntry
+	//交易花费的输出，键为输出(交易ID:输出索引)，值为花费它的交易ID
+	spends map[string]string
+	size   int
+}
+
+// 创建内存池并从数据库恢复上次保存的交易，已经无效或者过期的交易会被丢弃
+func NewMempool(bc *Blockchain) *Mempool {
+	mp := &Mempool{bc: bc, entries: make(map[string]*MempoolEntry), spends: make(map[string]string)}
+	var saved []MempoolEntry
+	err := bc.db.Update(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(mempoolBucket)); b != nil {
+			b.ForEach(func(k, v []byte) error {
+				saved = append(saved, DeserializeMempoolEntry(v))
+				return nil
+			})
+			if err := tx.DeleteBucket([]byte(mempoolBucket)); err != nil {
+				return err
+			}
+		}
+		_, err := tx.CreateBucket([]byte(mempoolBucket))
+		return err
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	//重新检查保存的交易，期间链可能已经变化
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	for _, entry := range saved {
+		if time.Since(time.Unix(entry.Time, 0)) <= mempoolExpiry {
+			mp.add(entry.Tx, entry.Time)
+		}
+	}
+	return mp
+}
+
+// 检查交易后放入内存池
+// 交易的输入必须都在UTXO集中，并且没有被内存池中的其他交易花费
+// 内存池满时按手续费率移出最低的交易，新交易的费率不够高时被拒绝
+func (mp *Mempool) Add(tx Transaction) error {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	mp.expire(time.Now())
+	return mp.add(tx, time.Now().Unix())
+}
+
+func (mp *Mempool) add(tx Transaction, added int64) error {
+	txID := hex.EncodeToString(tx.ID)
+	if _, ok := mp.entries[txID]; ok {
+		return ErrAlreadyInMempool
+	}
+	if tx.IsCoinbase() || !tx.HasValidID() {
+		return ErrBadTransaction
+	}
+	utxoSet := UTXOSet{mp.bc}
+	spends := make(map[string]bool)
+	for _, vin := range tx.Vin {
+		outpoint := vin.Outpoint()
+		if spends[outpoint] {
+			return fmt.Errorf("%w: %s spent twice", ErrBadTransaction, outpoint)
+		}
+		spends[outpoint] = true
+		if spender, ok := mp.spends[outpoint]; ok {
+			return fmt.Errorf("%w: %s already spent by %s", ErrMempoolConflict, outpoint, spender)
+		}
+		if _, ok := utxoSet.FindOutput(vin.Txid, vin.Vout); !ok {
+			return fmt.Errorf("%w: %s", ErrMissingInputs, outpoint)
+		}
+	}
+	fee, err := utxoSet.TransactionFee(&tx)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBadTransaction, err)
+	}
+	if err := utxoSet.CheckMaturity(&tx, mp.bc.GetBestHeight()+1); err != nil {
+		return err
+	}
+	//只接受能打包进下一个区块的交易
+	if err := mp.bc.checkTransactionLocks(&tx, mp.bc.findHeader(mp.bc.tip)); err != nil {
+		return err
+	}
+	if !mp.bc.VerifyTransaction(&tx) {
+		return fmt.Errorf("%w: bad signature", ErrBadTransaction)
+	}
+
+	entry := &MempoolEntry{tx, fee, len(tx.Serialize()), added}
+	if err := mp.makeRoom(entry); err != nil {
+		return err
+	}
+	mp.entries[txID] = entry
+	mp.size += entry.Size
+	for outpoint := range spends {
+		mp.spends[outpoint] = txID
+	}
+	mp.persist(func(b *bolt.Bucket) error {
+		return b.Put(tx.ID, entry.Serialize())
+	})
+	return nil
+}
+
+// 内存池放不下entry时，从手续费率最低的交易开始移出，直到有足够的空间
+// 需要移出费率不低于entry的交易时拒绝entry
+func (mp *Mempool) makeRoom(entry *MempoolEntry) error {
+	if mp.size+entry.Size <= maxMempoolSize {
+		return nil
+	}
+	if entry.Size > maxMempoolSize {
+		return ErrMempoolFull
+	}
+	var victims []string
+	freed := 0
+	for _, id := range mp.byFeeRate(true) {
+		if mp.size-freed+entry.Size <= maxMempoolSize {
+			break
+		}
+		if !entry.candidate().higherFeeRate(mp.entries[id].candidate()) {
+			return ErrMempoolFull
+		}
+		victims = append(victims, id)
+		freed += mp.entries[id].Size
+	}
+	for _, id := range victims {
+		mp.remove(id)
+	}
+	return nil
+}
+
+// 返回内存池中的交易ID，按手续费率从高到低排列，ascending为true时从低到高
+func (mp *Mempool) byFeeRate(ascending bool) []string {
+	ids := make([]string, 0, len(mp.entries))
+	for id := range mp.entries {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := mp.entries[ids[i]].candidate(), mp.entries[ids[j]].candidate()
+		if ascending {
+			return b.higherFeeRate(a)
+		}
+		return a.higherFeeRate(b)
+	})
+	return ids
+}
+
+// 移出在内存池中停留超过 mempoolExpiry 的交易
+func (mp *Mempool) expire(now time.Time) {
+	for id, entry := range mp.entries {
+		if now.Sub(time.Unix(entry.Time, 0)) > mempoolExpiry {
+			mp.remove(id)
+		}
+	}
+}
+
+// 把交易移出内存池，同时释放它花费的输出
+func (mp *Mempool) Remove(txID []byte) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	mp.remove(hex.EncodeToString(txID))
+}
+
+func (mp *Mempool) remove(txID string) {
+	entry, ok := mp.entries[txID]
+	if !ok {
+		return
+	}
+	for _, vin := range entry.Tx.Vin {
+		delete(mp.spends, vin.Outpoint())
+	}
+	mp.size -= entry.Size
+	delete(mp.entries, txID)
+	mp.persist(func(b *bolt.Bucket) error {
+		return b.Delete(entry.Tx.ID)
+	})
+}
+
+// 在数据库的内存池bucket中执行修改
+func (mp *Mempool) persist(fn func(b *bolt.Bucket) error) {
+	err := mp.bc.db.Update(func(tx *bolt.Tx) error {
+		return fn(tx.Bucket([]byte(mempoolBucket)))
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// 主链变化后更新内存池：被断开区块中的交易放回，被打包的交易以及与它们冲突的交易移出
+func (mp *Mempool) UpdateChain(update *ChainUpdate) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	now := time.Now().Unix()
+	//Disconnected 从原链尖开始排列，倒过来按从旧到新的顺序放回，父交易先于子交易
+	for i := len(update.Disconnected) - 1; i >= 0; i-- {
+		for _, tx := range update.Disconnected[i].Transactions {
+			if !tx.IsCoinbase() {
+				//输入已经被新主链花费的交易会被拒绝，父交易不在新主链上的交易也会被拒绝(内存池只接受输入已确认的交易)
+				mp.add(*tx, now)
+			}
+		}
+	}
+	for _, block := range update.Connected {
+		for _, tx := range block.Transactions {
+			mp.remove(hex.EncodeToString(tx.ID))
+			if tx.IsCoinbase() {
+				continue
+			}
+			for _, vin := range tx.Vin {
+				if spender, ok := mp.spends[vin.Outpoint()]; ok {
+					mp.remove(spender)
+				}
+			}
+		}
+	}
+}
+
+// 内存池中是否有这笔交易
+func (mp *Mempool) Has(txID []byte) bool {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	_, ok := mp.entries[hex.EncodeToString(txID)]
+	return ok
+}
+
+// 按ID查找内存池中的交易
+func (mp *Mempool) Get(txID []byte) (*Transaction, bool) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	entry, ok := mp.entries[hex.EncodeToString(txID)]
+	if !ok {
+		return nil, false
+	}
+	tx := entry.Tx
+	return &tx, true
+}
+
+// 返回内存池中所有交易的副本，按手续费率从高到低排列
+func (mp *Mempool) Entries() []MempoolEntry {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	var entries []MempoolEntry
+	for _, id := range mp.byFeeRate(false) {
+		entries = append(entries, *mp.entries[id])
+	}
+	return entries
+}
+
+// 返回内存池中的交易，按手续费率从高到低排列
+func (mp *Mempool) Transactions() []*Transaction {
+	var txs []*Transaction
+	for _, entry := range mp.Entries() {
+		tx := entry.Tx
+		txs = append(txs, &tx)
+	}
+	return txs
+}
+
+// 内存池中的交易数量
+func (mp *Mempool) Count() int {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	return len(mp.entries)
+}
+
+// 内存池中交易序列化后的总字节数
+func (mp *Mempool) Size() int {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	return mp.size
+}
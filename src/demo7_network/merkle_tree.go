@@ -1,6 +1,9 @@
 package main
 
-import "crypto/sha256"
+import (
+	"crypto/sha256"
+	"errors"
+)
 
 type MerkleTree struct {
 	RootNode *MerkleNode
@@ -50,13 +53,9 @@ func NewMerkleTree(data [][]byte) *MerkleTree {
 		node := NewMerkleNode(nil, nil, datum)
 		nodes = append(nodes, *node)
 	}
-	for i := 0; i < len(data)/2; i++ {
-		var newLevel []MerkleNode
-		for j := 0; j < len(nodes); j += 2 {
-			node := NewMerkleNode(&nodes[j], &nodes[j+1], nil)
-			newLevel = append(newLevel, *node)
-		}
-		nodes = newLevel
+	//逐层向上构建，直到只剩根结点(奇数个结点时复制最后一个)
+	for len(nodes) > 1 {
+		nodes = NewMerkleTreeLevel(nodes)
 	}
 	mTree := MerkleTree{&nodes[0]}
 	return &mTree
@@ -74,3 +73,103 @@ func NewMerkleTreeLevel(nodes []MerkleNode) []MerkleNode {
 	}
 	return newLevel
 }
+
+//树的高度(根结点到叶子结点的层数)
+func (t *MerkleTree) height() int {
+	h := 0
+	for node := t.RootNode; node.Left != nil; node = node.Left {
+		h++
+	}
+	return h
+}
+
+//构建部分默克尔树证明：深度优先遍历，每个结点记录一个标志位，表示它的子树中是否有匹配的叶子结点
+//没有匹配的子树只记录子树根结点的哈希，匹配的叶子结点记录自己的哈希
+//matches[i] 表示第i个叶子结点(第i笔交易)是否匹配
+func (t *MerkleTree) PartialProof(matches []bool) ([][]byte, []bool) {
+	var hashes [][]byte
+	var flags []bool
+	h := t.height()
+	var walk func(node *MerkleNode, depth, pos int)
+	walk = func(node *MerkleNode, depth, pos int) {
+		//结点覆盖的叶子结点范围
+		first, last := pos<<(h-depth), (pos+1)<<(h-depth)
+		matched := false
+		for i := first; i < last && i < len(matches); i++ {
+			matched = matched || matches[i]
+		}
+		flags = append(flags, matched)
+		if depth == h || !matched {
+			hashes = append(hashes, node.Data)
+			return
+		}
+		walk(node.Left, depth+1, pos*2)
+		walk(node.Right, depth+1, pos*2+1)
+	}
+	walk(t.RootNode, 0, 0)
+	return hashes, flags
+}
+
+//有n个叶子结点的树的高度，与 NewMerkleTree 的构建方式一致
+func merkleTreeHeight(n int) int {
+	if n%2 != 0 {
+		n++
+	}
+	h := 0
+	for n > 1 {
+		if n%2 != 0 {
+			n++
+		}
+		n /= 2
+		h++
+	}
+	return h
+}
+
+//验证部分默克尔树证明，返回算出的根哈希和匹配的叶子结点哈希
+//total 为叶子结点(交易)的个数
+func VerifyPartialProof(total int, hashes [][]byte, flags []bool) ([]byte, [][]byte, error) {
+	if total <= 0 {
+		return nil, nil, errors.New("merkle proof has no transactions")
+	}
+	h := merkleTreeHeight(total)
+	var matched [][]byte
+	usedHashes, usedFlags := 0, 0
+	var walk func(depth int) ([]byte, error)
+	walk = func(depth int) ([]byte, error) {
+		if usedFlags >= len(flags) {
+			return nil, errors.New("merkle proof ran out of flags")
+		}
+		flag := flags[usedFlags]
+		usedFlags++
+		if depth == h || !flag {
+			if usedHashes >= len(hashes) {
+				return nil, errors.New("merkle proof ran out of hashes")
+			}
+			hash := hashes[usedHashes]
+			usedHashes++
+			if depth == h && flag {
+				matched = append(matched, hash)
+			}
+			return hash, nil
+		}
+		left, err := walk(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		right, err := walk(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(append(append([]byte{}, left...), right...))
+		return sum[:], nil
+	}
+	root, err := walk(0)
+	if err != nil {
+		return nil, nil, err
+	}
+	if usedHashes != len(hashes) || usedFlags != len(flags) {
+		return nil, nil, errors.New("merkle proof has unused hashes or flags")
+	}
+	return root, matched, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// 区块大小上限(序列化后的字节数)
+const maxBlockSize = 1000000
+
+// 为 coinbase 交易和区块头预留的空间
+const blockReservedSize = 1000
+
+// 挖矿候选交易及其手续费率
+type txCandidate struct {
+	tx   *Transaction
+	fee  int
+	size int
+}
+
+// 比较手续费率 fee/size，避免整数除法丢失精度
+func (c txCandidate) higherFeeRate(other txCandidate) bool {
+	return c.fee*other.size > other.fee*c.size
+}
+
+// 从候选交易中按手续费率从高到低选择要打包的交易，直到区块大小达到上限
+// 与已选中的交易花费同一个输出的交易会被跳过
+// 输入不在UTXO集中、花费未成熟的 coinbase 输出、锁定时间未到或者签名无效的交易会被跳过，返回选中的交易和它们的手续费总额
+func selectTransactions(bc *Blockchain, txs []*Transaction) ([]*Transaction, int) {
+	utxoSet := UTXOSet{bc}
+	height := bc.GetBestHeight() + 1
+	tip := bc.findHeader(bc.tip)
+	var candidates []txCandidate
+	for _, tx := range txs {
+		fee, err := utxoSet.TransactionFee(tx)
+		if err != nil || utxoSet.CheckMaturity(tx, height) != nil || bc.checkTransactionLocks(tx, tip) != nil || !bc.VerifyTransaction(tx) {
+			continue
+		}
+		candidates = append(candidates, txCandidate{tx, fee, len(tx.Serialize())})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].higherFeeRate(candidates[j])
+	})
+
+	var selected []*Transaction
+	fees := 0
+	blockSize := blockReservedSize
+	spent := make(map[string]bool)
+Candidates:
+	for _, c := range candidates {
+		if blockSize+c.size > maxBlockSize {
+			continue
+		}
+		for _, vin := range c.tx.Vin {
+			if spent[vin.Outpoint()] {
+				continue Candidates
+			}
+		}
+		for _, vin := range c.tx.Vin {
+			spent[vin.Outpoint()] = true
+		}
+		selected = append(selected, c.tx)
+		fees += c.fee
+		blockSize += c.size
+	}
+	return selected, fees
+}
+
+// 挖矿组件：节点收到新交易或新区块后通知它，由它决定什么时候打包区块
+type Miner struct {
+	node    *Node
+	address string
+	//容量为1，多次通知在挖矿期间合并为一次
+	wake chan struct{}
+}
+
+func newMiner(node *Node, address string) *Miner {
+	return &Miner{node, address, make(chan struct{}, 1)}
+}
+
+// 通知矿工内存池或主链发生了变化，不会阻塞
+func (m *Miner) Notify() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// 等待通知，每次被唤醒后一直挖矿直到内存池中没有可以打包的交易
+func (m *Miner) run() {
+	defer m.node.wg.Done()
+	for {
+		select {
+		case <-m.node.quit:
+			return
+		case <-m.wake:
+		}
+		for m.mineBlock() {
+			select {
+			case <-m.node.quit:
+				return
+			default:
+			}
+		}
+	}
+}
+
+// 在当前链尖上打包内存池中的交易并挖出一个区块，没有可以打包的交易或者区块被拒绝时返回false
+// 工作量证明期间不持有 chainMu，节点可以继续处理消息
+func (m *Miner) mineBlock() bool {
+	n := m.node
+	n.chainMu.Lock()
+	//按手续费率选择交易，矿工领取出块奖励和手续费
+	txs, fees := selectTransactions(n.bc, n.mempool.Transactions())
+	if len(txs) == 0 {
+		n.chainMu.Unlock()
+		return false
+	}
+	prev := n.bc.findHeader(n.bc.tip)
+	cbTx := NewCoinbaseTX(m.address, "", prev.Height+1, fees)
+	n.chainMu.Unlock()
+
+	newBlock := n.bc.NewBlockOn(prev, append([]*Transaction{cbTx}, txs...))
+
+	n.chainMu.Lock()
+	defer n.chainMu.Unlock()
+	update, err := n.bc.AddBlock(newBlock)
+	if err != nil {
+		fmt.Printf("Mined block %x was rejected: %v\n", newBlock.Hash, err)
+		return false
+	}
+	n.mempool.UpdateChain(update)
+	fmt.Println("New block is mined!")
+	n.relayBlock(nil, newBlock)
+	return true
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// 每个连接等待发送的消息数上限，超过时认为对方太慢并断开连接
+const peerSendQueueSize = 1000
+
+// 写一条消息的超时时间
+const peerWriteTimeout = 30 * time.Second
+
+// 与另一个节点之间的长连接
+// 读循环依次处理收到的消息，写循环依次发送队列中的消息，所以同一个连接上可以连续发送多条消息
+type Peer struct {
+	node    *Node
+	conn    net.Conn
+	inbound bool
+
+	//对方的监听地址，主动连接时为拨号地址，被动连接时在收到 version 消息后才知道
+	mu   sync.Mutex
+	addr string
+	//握手状态：收到对方的 version 和 verack 之后握手完成
+	remote         *version
+	verackReceived bool
+	//对方已知的最高区块高度，握手时来自 version，之后随收到的区块头和区块更新
+	bestHeight int
+	//握手完成之前要发送的其他消息，握手完成后按顺序发送
+	held []*message
+	//违规分数，达到 banThreshold 时断开并封禁
+	banScore int
+	//轻节点加载的布隆过滤器，没有加载时为 nil
+	filter *bloomFilter
+
+	sendQueue chan *message
+	quit      chan struct{}
+	closeOnce sync.Once
+}
+
+func newPeer(node *Node, conn net.Conn, addr string, inbound bool) *Peer {
+	return &Peer{
+		node:      node,
+		conn:      conn,
+		inbound:   inbound,
+		addr:      addr,
+		sendQueue: make(chan *message, peerSendQueueSize),
+		quit:      make(chan struct{}),
+	}
+}
+
+// 对方的监听地址，还不知道时为空
+func (p *Peer) Addr() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.addr
+}
+
+func (p *Peer) setAddr(addr string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.addr = addr
+}
+
+func (p *Peer) String() string {
+	if addr := p.Addr(); addr != "" {
+		return addr
+	}
+	return p.conn.RemoteAddr().String()
+}
+
+// 启动读写循环，超时没有完成握手的连接会被断开
+func (p *Peer) start() {
+	p.node.wg.Add(2)
+	go p.readLoop()
+	go p.writeLoop()
+	time.AfterFunc(handshakeTimeout, func() {
+		if !p.handshakeDone() {
+			p.Close()
+		}
+	})
+}
+
+// 对方在握手时发送的 version 消息，还没有收到时为 nil
+func (p *Peer) RemoteVersion() *version {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.remote
+}
+
+func (p *Peer) setRemoteVersion(v *version) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.remote = v
+	p.bestHeight = v.BestHeight
+}
+
+// 对方已知的最高区块高度
+func (p *Peer) BestHeight() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.bestHeight
+}
+
+// 得知对方拥有高度为height的区块
+func (p *Peer) updateHeight(height int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if height > p.bestHeight {
+		p.bestHeight = height
+	}
+}
+
+func (p *Peer) handshakeDone() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.remote != nil && p.verackReceived
+}
+
+// 收到 verack 后完成握手，发送握手期间暂存的消息
+func (p *Peer) completeHandshake() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.verackReceived = true
+	held := p.held
+	p.held = nil
+	for _, msg := range held {
+		p.enqueue(msg)
+	}
+}
+
+// 增加违规分数，返回新的分数
+func (p *Peer) addBanScore(score int) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.banScore += score
+	return p.banScore
+}
+
+func (p *Peer) setFilter(f *bloomFilter) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.filter = f
+}
+
+// 向已经加载的过滤器中添加数据，没有过滤器时返回 false
+func (p *Peer) addToFilter(data []byte) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.filter == nil {
+		return false
+	}
+	p.filter.Add(data)
+	return true
+}
+
+func (p *Peer) hasFilter() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.filter != nil
+}
+
+// 交易是否与对方的过滤器匹配，匹配的输出会被加入过滤器
+func (p *Peer) filterMatch(tx *Transaction) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.filter != nil && p.filter.MatchTx(tx)
+}
+
+func (p *Peer) readLoop() {
+	defer p.node.wg.Done()
+	defer p.Close()
+	for {
+		msg, err := readMessage(p.conn)
+		if err != nil {
+			if p.closed() {
+				return
+			}
+			//对方发送了无效的消息帧，其他错误只是连接断开
+			if errors.Is(err, ErrBadMagic) || errors.Is(err, ErrBadChecksum) ||
+				errors.Is(err, ErrBadCommand) || errors.Is(err, ErrPayloadTooLarge) {
+				p.node.misbehaving(p, banScoreMalformed, err.Error())
+			}
+			if err != io.EOF {
+				fmt.Printf("Disconnecting %s: %v\n", p, err)
+			}
+			return
+		}
+		p.node.handleMessage(p, msg)
+	}
+}
+
+func (p *Peer) writeLoop() {
+	defer p.node.wg.Done()
+	defer p.Close()
+	for {
+		select {
+		case msg := <-p.sendQueue:
+			p.conn.SetWriteDeadline(time.Now().Add(peerWriteTimeout))
+			if err := writeMessage(p.conn, msg); err != nil {
+				fmt.Printf("Failed to send %s to %s: %v\n", msg.Command, p, err)
+				return
+			}
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+// 把gob编码后的消息放入发送队列，不会阻塞，payload 为 nil 时消息体为空
+// 握手完成之前，除了 version 和 verack 之外的消息先暂存起来
+func (p *Peer) Send(command string, payload interface{}) {
+	msg := &message{command, nil}
+	if payload != nil {
+		msg.Payload = gobEncode(payload)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if command != "version" && command != "verack" && !(p.remote != nil && p.verackReceived) {
+		p.held = append(p.held, msg)
+		return
+	}
+	p.enqueue(msg)
+}
+
+func (p *Peer) enqueue(msg *message) {
+	select {
+	case p.sendQueue <- msg:
+	case <-p.quit:
+	default:
+		//调用者持有 p.mu，不能使用 p.String()
+		fmt.Printf("Send queue of %s is full, disconnecting\n", p.conn.RemoteAddr())
+		p.Close()
+	}
+}
+
+// 断开连接，可以重复调用
+func (p *Peer) Close() {
+	p.closeOnce.Do(func() {
+		close(p.quit)
+		p.conn.Close()
+		p.node.removePeer(p)
+	})
+}
+
+func (p *Peer) closed() bool {
+	select {
+	case <-p.quit:
+		return true
+	default:
+		return false
+	}
+}
@@ -8,20 +8,17 @@ import (
 	"math/big"
 )
 
-// 定义挖矿难度
-const targetBits = 8
 const maxNonce = math.MaxInt64
 
 type ProofOfWork struct {
-	block  *Block
+	header *BlockHeader
 	target *big.Int
 }
 
-func NewProofOfWork(b *Block) *ProofOfWork {
-	target := big.NewInt(1)
-	//将target << uint(256-targetBits)
-	target.Lsh(target, uint(256-targetBits))
-	pow := &ProofOfWork{b, target}
+// 区块的难度目标由区块头中的 Bits 字段给出
+func NewProofOfWork(h *BlockHeader) *ProofOfWork {
+	target := CompactToBig(h.Bits)
+	pow := &ProofOfWork{h, target}
 	return pow
 }
 
@@ -52,21 +49,84 @@ func (pow *ProofOfWork) Run() (int, []byte) {
 // 上个区块信息+当前区块信息(nonce用于工作量证明)
 func (pow *ProofOfWork) prepareData(nonce int) []byte {
 	data := bytes.Join([][]byte{
-		pow.block.PrevBlockHash,
-		pow.block.HashTransactions(),
-		IntToHex(pow.block.Timestamp),
-		IntToHex(int64(targetBits)),
+		pow.header.PrevBlockHash,
+		pow.header.MerkleRoot,
+		IntToHex(pow.header.Timestamp),
+		IntToHex(int64(pow.header.Bits)),
 		IntToHex(int64(nonce)),
 	}, []byte{})
 	return data
 }
 
-// 工作量证明验证
-func (pow *ProofOfWork) Validate() bool {
+// 计算给定nonce下的区块哈希
+func (pow *ProofOfWork) CalculateHash(nonce int) []byte {
+	hash := sha256.Sum256(pow.prepareData(nonce))
+	return hash[:]
+}
+
+// 工作量证明验证(expectedBits为该高度按难度调整规则应使用的难度目标)
+func (pow *ProofOfWork) Validate(expectedBits uint32) bool {
+	if pow.header.Bits != expectedBits {
+		return false
+	}
+	if pow.target.Sign() <= 0 || pow.target.Cmp(powLimit) > 0 {
+		return false
+	}
 	var hashInt big.Int
-	data := pow.prepareData(pow.block.Nonce)
-	hash := sha256.Sum256(data)
-	hashInt.SetBytes(hash[:])
+	hash := pow.CalculateHash(pow.header.Nonce)
+	hashInt.SetBytes(hash)
 	isValid := hashInt.Cmp(pow.target) == -1
 	return isValid
 }
+
+// 区块的工作量，即找到满足目标值的哈希平均需要的尝试次数 2^256/(target+1)
+func (pow *ProofOfWork) Work() *big.Int {
+	denominator := new(big.Int).Add(pow.target, big.NewInt(1))
+	return new(big.Int).Div(new(big.Int).Lsh(big.NewInt(1), 256), denominator)
+}
+
+// 将压缩格式的难度目标转换为大整数
+// 与比特币的 nBits 相同：最高字节为指数，低3字节为尾数，target = 尾数 * 256^(指数-3)
+func CompactToBig(compact uint32) *big.Int {
+	mantissa := compact & 0x007fffff
+	exponent := uint(compact >> 24)
+	var target *big.Int
+	if exponent <= 3 {
+		mantissa >>= 8 * (3 - exponent)
+		target = big.NewInt(int64(mantissa))
+	} else {
+		target = big.NewInt(int64(mantissa))
+		target.Lsh(target, 8*(exponent-3))
+	}
+	//第24位是符号位
+	if compact&0x00800000 != 0 {
+		target.Neg(target)
+	}
+	return target
+}
+
+// 将难度目标转换为压缩格式
+func BigToCompact(n *big.Int) uint32 {
+	if n.Sign() == 0 {
+		return 0
+	}
+	var mantissa uint32
+	exponent := uint(len(n.Bytes()))
+	if exponent <= 3 {
+		mantissa = uint32(n.Bits()[0])
+		mantissa <<= 8 * (3 - exponent)
+	} else {
+		tn := new(big.Int).Abs(n)
+		mantissa = uint32(tn.Rsh(tn, 8*(exponent-3)).Bits()[0])
+	}
+	//尾数的最高位会被当作符号位，需要多用一个字节
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		exponent++
+	}
+	compact := uint32(exponent<<24) | mantissa
+	if n.Sign() < 0 {
+		compact |= 0x00800000
+	}
+	return compact
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// 部分签名交易：还没有解锁脚本的交易，加上每个输入收集到的签名
+// 可以在多个钱包之间传递，每个钱包签名自己的部分，收集到足够的签名后合成完整的交易
+type PartialTransaction struct {
+	Tx     Transaction
+	Inputs []PartialInput
+}
+
+// 部分签名交易的一个输入
+// PrevOut 为被花费的输出，签名方不需要区块链就能签名
+// RedeemScript 为花费 P2SH 输出时需要公开的赎回脚本
+// Signatures 为收集到的签名，键为公钥的十六进制
+type PartialInput struct {
+	PrevOut      TXOutput
+	RedeemScript []byte
+	Signatures   map[string][]byte
+}
+
+// 签名覆盖的脚本：P2SH 输出为赎回脚本，其他为输出的锁定脚本
+func (in *PartialInput) signScript() []byte {
+	if extractScriptHash(in.PrevOut.ScriptPubKey) != nil {
+		return in.RedeemScript
+	}
+	return in.PrevOut.ScriptPubKey
+}
+
+// 合成交易失败的原因
+var (
+	ErrPartialMismatch   = errors.New("partial transactions spend different transactions")
+	ErrNotEnoughSigs     = errors.New("not enough signatures")
+	ErrUnknownLockScript = errors.New("unknown locking script")
+	ErrNoRedeemScript    = errors.New("missing redeem script")
+)
+
+// 创建从锁定脚本为from的输出向to支付amount的部分签名交易，找零回到from
+func NewPartialTransaction(from, to []byte, amount, fee int, UTXOSet *UTXOSet) *PartialTransaction {
+	acc, validOutputs := UTXOSet.FindSpendableScriptOutputs(from, amount+fee)
+	if acc < amount+fee {
+		log.Panic("ERROR:Not enough funds")
+	}
+	pt := &PartialTransaction{}
+	for txid, outs := range validOutputs {
+		txID, _ := hex.DecodeString(txid)
+		for _, out := range outs {
+			prevOut, _ := UTXOSet.FindOutput(txID, out)
+			pt.Tx.Vin = append(pt.Tx.Vin, TXInput{txID, out, nil, sequenceFinal})
+			pt.Inputs = append(pt.Inputs, PartialInput{prevOut, nil, make(map[string][]byte)})
+		}
+	}
+	pt.Tx.Vout = append(pt.Tx.Vout, TXOutput{amount, to})
+	if acc > amount+fee {
+		pt.Tx.Vout = append(pt.Tx.Vout, TXOutput{acc - amount - fee, from})
+	}
+	pt.Tx.ID = pt.Tx.Hash()
+	return pt
+}
+
+// 为花费哈希与redeemScript一致的 P2SH 输出的输入加上赎回脚本，返回加上的个数
+func (pt *PartialTransaction) AddRedeemScript(redeemScript []byte) int {
+	added := 0
+	for i := range pt.Inputs {
+		if bytes.Equal(extractScriptHash(pt.Inputs[i].PrevOut.ScriptPubKey), HashPubKey(redeemScript)) {
+			pt.Inputs[i].RedeemScript = redeemScript
+			added++
+		}
+	}
+	return added
+}
+
+// 用钱包对能签名的输入签名：锁定到钱包的公钥哈希，或者多重签名中包含钱包的公钥，返回新增的签名数
+func (pt *PartialTransaction) Sign(wallet *Wallet) int {
+	signed := 0
+	key := hex.EncodeToString(wallet.PublicKey)
+	for inID := range pt.Inputs {
+		in := &pt.Inputs[inID]
+		if _, ok := in.Signatures[key]; ok || !canSign(in.signScript(), wallet.PublicKey) {
+			continue
+		}
+		in.Signatures[key] = pt.Tx.SignInput(inID, wallet.PrivateKey, in.signScript())
+		signed++
+	}
+	return signed
+}
+
+// 公钥能否为锁定脚本提供签名
+func canSign(script, pubKey []byte) bool {
+	if bytes.Equal(extractPubKeyHash(script), HashPubKey(pubKey)) {
+		return true
+	}
+	_, pubKeys, _ := extractMultisig(script)
+	for _, k := range pubKeys {
+		if bytes.Equal(k, pubKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// 合并另一个钱包签名的同一笔交易
+func (pt *PartialTransaction) Combine(other *PartialTransaction) error {
+	if !bytes.Equal(pt.Tx.ID, other.Tx.ID) || len(pt.Inputs) != len(other.Inputs) {
+		return fmt.Errorf("%w: %x and %x", ErrPartialMismatch, pt.Tx.ID, other.Tx.ID)
+	}
+	for i, in := range other.Inputs {
+		if pt.Inputs[i].RedeemScript == nil {
+			pt.Inputs[i].RedeemScript = in.RedeemScript
+		}
+		for key, sig := range in.Signatures {
+			pt.Inputs[i].Signatures[key] = sig
+		}
+	}
+	return nil
+}
+
+// 用收集到的签名生成每个输入的解锁脚本，返回可以广播的交易
+// 多重签名按公钥的顺序取前m个签名，P2SH 输出在最后加上赎回脚本
+func (pt *PartialTransaction) Finalize() (*Transaction, error) {
+	tx := pt.Tx
+	tx.Vin = append([]TXInput{}, pt.Tx.Vin...)
+	for inID, in := range pt.Inputs {
+		script := in.signScript()
+		if script == nil {
+			return nil, fmt.Errorf("%w: input %d", ErrNoRedeemScript, inID)
+		}
+		if m, pubKeys, ok := extractMultisig(script); ok {
+			var sigs [][]byte
+			for _, pubKey := range pubKeys {
+				if sig, ok := in.Signatures[hex.EncodeToString(pubKey)]; ok && len(sigs) < m {
+					sigs = append(sigs, sig)
+				}
+			}
+			if len(sigs) < m {
+				return nil, fmt.Errorf("%w: input %d has %d of %d", ErrNotEnoughSigs, inID, len(sigs), m)
+			}
+			tx.Vin[inID].ScriptSig = MultisigScriptSig(sigs)
+		} else if pubKeyHash := extractPubKeyHash(script); pubKeyHash != nil {
+			for key, sig := range in.Signatures {
+				pubKey, _ := hex.DecodeString(key)
+				if bytes.Equal(HashPubKey(pubKey), pubKeyHash) {
+					tx.Vin[inID].ScriptSig = P2PKHScriptSig(sig, pubKey)
+				}
+			}
+			if tx.Vin[inID].ScriptSig == nil {
+				return nil, fmt.Errorf("%w: input %d is not signed", ErrNotEnoughSigs, inID)
+			}
+		} else {
+			return nil, fmt.Errorf("%w: input %d", ErrUnknownLockScript, inID)
+		}
+		if in.RedeemScript != nil {
+			tx.Vin[inID].ScriptSig = append(tx.Vin[inID].ScriptSig, NewScriptBuilder().AddData(in.RedeemScript).Script()...)
+		}
+		if err := VerifyScript(tx.Vin[inID].ScriptSig, in.PrevOut.ScriptPubKey, &tx, inID); err != nil {
+			return nil, fmt.Errorf("input %d: %w", inID, err)
+		}
+	}
+	return &tx, nil
+}
+
+func (pt *PartialTransaction) Serialize() []byte {
+	var buff bytes.Buffer
+	enc := gob.NewEncoder(&buff)
+	err := enc.Encode(pt)
+	if err != nil {
+		log.Panic(err)
+	}
+	return buff.Bytes()
+}
+
+func DeserializePartialTransaction(data []byte) *PartialTransaction {
+	var pt PartialTransaction
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	err := dec.Decode(&pt)
+	if err != nil {
+		log.Panic(err)
+	}
+	//gob 不会创建空的 map
+	for i := range pt.Inputs {
+		if pt.Inputs[i].Signatures == nil {
+			pt.Inputs[i].Signatures = make(map[string][]byte)
+		}
+	}
+	return &pt
+}
@@ -0,0 +1,652 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// 脚本操作码，编码与比特币相同
+// 1-75 表示把接下来的 n 个字节压入栈中
+const (
+	OP_0         = 0x00
+	OP_FALSE     = OP_0
+	OP_PUSHDATA1 = 0x4c
+	OP_PUSHDATA2 = 0x4d
+	OP_1         = 0x51
+	OP_TRUE      = OP_1
+	OP_16        = 0x60
+
+	OP_IF     = 0x63
+	OP_NOTIF  = 0x64
+	OP_ELSE   = 0x67
+	OP_ENDIF  = 0x68
+	OP_VERIFY = 0x69
+	OP_RETURN = 0x6a
+
+	OP_DROP = 0x75
+	OP_DUP  = 0x76
+
+	OP_EQUAL       = 0x87
+	OP_EQUALVERIFY = 0x88
+
+	OP_SHA256              = 0xa8
+	OP_HASH160             = 0xa9
+	OP_CHECKSIG            = 0xac
+	OP_CHECKSIGVERIFY      = 0xad
+	OP_CHECKMULTISIG       = 0xae
+	OP_CHECKMULTISIGVERIFY = 0xaf
+
+	OP_CHECKLOCKTIMEVERIFY = 0xb1
+)
+
+// 脚本的大小限制
+const (
+	maxScriptSize        = 10000
+	maxScriptElementSize = 520
+	maxStackSize         = 1000
+	maxOpsPerScript      = 201
+	//多重签名最多的公钥个数
+	maxPubKeysPerMultisig = 16
+)
+
+// 脚本执行失败的原因
+var (
+	ErrMalformedScript = errors.New("malformed script")
+	ErrScriptTooLarge  = errors.New("script too large")
+	ErrBadOpcode       = errors.New("bad opcode")
+	ErrStackUnderflow  = errors.New("stack underflow")
+	ErrStackOverflow   = errors.New("stack overflow")
+	ErrVerifyFailed    = errors.New("verify failed")
+	ErrEarlyReturn     = errors.New("OP_RETURN executed")
+	ErrScriptSigPush   = errors.New("scriptSig is not push-only")
+	ErrScriptFalse     = errors.New("script evaluated to false")
+	ErrUnbalancedIf    = errors.New("unbalanced conditional")
+	ErrLockTime        = errors.New("lock time requirement not satisfied")
+)
+
+// 解析后的一条指令，Data 为压栈的数据
+type scriptOp struct {
+	Op   byte
+	Data []byte
+}
+
+// 把脚本解析成指令序列
+func parseScript(script []byte) ([]scriptOp, error) {
+	if len(script) > maxScriptSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrScriptTooLarge, len(script))
+	}
+	var ops []scriptOp
+	for i := 0; i < len(script); {
+		op := script[i]
+		i++
+		n := 0
+		switch {
+		case op > OP_0 && op < OP_PUSHDATA1:
+			n = int(op)
+		case op == OP_PUSHDATA1:
+			if i+1 > len(script) {
+				return nil, fmt.Errorf("%w: truncated OP_PUSHDATA1", ErrMalformedScript)
+			}
+			n = int(script[i])
+			i++
+		case op == OP_PUSHDATA2:
+			if i+2 > len(script) {
+				return nil, fmt.Errorf("%w: truncated OP_PUSHDATA2", ErrMalformedScript)
+			}
+			n = int(binary.LittleEndian.Uint16(script[i:]))
+			i += 2
+		}
+		if i+n > len(script) {
+			return nil, fmt.Errorf("%w: push of %d bytes past the end", ErrMalformedScript, n)
+		}
+		var data []byte
+		if n > 0 {
+			data = script[i : i+n]
+		}
+		ops = append(ops, scriptOp{op, data})
+		i += n
+	}
+	return ops, nil
+}
+
+// 是否为压栈指令(包括 OP_0 和 OP_1 到 OP_16)
+func (op scriptOp) isPush() bool {
+	return op.Op <= OP_PUSHDATA2 || (op.Op >= OP_1 && op.Op <= OP_16)
+}
+
+// 脚本构造器，按顺序添加操作码和数据
+type ScriptBuilder struct {
+	script []byte
+}
+
+func NewScriptBuilder() *ScriptBuilder {
+	return &ScriptBuilder{}
+}
+
+func (b *ScriptBuilder) AddOp(op byte) *ScriptBuilder {
+	b.script = append(b.script, op)
+	return b
+}
+
+// 用最短的方式压入数据
+func (b *ScriptBuilder) AddData(data []byte) *ScriptBuilder {
+	switch n := len(data); {
+	case n == 0:
+		b.script = append(b.script, OP_0)
+	case n < OP_PUSHDATA1:
+		b.script = append(b.script, byte(n))
+	case n <= 0xff:
+		b.script = append(b.script, OP_PUSHDATA1, byte(n))
+	default:
+		b.script = append(b.script, OP_PUSHDATA2, byte(n), byte(n>>8))
+	}
+	b.script = append(b.script, data...)
+	return b
+}
+
+// 压入整数，0 到 16 使用 OP_0 到 OP_16
+func (b *ScriptBuilder) AddInt(n int64) *ScriptBuilder {
+	switch {
+	case n == 0:
+		return b.AddOp(OP_0)
+	case n >= 1 && n <= 16:
+		return b.AddOp(byte(OP_1 + n - 1))
+	}
+	return b.AddData(encodeScriptNum(n))
+}
+
+func (b *ScriptBuilder) Script() []byte {
+	return b.script
+}
+
+// 支付到公钥哈希的锁定脚本：OP_DUP OP_HASH160 <pubKeyHash> OP_EQUALVERIFY OP_CHECKSIG
+func P2PKHScript(pubKeyHash []byte) []byte {
+	return NewScriptBuilder().AddOp(OP_DUP).AddOp(OP_HASH160).AddData(pubKeyHash).
+		AddOp(OP_EQUALVERIFY).AddOp(OP_CHECKSIG).Script()
+}
+
+// 花费支付到公钥哈希的输出的解锁脚本：<signature> <pubKey>
+func P2PKHScriptSig(signature, pubKey []byte) []byte {
+	return NewScriptBuilder().AddData(signature).AddData(pubKey).Script()
+}
+
+// M-of-N 多重签名的锁定脚本：OP_m <pubKey1> ... <pubKeyN> OP_n OP_CHECKMULTISIG
+// 花费时需要按公钥的顺序提供其中m个公钥的签名
+func MultisigScript(m int, pubKeys [][]byte) ([]byte, error) {
+	n := len(pubKeys)
+	if n == 0 || n > maxPubKeysPerMultisig || m < 1 || m > n {
+		return nil, fmt.Errorf("invalid %d-of-%d multisig", m, n)
+	}
+	b := NewScriptBuilder().AddInt(int64(m))
+	for _, pubKey := range pubKeys {
+		b.AddData(pubKey)
+	}
+	return b.AddInt(int64(n)).AddOp(OP_CHECKMULTISIG).Script(), nil
+}
+
+// 花费多重签名输出的解锁脚本：<signature1> ... <signatureM>
+func MultisigScriptSig(signatures [][]byte) []byte {
+	b := NewScriptBuilder()
+	for _, sig := range signatures {
+		b.AddData(sig)
+	}
+	return b.Script()
+}
+
+// 锁定脚本是多重签名时返回需要的签名数和公钥
+func extractMultisig(script []byte) (int, [][]byte, bool) {
+	ops, err := parseScript(script)
+	if err != nil || len(ops) < 4 || ops[len(ops)-1].Op != OP_CHECKMULTISIG {
+		return 0, nil, false
+	}
+	m, n := smallInt(ops[0].Op), smallInt(ops[len(ops)-2].Op)
+	keys := ops[1 : len(ops)-2]
+	if m < 1 || n != len(keys) || m > n {
+		return 0, nil, false
+	}
+	var pubKeys [][]byte
+	for _, op := range keys {
+		if len(op.Data) == 0 {
+			return 0, nil, false
+		}
+		pubKeys = append(pubKeys, op.Data)
+	}
+	return m, pubKeys, true
+}
+
+// OP_1 到 OP_16 表示的整数，其他操作码返回 -1
+func smallInt(op byte) int {
+	if op < OP_1 || op > OP_16 {
+		return -1
+	}
+	return int(op-OP_1) + 1
+}
+
+// 支付到脚本哈希的锁定脚本：OP_HASH160 <scriptHash> OP_EQUAL
+// 花费时解锁脚本的最后一个数据为赎回脚本，哈希匹配后用其余的数据执行赎回脚本
+func P2SHScript(scriptHash []byte) []byte {
+	return NewScriptBuilder().AddOp(OP_HASH160).AddData(scriptHash).AddOp(OP_EQUAL).Script()
+}
+
+// 锁定脚本是支付到脚本哈希时返回脚本哈希，否则返回 nil
+func extractScriptHash(script []byte) []byte {
+	if len(script) != 23 || script[0] != OP_HASH160 || script[1] != 20 || script[22] != OP_EQUAL {
+		return nil
+	}
+	return script[2:22]
+}
+
+// 锁定脚本是支付到公钥哈希时返回公钥哈希，否则返回 nil
+func extractPubKeyHash(script []byte) []byte {
+	ops, err := parseScript(script)
+	if err != nil || len(ops) != 5 {
+		return nil
+	}
+	if ops[0].Op != OP_DUP || ops[1].Op != OP_HASH160 || len(ops[2].Data) != 20 ||
+		ops[3].Op != OP_EQUALVERIFY || ops[4].Op != OP_CHECKSIG {
+		return nil
+	}
+	return ops[2].Data
+}
+
+// 脚本中压栈的所有数据，无法解析的脚本返回 nil
+func scriptPushes(script []byte) [][]byte {
+	ops, err := parseScript(script)
+	if err != nil {
+		return nil
+	}
+	var pushes [][]byte
+	for _, op := range ops {
+		if len(op.Data) > 0 {
+			pushes = append(pushes, op.Data)
+		}
+	}
+	return pushes
+}
+
+// 栈元素作为布尔值：全为0(或者只有最后一个字节为符号位 0x80)时为 false
+func castToBool(v []byte) bool {
+	for i, b := range v {
+		if b != 0 {
+			return !(i == len(v)-1 && b == 0x80)
+		}
+	}
+	return false
+}
+
+// 脚本中的整数：小端序，最高字节的最高位为符号位，0 编码为空数组
+func encodeScriptNum(n int64) []byte {
+	if n == 0 {
+		return nil
+	}
+	neg := n < 0
+	if neg {
+		n = -n
+	}
+	var v []byte
+	for n > 0 {
+		v = append(v, byte(n))
+		n >>= 8
+	}
+	//最高位已经被占用时增加一个字节存放符号位
+	if v[len(v)-1]&0x80 != 0 {
+		if neg {
+			v = append(v, 0x80)
+		} else {
+			v = append(v, 0)
+		}
+	} else if neg {
+		v[len(v)-1] |= 0x80
+	}
+	return v
+}
+
+// 解码栈中的整数，超过maxLen个字节时出错
+func decodeScriptNum(v []byte, maxLen int) (int64, error) {
+	if len(v) > maxLen {
+		return 0, fmt.Errorf("%w: number of %d bytes", ErrMalformedScript, len(v))
+	}
+	if len(v) == 0 {
+		return 0, nil
+	}
+	var n int64
+	for i, b := range v {
+		n |= int64(b) << uint(8*i)
+	}
+	if v[len(v)-1]&0x80 != 0 {
+		n &^= int64(0x80) << uint(8*(len(v)-1))
+		return -n, nil
+	}
+	return n, nil
+}
+
+// 执行脚本的栈机，tx 和 inID 为正在验证的交易输入，用于检查签名
+type scriptEngine struct {
+	tx    *Transaction
+	inID  int
+	stack [][]byte
+	//当前正在执行的脚本，签名覆盖它而不是解锁脚本
+	script []byte
+	//嵌套的 OP_IF 分支是否执行
+	cond []bool
+}
+
+func (e *scriptEngine) push(v []byte) error {
+	if len(v) > maxScriptElementSize {
+		return fmt.Errorf("%w: element of %d bytes", ErrScriptTooLarge, len(v))
+	}
+	if len(e.stack) >= maxStackSize {
+		return ErrStackOverflow
+	}
+	e.stack = append(e.stack, v)
+	return nil
+}
+
+func (e *scriptEngine) pop() ([]byte, error) {
+	if len(e.stack) == 0 {
+		return nil, ErrStackUnderflow
+	}
+	v := e.stack[len(e.stack)-1]
+	e.stack = e.stack[:len(e.stack)-1]
+	return v, nil
+}
+
+// 弹出一个4字节以内的整数
+func (e *scriptEngine) popInt() (int64, error) {
+	v, err := e.pop()
+	if err != nil {
+		return 0, err
+	}
+	return decodeScriptNum(v, 4)
+}
+
+func (e *scriptEngine) pushBool(b bool) error {
+	if b {
+		return e.push([]byte{1})
+	}
+	return e.push(nil)
+}
+
+// 执行一段脚本
+func (e *scriptEngine) execute(script []byte) error {
+	ops, err := parseScript(script)
+	if err != nil {
+		return err
+	}
+	e.script = script
+	e.cond = nil
+	count := 0
+	for _, op := range ops {
+		if op.Op > OP_16 {
+			count++
+			if count > maxOpsPerScript {
+				return fmt.Errorf("%w: more than %d operations", ErrScriptTooLarge, maxOpsPerScript)
+			}
+		}
+		//不执行的分支中只处理条件指令，用来找到对应的 OP_ELSE 和 OP_ENDIF
+		if !e.executing() && (op.Op < OP_IF || op.Op > OP_ENDIF) {
+			continue
+		}
+		if err := e.step(op); err != nil {
+			return err
+		}
+	}
+	if len(e.cond) != 0 {
+		return fmt.Errorf("%w: missing OP_ENDIF", ErrUnbalancedIf)
+	}
+	return nil
+}
+
+// 当前所在的所有分支都执行时为真
+func (e *scriptEngine) executing() bool {
+	for _, c := range e.cond {
+		if !c {
+			return false
+		}
+	}
+	return true
+}
+
+// 执行一条指令
+func (e *scriptEngine) step(op scriptOp) error {
+	switch {
+	case op.Op <= OP_PUSHDATA2:
+		return e.push(op.Data)
+	case op.Op >= OP_1 && op.Op <= OP_16:
+		return e.push([]byte{op.Op - OP_1 + 1})
+	}
+
+	switch op.Op {
+	case OP_IF, OP_NOTIF:
+		//不执行的分支中不弹出条件，嵌套的分支也都不执行
+		branch := false
+		if e.executing() {
+			v, err := e.pop()
+			if err != nil {
+				return err
+			}
+			branch = castToBool(v) == (op.Op == OP_IF)
+		}
+		e.cond = append(e.cond, branch)
+	case OP_ELSE:
+		if len(e.cond) == 0 {
+			return fmt.Errorf("%w: OP_ELSE without OP_IF", ErrUnbalancedIf)
+		}
+		e.cond[len(e.cond)-1] = !e.cond[len(e.cond)-1]
+	case OP_ENDIF:
+		if len(e.cond) == 0 {
+			return fmt.Errorf("%w: OP_ENDIF without OP_IF", ErrUnbalancedIf)
+		}
+		e.cond = e.cond[:len(e.cond)-1]
+	case OP_VERIFY:
+		v, err := e.pop()
+		if err != nil {
+			return err
+		}
+		if !castToBool(v) {
+			return ErrVerifyFailed
+		}
+	case OP_RETURN:
+		return ErrEarlyReturn
+	case OP_DROP:
+		_, err := e.pop()
+		return err
+	case OP_DUP:
+		v, err := e.pop()
+		if err != nil {
+			return err
+		}
+		e.push(v)
+		return e.push(v)
+	case OP_EQUAL, OP_EQUALVERIFY:
+		a, err := e.pop()
+		if err != nil {
+			return err
+		}
+		b, err := e.pop()
+		if err != nil {
+			return err
+		}
+		if op.Op == OP_EQUALVERIFY {
+			if !bytes.Equal(a, b) {
+				return fmt.Errorf("%w: OP_EQUALVERIFY", ErrVerifyFailed)
+			}
+			return nil
+		}
+		return e.pushBool(bytes.Equal(a, b))
+	case OP_SHA256:
+		v, err := e.pop()
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(v)
+		return e.push(sum[:])
+	case OP_HASH160:
+		v, err := e.pop()
+		if err != nil {
+			return err
+		}
+		return e.push(HashPubKey(v))
+	case OP_CHECKSIG, OP_CHECKSIGVERIFY:
+		pubKey, err := e.pop()
+		if err != nil {
+			return err
+		}
+		sig, err := e.pop()
+		if err != nil {
+			return err
+		}
+		ok := e.checkSig(sig, pubKey)
+		if op.Op == OP_CHECKSIGVERIFY {
+			if !ok {
+				return fmt.Errorf("%w: OP_CHECKSIGVERIFY", ErrVerifyFailed)
+			}
+			return nil
+		}
+		return e.pushBool(ok)
+	case OP_CHECKMULTISIG, OP_CHECKMULTISIGVERIFY:
+		ok, err := e.checkMultisig()
+		if err != nil {
+			return err
+		}
+		if op.Op == OP_CHECKMULTISIGVERIFY {
+			if !ok {
+				return fmt.Errorf("%w: OP_CHECKMULTISIGVERIFY", ErrVerifyFailed)
+			}
+			return nil
+		}
+		return e.pushBool(ok)
+	case OP_CHECKLOCKTIMEVERIFY:
+		//不弹出栈顶的锁定时间，之后通常跟着 OP_DROP
+		if len(e.stack) == 0 {
+			return ErrStackUnderflow
+		}
+		lockTime, err := decodeScriptNum(e.stack[len(e.stack)-1], 5)
+		if err != nil {
+			return err
+		}
+		return e.checkLockTime(lockTime)
+	default:
+		return fmt.Errorf("%w: 0x%02x", ErrBadOpcode, op.Op)
+	}
+	return nil
+}
+
+// 用公钥验证签名，签名的数据为交易对当前脚本的签名哈希
+func (e *scriptEngine) checkSig(sig, pubKey []byte) bool {
+	if len(sig) == 0 || len(sig)%2 != 0 || len(pubKey) == 0 || len(pubKey)%2 != 0 {
+		return false
+	}
+	r := new(big.Int).SetBytes(sig[:len(sig)/2])
+	s := new(big.Int).SetBytes(sig[len(sig)/2:])
+	x := new(big.Int).SetBytes(pubKey[:len(pubKey)/2])
+	y := new(big.Int).SetBytes(pubKey[len(pubKey)/2:])
+	rawPubKey := ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+	return ecdsa.Verify(&rawPubKey, e.tx.SigHash(e.inID, e.script), r, s)
+}
+
+// 交易的锁定时间必须与lockTime的类型相同(都是高度或者都是时间)并且不小于lockTime
+// 输入的序列号不能为 sequenceFinal，否则交易的锁定时间不生效
+func (e *scriptEngine) checkLockTime(lockTime int64) error {
+	txLockTime := e.tx.LockTime
+	switch {
+	case lockTime < 0:
+		return fmt.Errorf("%w: negative lock time %d", ErrLockTime, lockTime)
+	case (lockTime < lockTimeThreshold) != (txLockTime < lockTimeThreshold):
+		return fmt.Errorf("%w: lock time %d and transaction lock time %d have different types", ErrLockTime, lockTime, txLockTime)
+	case lockTime > txLockTime:
+		return fmt.Errorf("%w: transaction lock time %d is before %d", ErrLockTime, txLockTime, lockTime)
+	case e.tx.Vin[e.inID].Sequence == sequenceFinal:
+		return fmt.Errorf("%w: input sequence is final", ErrLockTime)
+	}
+	return nil
+}
+
+// 栈顶依次为公钥个数n、n个公钥、签名个数m、m个签名
+// 签名必须按公钥的顺序排列，每个公钥最多匹配一个签名
+func (e *scriptEngine) checkMultisig() (bool, error) {
+	n, err := e.popInt()
+	if err != nil {
+		return false, err
+	}
+	if n < 0 || n > maxPubKeysPerMultisig {
+		return false, fmt.Errorf("%w: %d public keys", ErrMalformedScript, n)
+	}
+	pubKeys := make([][]byte, n)
+	for i := n - 1; i >= 0; i-- {
+		if pubKeys[i], err = e.pop(); err != nil {
+			return false, err
+		}
+	}
+	m, err := e.popInt()
+	if err != nil {
+		return false, err
+	}
+	if m < 0 || m > n {
+		return false, fmt.Errorf("%w: %d signatures for %d keys", ErrMalformedScript, m, n)
+	}
+	sigs := make([][]byte, m)
+	for i := m - 1; i >= 0; i-- {
+		if sigs[i], err = e.pop(); err != nil {
+			return false, err
+		}
+	}
+	k := 0
+	for _, sig := range sigs {
+		for k < len(pubKeys) && !e.checkSig(sig, pubKeys[k]) {
+			k++
+		}
+		if k == len(pubKeys) {
+			return false, nil
+		}
+		k++
+	}
+	return true, nil
+}
+
+// 验证交易的第inID个输入：先执行解锁脚本，再用得到的栈执行锁定脚本，栈顶为真时通过
+func VerifyScript(scriptSig, scriptPubKey []byte, tx *Transaction, inID int) error {
+	ops, err := parseScript(scriptSig)
+	if err != nil {
+		return err
+	}
+	for _, op := range ops {
+		if !op.isPush() {
+			return ErrScriptSigPush
+		}
+	}
+	e := &scriptEngine{tx: tx, inID: inID}
+	if err := e.execute(scriptSig); err != nil {
+		return err
+	}
+	sigStack := append([][]byte{}, e.stack...)
+	if err := e.execute(scriptPubKey); err != nil {
+		return err
+	}
+	if len(e.stack) == 0 || !castToBool(e.stack[len(e.stack)-1]) {
+		return ErrScriptFalse
+	}
+	if extractScriptHash(scriptPubKey) == nil {
+		return nil
+	}
+
+	//P2SH：锁定脚本只检查了赎回脚本的哈希，还要用解锁脚本的其余数据执行赎回脚本
+	e.stack = sigStack
+	redeemScript, err := e.pop()
+	if err != nil {
+		return err
+	}
+	if err := e.execute(redeemScript); err != nil {
+		return fmt.Errorf("redeem script: %w", err)
+	}
+	if len(e.stack) == 0 || !castToBool(e.stack[len(e.stack)-1]) {
+		return fmt.Errorf("redeem script: %w", ErrScriptFalse)
+	}
+	return nil
+}
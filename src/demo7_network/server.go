@@ -3,45 +3,80 @@ package main
 import (
 	"bytes"
 	"encoding/gob"
-	"encoding/hex"
+	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
 	"net"
+	"sync"
+	"time"
 )
 
 const protocol = "tcp"
 
-//节点版本
-const nodeVersion = 1
-
-//前12字节指定了命令名
+//消息头中命令名的长度
 const commandLength = 12
 
-var nodeAddress string
-
-//挖矿奖励地址
-var miningAddress string
-
-//中心节点
-var knownNodes = []string{"localhost:3000"}
-
-//跟踪已下载的块
-var blocksInTransit = [][]byte{}
-
-//内存池
-var mempool = make(map[string]Transaction)
+//连接其他节点的超时时间
+const dialTimeout = 5 * time.Second
+
+//默认的种子节点，命令行发送交易时也默认发给它
+const defaultSeed = "localhost:3000"
+
+//一个网络节点，拥有自己的区块链、内存池、已知节点列表和到其他节点的长连接
+//每个连接有自己的读写 goroutine，Blockchain 不是并发安全的，所以消息处理由 chainMu 串行化
+type Node struct {
+	Address string
+	//挖矿组件，不挖矿时为 nil
+	miner *Miner
+	//轻节点模式下的钱包，全节点为 nil
+	spv *spvWallet
+	//节点提供的服务和握手时用来发现自连接的随机数
+	services uint64
+	nonce    uint64
+	bc       *Blockchain
+	mempool  *Mempool
+	listener net.Listener
+
+	//区块下载管理器
+	downloader *blockDownloader
+	//等待 blocktxn 补全的紧凑区块，键为区块哈希，由 chainMu 保护
+	partialBlocks map[string]*partialBlock
+
+	//mu 保护已知节点、被封禁的节点、正在建立的连接和连接
+	mu      sync.Mutex
+	addrs   map[string]peerAddress
+	banned  map[string]banEntry
+	dialing map[string]bool
+	peers   map[*Peer]bool
+
+	chainMu sync.Mutex
+	quit    chan struct{}
+	wg      sync.WaitGroup
+}
 
-//由于我们仅有一个区块链版本，所以 Version 字段实际并不会存储什么重要信息,BestHeight 存储区块链中节点的高度,AddFrom 存储发送者的地址。
+//握手时发送的第一条消息：Version 是协议版本,BestHeight 存储区块链中节点的高度,AddFrom 存储发送者的地址。
+//Services 为节点提供的服务，Nonce 用来发现连接到了自己
 type version struct {
 	Version    int
 	BestHeight int
 	AddrFrom   string
+	Services   uint64
+	UserAgent  string
+	Timestamp  int64
+	Nonce      uint64
 }
 
-type getblocks struct {
+//请求区块头：Locator 是请求方的区块定位器，StopHash 为空时返回尽可能多的区块头
+type getheaders struct {
 	AddrFrom string
+	Locator  [][]byte
+	StopHash []byte
+}
+
+//区块头列表，按高度从低到高排列，每个元素是序列化的 BlockHeader
+type headers struct {
+	AddrFrom string
+	Headers  [][]byte
 }
 
 //比特币使用 inv 来向其他节点展示当前节点有什么块和交易 它没有包含完整的区块链和交易，仅仅是哈希而已
@@ -58,6 +93,13 @@ type getdata struct {
 	ID       []byte
 }
 
+//回复 getdata：请求的区块或交易不存在
+type notfound struct {
+	AddrFrom string
+	Type     string
+	ID       []byte
+}
+
 type block struct {
 	AddrFrom string
 	Block    []byte
@@ -68,399 +110,618 @@ type tx struct {
 	Transaction []byte
 }
 
-type addr struct {
-	AddrList []string
+//开启一个服务器，在后台接受连接并返回节点
+//seeds 为启动时首先连接的种子节点，之后通过地址传播发现更多节点
+func StartServer(nodeID, minerAddress string, seeds []string) *Node {
+	return startNode(nodeID, minerAddress, seeds, nil)
 }
 
-//开启一个服务器
-func StartServer(nodeId, minerAddress string) {
-	nodeAddress = fmt.Sprintf("localhost:%s", nodeId)
-	miningAddress = minerAddress
-	ln, err := net.Listen(protocol, nodeAddress)
+// spvKeys 不为 nil 时以轻节点模式启动，跟踪这些公钥的余额
+func startNode(nodeID, minerAddress string, seeds []string, spvKeys [][]byte) *Node {
+	n := &Node{
+		Address:       fmt.Sprintf("localhost:%s", nodeID),
+		services:      SFNodeFull,
+		nonce:         randomNonce(),
+		addrs:         make(map[string]peerAddress),
+		banned:        make(map[string]banEntry),
+		dialing:       make(map[string]bool),
+		peers:         make(map[*Peer]bool),
+		partialBlocks: make(map[string]*partialBlock),
+		quit:          make(chan struct{}),
+	}
+	n.downloader = newBlockDownloader(n)
+	if spvKeys != nil {
+		n.services = SFNodeWallet
+	} else if minerAddress != "" {
+		n.services |= SFNodeMiner
+		n.miner = newMiner(n, minerAddress)
+	}
+	ln, err := net.Listen(protocol, n.Address)
 	if err != nil {
 		log.Panicln(err)
 	}
-	defer ln.Close()
-	bc := PositioningBlockchain(nodeId)
+	n.listener = ln
+	n.bc = PositioningBlockchain(nodeID)
+	n.mempool = NewMempool(n.bc)
+	if spvKeys != nil {
+		n.spv = newSPVWallet(n, spvKeys)
+	}
+	n.loadAddresses()
+	n.loadBans()
 
-	//这意味着如果当前节点不是中心节点，它必须向中心节点发送 version 消息来查询是否自己的区块链已过时
-	if nodeAddress != knownNodes[0] {
-		sendVersion(knownNodes[0], bc)
+	//先连接种子节点，再连接上次运行时保存的节点，握手后会检查自己的区块链是否已过时
+	for _, seed := range seeds {
+		if seed != n.Address && n.peerByAddr(seed) != nil {
+			n.addAddress(peerAddress{seed, SFNodeFull, 0})
+		}
+	}
+	n.connectMore()
+	n.wg.Add(2)
+	go n.serve()
+	go n.downloader.run()
+	if n.miner != nil {
+		n.wg.Add(1)
+		go n.miner.run()
+		//启动时内存池中可能已经有交易
+		n.miner.Notify()
 	}
+	return n
+}
+
+func (n *Node) serve() {
+	defer n.wg.Done()
 	for {
-		conn, err := ln.Accept()
+		conn, err := n.listener.Accept()
 		if err != nil {
-			log.Panic(err)
+			select {
+			case <-n.quit:
+				return
+			default:
+				log.Panic(err)
+			}
 		}
-		go handleConnection(conn, bc)
+		n.handleConnection(conn)
+	}
+}
 
+// 停止接受连接，断开所有连接，等待正在处理的消息完成后关闭数据库
+func (n *Node) Stop() {
+	close(n.quit)
+	n.listener.Close()
+	for _, p := range n.Peers() {
+		p.Close()
 	}
+	n.wg.Wait()
+	n.bc.db.Close()
 }
 
-func gobEncode(data interface{}) []byte {
-	var buff bytes.Buffer
-	enc := gob.NewEncoder(&buff)
-	enc.Encode(data)
-	return buff.Bytes()
+// 等待节点停止
+func (n *Node) Wait() {
+	<-n.quit
+	n.wg.Wait()
+}
 
+// 节点的区块链高度
+func (n *Node) BestHeight() int {
+	n.chainMu.Lock()
+	defer n.chainMu.Unlock()
+	return n.bc.GetBestHeight()
 }
 
-func commandToBytes(command string) []byte {
-	var bytes [commandLength]byte
-	for i, c := range command {
-		bytes[i] = byte(c)
+// 节点内存池中的交易数量
+func (n *Node) MempoolCount() int {
+	return n.mempool.Count()
+}
+
+// 返回当前所有连接
+func (n *Node) Peers() []*Peer {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var peers []*Peer
+	for p := range n.peers {
+		peers = append(peers, p)
 	}
-	return bytes[:]
+	return peers
 }
 
-func bytesToCommand(bytes []byte) string {
-	var command []byte
-	for _, b := range bytes {
-		if b != 0x0 {
-			command = append(command, b)
-		}
+// 添加连接，节点正在停止时返回 false，Stop 断开连接之后不会再有新的连接
+func (n *Node) addPeer(p *Peer) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	select {
+	case <-n.quit:
+		return false
+	default:
 	}
-	return fmt.Sprintf("%s", command)
+	n.peers[p] = true
+	return true
 }
-func extractCommand(request []byte) []byte {
-	return request[:commandLength]
+
+func (n *Node) removePeer(p *Peer) {
+	n.mu.Lock()
+	delete(n.peers, p)
+	n.mu.Unlock()
+	n.downloader.removePeer(p)
 }
-func requestBlocks() {
-	for _, node := range knownNodes {
-		sendGetBlocks(node)
+
+// 返回到addr的连接，还没有连接时建立一个并发送 version 开始握手
+// 连接不上的节点从已知节点列表中移除，被封禁的节点不会连接，返回 nil
+// 建立连接可能要等待 dialTimeout，调用者不能持有 chainMu；同一个地址同时只建立一个连接，正在建立时返回 nil
+func (n *Node) peerByAddr(addr string) *Peer {
+	n.mu.Lock()
+	if n.dialing[addr] {
+		n.mu.Unlock()
+		return nil
 	}
-}
-func nodeIsKnown(addr string) bool {
-	for _, node := range knownNodes {
-		if node == addr {
-			return true
+	n.dialing[addr] = true
+	n.mu.Unlock()
+	defer func() {
+		n.mu.Lock()
+		delete(n.dialing, addr)
+		n.mu.Unlock()
+	}()
+
+	//在占用 dialing 之后检查，之前完成的连接一定已经加入 peers
+	for _, p := range n.Peers() {
+		if p.Addr() == addr {
+			return p
 		}
 	}
-	return false
+	if n.isBanned(addr) {
+		return nil
+	}
+	conn, err := net.DialTimeout(protocol, addr, dialTimeout)
+	if err != nil {
+		fmt.Printf("%s is not available\n", addr)
+		n.removeKnownNode(addr)
+		return nil
+	}
+	//addr 可能是主机名，连接后按实际的IP检查封禁
+	if n.isBanned(conn.RemoteAddr().String()) {
+		conn.Close()
+		return nil
+	}
+	p := newPeer(n, conn, addr, false)
+	if !n.addPeer(p) {
+		conn.Close()
+		return nil
+	}
+	p.start()
+	//这里不持有 chainMu，通过 BestHeight 读取高度
+	n.sendVersion(p, n.BestHeight())
+	return p
 }
 
-func sendAddr(address string) {
-	nodes := addr{knownNodes}
-	nodes.AddrList = append(nodes.AddrList, nodeAddress)
-	payload := gobEncode(nodes)
-	request := append(commandToBytes("addr"), payload...)
+func gobEncode(data interface{}) []byte {
+	var buff bytes.Buffer
+	enc := gob.NewEncoder(&buff)
+	enc.Encode(data)
+	return buff.Bytes()
 
-	sendData(address, request)
 }
 
-func sendBlock(addr string, b *Block) {
-	data := block{nodeAddress, b.Serialize()}
-	payload := gobEncode(data)
-	request := append(commandToBytes("block"), payload...)
-
-	sendData(addr, request)
+func (n *Node) sendBlock(p *Peer, b *Block) {
+	p.Send("block", block{n.Address, b.Serialize()})
 }
 
-func sendData(addr string, data []byte) {
-	conn, err := net.Dial(protocol, addr)
+// 不经过节点直接向addr发送一条消息后断开，用于命令行发送交易
+// 以只有钱包功能的身份完成握手后再发送消息
+func sendMessage(addr, command string, payload interface{}) error {
+	conn, err := net.DialTimeout(protocol, addr, dialTimeout)
 	if err != nil {
-		fmt.Printf("%s is not available\n", addr)
-		var updatedNodes []string
-
-		for _, node := range knownNodes {
-			if node != addr {
-				updatedNodes = append(updatedNodes, node)
-			}
-		}
-
-		knownNodes = updatedNodes
-
-		return
+		return err
 	}
 	defer conn.Close()
-
-	_, err = io.Copy(conn, bytes.NewReader(data))
-	if err != nil {
-		log.Panic(err)
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := clientHandshake(conn); err != nil {
+		return err
 	}
+	return writeMessage(conn, &message{command, gobEncode(payload)})
 }
 
-func sendInv(address, kind string, items [][]byte) {
-	inventory := inv{nodeAddress, kind, items}
-	payload := gobEncode(inventory)
-	request := append(commandToBytes("inv"), payload...)
-
-	sendData(address, request)
+// 向已知节点addr发送消息，连接不上时什么也不做
+func (n *Node) send(addr, command string, payload interface{}) {
+	if p := n.peerByAddr(addr); p != nil {
+		p.Send(command, payload)
+	}
 }
 
-func sendGetBlocks(address string) {
-	payload := gobEncode(getblocks{nodeAddress})
-	request := append(commandToBytes("getblocks"), payload...)
-
-	sendData(address, request)
+func (n *Node) sendInv(p *Peer, kind string, items [][]byte) {
+	p.Send("inv", inv{n.Address, kind, items})
 }
 
-func sendGetData(address, kind string, id []byte) {
-	payload := gobEncode(getdata{nodeAddress, kind, id})
-	request := append(commandToBytes("getdata"), payload...)
-
-	sendData(address, request)
+func (n *Node) sendGetHeaders(p *Peer) {
+	p.Send("getheaders", getheaders{n.Address, n.bc.BlockLocator(), nil})
 }
 
-func sendTx(addr string, tnx *Transaction) {
-	data := tx{nodeAddress, tnx.Serialize()}
-	payload := gobEncode(data)
-	request := append(commandToBytes("tx"), payload...)
-
-	sendData(addr, request)
+func (n *Node) sendHeaders(p *Peer, hdrs [][]byte) {
+	p.Send("headers", headers{n.Address, hdrs})
 }
 
-func sendVersion(addr string, bc *Blockchain) {
-	bestHeight := bc.GetBestHeight()
-	payload := gobEncode(version{nodeVersion, bestHeight, nodeAddress})
-
-	request := append(commandToBytes("version"), payload...)
-
-	sendData(addr, request)
+func (n *Node) sendGetData(p *Peer, kind string, id []byte) {
+	p.Send("getdata", getdata{n.Address, kind, id})
 }
 
-//当一个节点接收到一个命令，它会运行 bytesToCommand 来提取命令名，并选择正确的处理器处理命令主体
-func handleAddr(request []byte) {
-	var buff bytes.Buffer
-	var payload addr
+func (n *Node) sendNotFound(p *Peer, kind string, id []byte) {
+	p.Send("notfound", notfound{n.Address, kind, id})
+}
 
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	if err != nil {
-		log.Panic(err)
-	}
+func (n *Node) sendTx(p *Peer, tnx *Transaction) {
+	p.Send("tx", tx{n.Address, tnx.Serialize()})
+}
 
-	knownNodes = append(knownNodes, payload.AddrList...)
-	fmt.Printf("There are %d known nodes now!\n", len(knownNodes))
-	requestBlocks()
+// height 由调用者在 chainMu 下读取
+func (n *Node) sendVersion(p *Peer, height int) {
+	p.Send("version", version{nodeVersion, height, n.Address, n.services, userAgent, time.Now().Unix(), n.nonce})
 }
 
-func handleBlock(request []byte, bc *Blockchain) {
+func (n *Node) handleBlock(p *Peer, request []byte) {
 	var buff bytes.Buffer
 	var payload block
 
-	buff.Write(request[commandLength:])
+	buff.Write(request)
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		n.misbehaving(p, banScoreMalformed, fmt.Sprintf("malformed block: %v", err))
+		return
 	}
 
 	blockData := payload.Block
 	block := DeserializeBlock(blockData)
-
+	if block == nil {
+		n.misbehaving(p, banScoreMalformed, "malformed block")
+		return
+	}
 	fmt.Println("Recevied a new block!")
-	bc.AddBlock(block)
+	n.processBlock(p, block)
+}
 
-	fmt.Printf("Added block %x\n", block.Hash)
+// 处理完整区块或者由紧凑区块还原的区块：连接到链上并连接缓存中的后续区块
+func (n *Node) processBlock(p *Peer, block *Block) {
+	p.updateHeight(block.Height)
+	//并行下载的区块可能先于父区块到达，先缓存起来，父区块连接之后再按顺序连接
+	requested := n.downloader.received(block.Hash)
+	if requested && !n.bc.hasBlock(block.PrevBlockHash) && n.bc.findHeader(block.PrevBlockHash) != nil {
+		n.downloader.buffer(block, p)
+		n.downloader.fill()
+		return
+	}
 
-	if len(blocksInTransit) > 0 {
-		blockHash := blocksInTransit[0]
-		sendGetData(payload.AddrFrom, "block", blockHash)
+	connected := false
+	pending := []*bufferedBlock{{block, p, time.Now()}}
+	for len(pending) > 0 {
+		b := pending[0]
+		pending = pending[1:]
+		update, err := n.bc.AddBlock(b.block)
+		if err != nil {
+			fmt.Printf("Rejected block from %s: %v\n", b.from, err)
+			//缓存中的后代也无法连接，同步区块头之后重新下载
+			n.downloader.rejected(b.block.Hash)
+			//缺少父区块时先同步区块头，其他违反共识规则的区块是对方的过错
+			var verr *BlockValidationError
+			if errors.Is(err, ErrOrphanBlock) {
+				n.sendGetHeaders(b.from)
+			} else if errors.As(err, &verr) {
+				n.misbehaving(b.from, blockBanScore(err), err.Error())
+			}
+			continue
+		}
+		fmt.Printf("Added block %x\n", b.block.Hash)
+		n.mempool.UpdateChain(update)
+		connected = connected || len(update.Connected) > 0
+		//同一个父区块可能有多个相互竞争的子区块，都尝试连接
+		pending = append(pending, n.downloader.takeChildren(b.block.Hash)...)
+	}
+	if !connected {
+		return
+	}
+	if n.miner != nil {
+		n.miner.Notify()
+	}
+	n.downloader.fill()
+	//下载完成后把新的链尖转发给其他节点
+	if n.downloader.idle() {
+		if tip, err := n.bc.GetBlock(n.bc.tip); err == nil {
+			n.relayBlock(p, &tip)
+		}
+	}
+}
 
-		blocksInTransit = blocksInTransit[1:]
-	} else {
-		UTXOSet := UTXOSet{bc}
-		UTXOSet.Reindex()
+// 把最佳区块头链上还没有区块体的区块交给下载管理器
+func (n *Node) requestMissingBlocks() {
+	var reqs []*blockRequest
+	for _, hash := range n.bc.MissingBlocks() {
+		reqs = append(reqs, &blockRequest{hash: hash, height: n.bc.findHeader(hash).Height})
 	}
+	n.downloader.add(reqs)
 }
 
-func handleInv(request []byte, bc *Blockchain) {
+func (n *Node) handleInv(p *Peer, request []byte) {
 	var buff bytes.Buffer
 	var payload inv
 
-	buff.Write(request[commandLength:])
+	buff.Write(request)
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		n.misbehaving(p, banScoreMalformed, fmt.Sprintf("malformed inv: %v", err))
+		return
 	}
 
 	fmt.Printf("Recevied inventory with %d %s\n", len(payload.Items), payload.Type)
 
 	if payload.Type == "block" {
-		blocksInTransit = payload.Items
-
-		blockHash := payload.Items[0]
-		sendGetData(payload.AddrFrom, "block", blockHash)
-
-		newInTransit := [][]byte{}
-		for _, b := range blocksInTransit {
-			if bytes.Compare(b, blockHash) != 0 {
-				newInTransit = append(newInTransit, b)
+		//先同步区块头：有不认识的区块时请求区块头，区块头链更新后再下载区块体
+		unknown := false
+		for _, hash := range payload.Items {
+			if header := n.bc.findHeader(hash); header != nil {
+				p.updateHeight(header.Height)
+			} else {
+				unknown = true
 			}
 		}
-		blocksInTransit = newInTransit
+		if unknown {
+			n.sendGetHeaders(p)
+		}
+		if n.spv != nil {
+			n.spv.requestFiltered(p)
+		} else {
+			n.requestMissingBlocks()
+		}
 	}
 
-	if payload.Type == "tx" {
-		txID := payload.Items[0]
-
-		if mempool[hex.EncodeToString(txID)].ID == nil {
-			sendGetData(payload.AddrFrom, "tx", txID)
+	//轻节点只接收与过滤器匹配的已打包交易
+	if payload.Type == "tx" && n.spv == nil {
+		for _, txID := range payload.Items {
+			if !n.mempool.Has(txID) {
+				n.sendGetData(p, "tx", txID)
+			}
 		}
 	}
 }
 
-func handleGetBlocks(request []byte, bc *Blockchain) {
+func (n *Node) handleGetHeaders(p *Peer, request []byte) {
 	var buff bytes.Buffer
-	var payload getblocks
+	var payload getheaders
 
-	buff.Write(request[commandLength:])
+	buff.Write(request)
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		n.misbehaving(p, banScoreMalformed, fmt.Sprintf("malformed getheaders: %v", err))
+		return
 	}
 
-	blocks := bc.GetBlockHashes()
-	sendInv(payload.AddrFrom, "block", blocks)
+	var hdrs [][]byte
+	for _, hash := range n.bc.LocateHashes(payload.Locator, payload.StopHash, maxHeadersPerMsg) {
+		hdrs = append(hdrs, n.bc.findHeader(hash).Serialize())
+	}
+	n.sendHeaders(p, hdrs)
 }
 
-func handleGetData(request []byte, bc *Blockchain) {
+//先验证并保存区块头，区块头链同步完成后再按高度顺序下载区块体
+func (n *Node) handleHeaders(p *Peer, request []byte) {
 	var buff bytes.Buffer
-	var payload getdata
+	var payload headers
 
-	buff.Write(request[commandLength:])
+	buff.Write(request)
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		n.misbehaving(p, banScoreMalformed, fmt.Sprintf("malformed headers: %v", err))
+		return
 	}
 
-	if payload.Type == "block" {
-		block := bc.GetBlock([]byte(payload.ID))
-
-		sendBlock(payload.AddrFrom, &block)
+	fmt.Printf("Recevied %d headers\n", len(payload.Headers))
+	for _, data := range payload.Headers {
+		header := DeserializeHeader(data)
+		if header == nil {
+			n.misbehaving(p, banScoreMalformed, "malformed header")
+			return
+		}
+		p.updateHeight(header.Height)
+		if err := n.bc.AddHeader(header); err != nil {
+			fmt.Printf("Rejected header from %s: %v\n", p, err)
+			var verr *BlockValidationError
+			if !errors.Is(err, ErrOrphanBlock) && errors.As(err, &verr) {
+				n.misbehaving(p, blockBanScore(err), err.Error())
+			}
+			return
+		}
 	}
 
-	if payload.Type == "tx" {
-		txID := hex.EncodeToString(payload.ID)
-		tx := mempool[txID]
-
-		sendTx(payload.AddrFrom, &tx)
-		// delete(mempool, txID)
+	//区块体的下载与后续区块头的同步同时进行，轻节点只请求过滤后的区块
+	if n.spv != nil {
+		n.spv.requestFiltered(p)
+	} else {
+		n.requestMissingBlocks()
+	}
+	//对方可能还有更多的区块头
+	if len(payload.Headers) == maxHeadersPerMsg {
+		n.sendGetHeaders(p)
 	}
 }
 
-func handleTx(request []byte, bc *Blockchain) {
+func (n *Node) handleGetData(p *Peer, request []byte) {
 	var buff bytes.Buffer
-	var payload tx
+	var payload getdata
 
-	buff.Write(request[commandLength:])
+	buff.Write(request)
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		n.misbehaving(p, banScoreMalformed, fmt.Sprintf("malformed getdata: %v", err))
+		return
 	}
 
-	txData := payload.Transaction
-	tx := DeserializeTransaction(txData)
-	mempool[hex.EncodeToString(tx.ID)] = tx
-
-	if nodeAddress == knownNodes[0] {
-		for _, node := range knownNodes {
-			if node != nodeAddress && node != payload.AddFrom {
-				sendInv(node, "tx", [][]byte{tx.ID})
-			}
+	switch payload.Type {
+	case "block":
+		block, err := n.bc.GetBlock(payload.ID)
+		if err != nil {
+			n.sendNotFound(p, payload.Type, payload.ID)
+			return
 		}
-	} else {
-		if len(mempool) >= 2 && len(miningAddress) > 0 {
-		MineTransactions:
-			var txs []*Transaction
-
-			for id := range mempool {
-				tx := mempool[id]
-				if bc.VerifyTransaction(&tx) {
-					txs = append(txs, &tx)
-				}
-			}
-
-			if len(txs) == 0 {
-				fmt.Println("All transactions are invalid! Waiting for new ones...")
-				return
-			}
-
-			cbTx := NewCoinbaseTX(miningAddress, "")
-			txs = append(txs, cbTx)
-
-			newBlock := bc.MineBlock(txs)
-			UTXOSet := UTXOSet{bc}
-			UTXOSet.Reindex()
-
-			fmt.Println("New block is mined!")
+		n.sendBlock(p, &block)
+	case "filtered":
+		block, err := n.bc.GetBlock(payload.ID)
+		if err != nil || !p.hasFilter() {
+			n.sendNotFound(p, payload.Type, payload.ID)
+			return
+		}
+		n.sendMerkleBlock(p, &block)
+	case "tx":
+		tx, ok := n.mempool.Get(payload.ID)
+		if !ok {
+			n.sendNotFound(p, payload.Type, payload.ID)
+			return
+		}
+		n.sendTx(p, tx)
+	default:
+		n.sendNotFound(p, payload.Type, payload.ID)
+	}
+}
 
-			for _, tx := range txs {
-				txID := hex.EncodeToString(tx.ID)
-				delete(mempool, txID)
-			}
+// 对方没有我们请求的数据：区块换一个连接重新请求
+func (n *Node) handleNotFound(p *Peer, request []byte) {
+	var buff bytes.Buffer
+	var payload notfound
 
-			for _, node := range knownNodes {
-				if node != nodeAddress {
-					sendInv(node, "block", [][]byte{newBlock.Hash})
-				}
-			}
+	buff.Write(request)
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		n.misbehaving(p, banScoreMalformed, fmt.Sprintf("malformed notfound: %v", err))
+		return
+	}
 
-			if len(mempool) > 0 {
-				goto MineTransactions
-			}
+	fmt.Printf("%s does not have %s %x\n", p, payload.Type, payload.ID)
+	switch payload.Type {
+	case "block":
+		n.downloader.notFound(p, payload.ID)
+	case "filtered":
+		if n.spv != nil {
+			n.spv.notFound(payload.ID)
 		}
 	}
 }
 
-func handleVersion(request []byte, bc *Blockchain) {
+func (n *Node) handleTx(p *Peer, request []byte) {
 	var buff bytes.Buffer
-	var payload version
+	var payload tx
 
-	buff.Write(request[commandLength:])
+	buff.Write(request)
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		n.misbehaving(p, banScoreMalformed, fmt.Sprintf("malformed tx: %v", err))
+		return
 	}
 
-	myBestHeight := bc.GetBestHeight()
-	foreignerBestHeight := payload.BestHeight
+	txData := payload.Transaction
+	tx := DeserializeTransaction(txData)
+	if n.spv != nil {
+		n.spv.receiveTx(&tx)
+		return
+	}
+	if err := n.mempool.Add(tx); err != nil {
+		fmt.Printf("Rejected transaction %x: %v\n", tx.ID, err)
+		//冲突、缺少输入或者内存池已满不一定是对方的过错
+		if errors.Is(err, ErrBadTransaction) {
+			n.misbehaving(p, banScoreInvalidTx, err.Error())
+		}
+		return
+	}
 
-	if myBestHeight < foreignerBestHeight {
-		sendGetBlocks(payload.AddrFrom)
-	} else if myBestHeight > foreignerBestHeight {
-		sendVersion(payload.AddrFrom, bc)
+	//每个节点都转发通过验证的交易，是否打包由挖矿组件决定
+	n.relayInv(p, "tx", [][]byte{tx.ID})
+	if n.miner != nil {
+		n.miner.Notify()
 	}
+}
 
-	// sendAddr(payload.AddrFrom)
-	if !nodeIsKnown(payload.AddrFrom) {
-		knownNodes = append(knownNodes, payload.AddrFrom)
+// 向除了from之外所有完成握手的全节点发送 inv
+func (n *Node) relayInv(from *Peer, kind string, items [][]byte) {
+	for _, p := range n.Peers() {
+		if p == from || !p.handshakeDone() || p.RemoteVersion().Services&SFNodeFull == 0 {
+			continue
+		}
+		n.sendInv(p, kind, items)
 	}
 }
 
-func handleConnection(conn net.Conn, bc *Blockchain) {
-	request, err := ioutil.ReadAll(conn)
-	if err != nil {
-		log.Panic(err)
+// 为接受的连接启动读写循环，来自被封禁地址的连接直接关闭
+func (n *Node) handleConnection(conn net.Conn) {
+	if n.isBanned(conn.RemoteAddr().String()) {
+		conn.Close()
+		return
 	}
-	command := bytesToCommand(request[:commandLength])
-	fmt.Printf("Received %s command\n", command)
+	p := newPeer(n, conn, "", true)
+	if !n.addPeer(p) {
+		conn.Close()
+		return
+	}
+	p.start()
+}
 
-	switch command {
+// 读循环收到一条消息后调用，按命令选择处理器
+func (n *Node) handleMessage(p *Peer, msg *message) {
+	fmt.Printf("Received %s command\n", msg.Command)
+
+	n.chainMu.Lock()
+	defer n.chainMu.Unlock()
+	//握手完成之前只接受 version 和 verack
+	if !p.handshakeDone() && msg.Command != "version" && msg.Command != "verack" {
+		fmt.Printf("Disconnecting %s: %s before handshake\n", p, msg.Command)
+		p.Close()
+		return
+	}
+	//轻节点没有完整的区块链，不处理区块和数据请求
+	if n.spv != nil && !spvCommands[msg.Command] {
+		fmt.Printf("Ignoring %s in SPV mode\n", msg.Command)
+		return
+	}
+	switch msg.Command {
 	case "addr":
-		handleAddr(request)
+		n.handleAddr(p, msg.Payload)
+	case "getaddr":
+		n.handleGetAddr(p)
 	case "block":
-		handleBlock(request, bc)
+		n.handleBlock(p, msg.Payload)
 	case "inv":
-		handleInv(request, bc)
-	case "getblocks":
-		handleGetBlocks(request, bc)
+		n.handleInv(p, msg.Payload)
+	case "getheaders":
+		n.handleGetHeaders(p, msg.Payload)
+	case "headers":
+		n.handleHeaders(p, msg.Payload)
+	case "cmpctblock":
+		n.handleCmpctBlock(p, msg.Payload)
+	case "getblocktxn":
+		n.handleGetBlockTxn(p, msg.Payload)
+	case "blocktxn":
+		n.handleBlockTxn(p, msg.Payload)
 	case "getdata":
-		handleGetData(request, bc)
+		n.handleGetData(p, msg.Payload)
+	case "notfound":
+		n.handleNotFound(p, msg.Payload)
+	case "merkleblock":
+		//全节点不会请求过滤区块，收到的 merkleblock 都是对方主动发送的
+		if n.spv == nil {
+			n.misbehaving(p, banScoreUnrequested, "unrequested merkleblock")
+			return
+		}
+		n.spv.handleMerkleBlock(p, msg.Payload)
+	case "filterload":
+		n.handleFilterLoad(p, msg.Payload)
+	case "filteradd":
+		n.handleFilterAdd(p, msg.Payload)
 	case "tx":
-		handleTx(request, bc)
+		n.handleTx(p, msg.Payload)
 	case "version":
-		handleVersion(request, bc)
+		n.handleVersion(p, msg.Payload)
+	case "verack":
+		n.handleVerack(p)
 	default:
 		fmt.Println("Unknown command!")
 	}
-
-	conn.Close()
 }
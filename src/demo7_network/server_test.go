@@ -0,0 +1,713 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 每隔一段时间检查一次条件，超时后测试失败
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// 把测试链的数据库复制给各个节点，相当于教程中复制 blockchain_genesis.db
+func copyTestChain(t *testing.T, nodeIDs ...string) {
+	data, err := ioutil.ReadFile("blockchain_test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range nodeIDs {
+		if err := ioutil.WriteFile("blockchain_"+id+".db", data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func hasNode(nodes []string, addr string) bool {
+	for _, node := range nodes {
+		if node == addr {
+			return true
+		}
+	}
+	return false
+}
+
+func TestNodesRelayAndMineTransactions(t *testing.T) {
+	bc, alice := newTestBlockchain(t)
+	utxo := UTXOSet{bc}
+	bob, carol, miner := NewWallet(), NewWallet(), NewWallet()
+	split := NewUTXOTransaction(alice, string(bob.GetAddress()), 5, 0, &utxo)
+	bc.MineBlock([]*Transaction{NewCoinbaseTX(string(alice.GetAddress()), "", 1, 0), split})
+	fromAlice := NewUTXOTransaction(alice, string(carol.GetAddress()), 2, 1, &utxo)
+	fromBob := NewUTXOTransaction(bob, string(carol.GetAddress()), 2, 1, &utxo)
+	bc.db.Close()
+	copyTestChain(t, "3910", "3911")
+
+	//两个节点地位相同，不挖矿的节点只作为种子节点，交易由它转发给矿工
+	seed := StartServer("3910", "", nil)
+	defer seed.Stop()
+	minerNode := StartServer("3911", string(miner.GetAddress()), []string{seed.Address})
+	defer minerNode.Stop()
+	waitFor(t, "miner to register with the seed node", func() bool {
+		return hasNode(seed.KnownNodes(), minerNode.Address)
+	})
+
+	for _, tnx := range []*Transaction{fromAlice, fromBob} {
+		if err := sendMessage(seed.Address, "tx", tx{"", tnx.Serialize()}); err != nil {
+			t.Fatalf("send tx: %v", err)
+		}
+	}
+	//矿工可能把两笔交易打包进一个或两个区块
+	waitFor(t, "seed node to receive the mined blocks", func() bool {
+		return seed.MempoolCount() == 0 && seed.BestHeight() >= 2
+	})
+	waitFor(t, "both nodes to agree on the tip", func() bool {
+		return minerNode.BestHeight() == seed.BestHeight() && minerNode.MempoolCount() == 0
+	})
+	//所有消息都经过矿工启动时建立的那一个连接
+	waitFor(t, "one persistent connection between the nodes", func() bool {
+		return len(seed.Peers()) == 1 && len(minerNode.Peers()) == 1
+	})
+}
+
+func TestReadMessageRejectsBadFrames(t *testing.T) {
+	var buff bytes.Buffer
+	if err := writeMessage(&buff, &message{"inv", []byte("payload")}); err != nil {
+		t.Fatal(err)
+	}
+	frame := buff.Bytes()
+	msg, err := readMessage(bytes.NewReader(frame))
+	if err != nil || msg.Command != "inv" || string(msg.Payload) != "payload" {
+		t.Fatalf("readMessage = %+v, %v", msg, err)
+	}
+
+	corrupt := func(f func(frame []byte)) []byte {
+		c := append([]byte{}, frame...)
+		f(c)
+		return c
+	}
+	tests := []struct {
+		name  string
+		frame []byte
+		want  error
+	}{
+		{"bad magic", corrupt(func(c []byte) { c[0] ^= 0xff }), ErrBadMagic},
+		{"bad command", corrupt(func(c []byte) { copy(c[4:], "i\x00v") }), ErrBadCommand},
+		{"bad checksum", corrupt(func(c []byte) { c[len(c)-1] ^= 0xff }), ErrBadChecksum},
+		//消息体没有发送，只要长度超过上限就应该被拒绝
+		{"oversized", corrupt(func(c []byte) {
+			binary.LittleEndian.PutUint32(c[4+commandLength:], maxPayloadSize+1)
+		})[:messageHeaderSize], ErrPayloadTooLarge},
+	}
+	for _, tt := range tests {
+		if _, err := readMessage(bytes.NewReader(tt.frame)); !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+// 在测试链上启动一个单独的节点
+func startTestNode(t *testing.T, nodeID string) *Node {
+	bc, _ := newTestBlockchain(t)
+	bc.db.Close()
+	copyTestChain(t, nodeID)
+	node := StartServer(nodeID, "", nil)
+	t.Cleanup(node.Stop)
+	return node
+}
+
+// 等待对方关闭连接
+func expectDisconnect(t *testing.T, conn net.Conn, what string) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, err := readMessage(conn); err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Fatalf("%s: connection still open", what)
+			}
+			return
+		}
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	node := startTestNode(t, "3920")
+
+	early, err := net.Dial(protocol, node.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer early.Close()
+	writeMessage(early, &message{"inv", gobEncode(inv{"", "tx", nil})})
+	expectDisconnect(t, early, "inv before handshake")
+
+	old, err := net.Dial(protocol, node.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+	writeMessage(old, &message{"version", gobEncode(version{Version: 1, Nonce: 1})})
+	expectDisconnect(t, old, "old protocol version")
+
+	wallet, err := net.Dial(protocol, node.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wallet.Close()
+	if err := clientHandshake(wallet); err != nil {
+		t.Fatalf("clientHandshake: %v", err)
+	}
+	waitFor(t, "wallet handshake", func() bool {
+		for _, p := range node.Peers() {
+			if v := p.RemoteVersion(); p.handshakeDone() && v.Services == SFNodeWallet && v.UserAgent == userAgent {
+				return true
+			}
+		}
+		return false
+	})
+	if hasNode(node.KnownNodes(), "") {
+		t.Errorf("wallet-only peer added to known nodes")
+	}
+	wallet.Close()
+
+	//连接到自己时对方的 nonce 与自己的相同，连接被断开
+	if p := node.peerByAddr(node.Address); p == nil {
+		t.Fatal("could not dial self")
+	}
+	waitFor(t, "self connection to be dropped", func() bool {
+		return len(node.Peers()) == 0
+	})
+}
+
+func connectedTo(node *Node, addr string) bool {
+	for _, p := range node.Peers() {
+		if p.Addr() == addr && p.handshakeDone() {
+			return true
+		}
+	}
+	return false
+}
+
+func TestPeerDiscoveryAndPersistentAddresses(t *testing.T) {
+	bc, _ := newTestBlockchain(t)
+	bc.db.Close()
+	copyTestChain(t, "3930", "3931", "3932")
+
+	seed := StartServer("3930", "", nil)
+	defer seed.Stop()
+	b := StartServer("3931", "", []string{seed.Address})
+	defer b.Stop()
+	waitFor(t, "b to connect to the seed", func() bool { return connectedTo(seed, b.Address) })
+
+	//c 只知道种子节点，通过 getaddr 发现 b 并连接它
+	c := StartServer("3932", "", []string{seed.Address})
+	waitFor(t, "c to discover and connect to b", func() bool {
+		return connectedTo(c, b.Address) && hasNode(b.KnownNodes(), c.Address)
+	})
+	if known := c.KnownNodes(); len(known) != 2 {
+		t.Errorf("c knows %v, want the seed and b without duplicates", known)
+	}
+
+	//重启后不指定种子节点，从数据库恢复已知节点
+	c.Stop()
+	c = StartServer("3932", "", nil)
+	defer c.Stop()
+	waitFor(t, "c to reconnect to saved peers", func() bool {
+		return connectedTo(c, seed.Address) && connectedTo(c, b.Address)
+	})
+}
+
+func TestConcurrentDialsShareOneConnection(t *testing.T) {
+	bc, _ := newTestBlockchain(t)
+	bc.db.Close()
+	copyTestChain(t, "3935", "3936")
+	a := StartServer("3935", "", nil)
+	defer a.Stop()
+	b := StartServer("3936", "", nil)
+	defer b.Stop()
+
+	//多个处理器同时需要到同一个地址的连接时只建立一个
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.peerByAddr(a.Address)
+		}()
+	}
+	wg.Wait()
+	waitFor(t, "b to connect to a", func() bool { return connectedTo(b, a.Address) })
+	if len(b.Peers()) != 1 || len(a.Peers()) != 1 {
+		t.Fatalf("b has %d peers and a has %d, want one connection", len(b.Peers()), len(a.Peers()))
+	}
+}
+
+// 返回节点封禁记录的键
+func bannedKeys(n *Node) []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var keys []string
+	for key := range n.banned {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func TestMisbehavingPeerIsBanned(t *testing.T) {
+	bc, _ := newTestBlockchain(t)
+	bc.db.Close()
+	copyTestChain(t, "3940", "3941", "3942")
+
+	a := StartServer("3940", "", nil)
+	bad := StartServer("3941", "", []string{a.Address})
+	defer bad.Stop()
+	waitFor(t, "bad node to connect", func() bool { return connectedTo(a, bad.Address) })
+
+	//无法解码的区块使对方的违规分数直接达到上限，回环地址的节点按监听地址封禁
+	bad.send(a.Address, "block", block{bad.Address, []byte("garbage")})
+	waitFor(t, "bad node to be banned and disconnected", func() bool {
+		return len(bannedKeys(a)) == 1 && len(a.Peers()) == 0
+	})
+	key := bannedKeys(a)[0]
+	if key != banKey(bad.Address) {
+		t.Fatalf("banned %q, want %q", key, banKey(bad.Address))
+	}
+	if hasNode(a.KnownNodes(), bad.Address) {
+		t.Errorf("banned node is still a known node")
+	}
+
+	//被封禁的节点从另一个端口重新连接，收到 version 时就被断开
+	waitFor(t, "bad node to notice the disconnect", func() bool { return len(bad.Peers()) == 0 })
+	conn, err := net.Dial(protocol, a.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	writeMessage(conn, &message{"version", gobEncode(version{nodeVersion, 1, bad.Address, SFNodeFull, userAgent, time.Now().Unix(), 7})})
+	expectDisconnect(t, conn, "banned peer reconnecting")
+	bad.peerByAddr(a.Address)
+	time.Sleep(200 * time.Millisecond)
+	if connectedTo(a, bad.Address) || len(a.Peers()) != 0 {
+		t.Fatal("banned node was accepted")
+	}
+
+	//同一台机器上的其他节点不受影响
+	good := StartServer("3942", "", []string{a.Address})
+	waitFor(t, "another local node to connect", func() bool { return connectedTo(a, good.Address) })
+	good.Stop()
+
+	//封禁保存在数据库中，重启后仍然有效，unban 之后可以重新连接
+	a.Stop()
+	a = StartServer("3940", "", nil)
+	if !a.isBanned(bad.Address) {
+		t.Fatal("ban was not persisted")
+	}
+	a.Stop()
+	cli := CLI{}
+	cli.unban(bad.Address, "3940")
+	a = StartServer("3940", "", nil)
+	defer a.Stop()
+	waitFor(t, "bad node to notice the restart", func() bool { return len(bad.Peers()) == 0 })
+	bad.peerByAddr(a.Address)
+	waitFor(t, "unbanned node to reconnect", func() bool { return connectedTo(a, bad.Address) })
+}
+
+func TestBanKey(t *testing.T) {
+	tests := []struct {
+		addr, want string
+	}{
+		{"10.0.0.1:3000", "10.0.0.1"},
+		{"10.0.0.1", "10.0.0.1"},
+		{"127.0.0.1:3000", "localhost:3000"},
+		{"localhost:3001", "localhost:3001"},
+		{"[::1]:3002", "localhost:3002"},
+	}
+	for _, tt := range tests {
+		if got := banKey(tt.addr); got != tt.want {
+			t.Errorf("banKey(%q) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+	if blockBanScore(ErrTimeTooNew) >= banThreshold || blockBanScore(ErrBadMerkleRoot) < banThreshold {
+		t.Errorf("future timestamps must score below the ban threshold, other rule violations at it")
+	}
+}
+
+func TestParallelBlockDownload(t *testing.T) {
+	bc, alice := newTestBlockchain(t)
+	bc.db.Close()
+	copyTestChain(t, "3952")
+	bc = PositioningBlockchain("test")
+	for height := 1; height <= 20; height++ {
+		bc.MineBlock([]*Transaction{NewCoinbaseTX(string(alice.GetAddress()), "", height, 0)})
+	}
+	bc.db.Close()
+	copyTestChain(t, "3950", "3951")
+
+	defer func(n int, d time.Duration) {
+		maxBlocksInFlightPerPeer, blockDownloadTimeout = n, d
+	}(maxBlocksInFlightPerPeer, blockDownloadTimeout)
+	maxBlocksInFlightPerPeer, blockDownloadTimeout = 4, 500*time.Millisecond
+
+	a := StartServer("3950", "", nil)
+	defer a.Stop()
+	b := StartServer("3951", "", nil)
+	defer b.Stop()
+	c := StartServer("3952", "", nil)
+	defer c.Stop()
+
+	//一个声称有20个区块但从不回复 getdata 的节点，分配给它的请求超时后由其他节点完成
+	staller, err := net.Dial(protocol, c.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer staller.Close()
+	writeMessage(staller, &message{"version", gobEncode(version{nodeVersion, 20, "localhost:3959", SFNodeFull, userAgent, time.Now().Unix(), 7})})
+	writeMessage(staller, &message{"verack", nil})
+	go io.Copy(ioutil.Discard, staller)
+	waitFor(t, "staller handshake", func() bool { return connectedTo(c, "localhost:3959") })
+
+	c.peerByAddr(a.Address)
+	c.peerByAddr(b.Address)
+	waitFor(t, "c to download all blocks", func() bool {
+		return c.BestHeight() == 20 && c.downloader.idle()
+	})
+}
+
+func TestNotFoundIsRetriedOnAnotherPeer(t *testing.T) {
+	bc, alice := newTestBlockchain(t)
+	bc.db.Close()
+	copyTestChain(t, "3961")
+	bc = PositioningBlockchain("test")
+	for height := 1; height <= 5; height++ {
+		bc.MineBlock([]*Transaction{NewCoinbaseTX(string(alice.GetAddress()), "", height, 0)})
+	}
+	bc.db.Close()
+	copyTestChain(t, "3960")
+
+	//每个连接一次只请求一个区块，超时足够长，只有处理 notfound 才能很快完成同步
+	defer func(n int, d time.Duration) {
+		maxBlocksInFlightPerPeer, blockDownloadTimeout = n, d
+	}(maxBlocksInFlightPerPeer, blockDownloadTimeout)
+	maxBlocksInFlightPerPeer, blockDownloadTimeout = 1, time.Minute
+
+	a := StartServer("3960", "", nil)
+	defer a.Stop()
+	c := StartServer("3961", "", nil)
+	defer c.Stop()
+
+	//声称有5个区块，但对所有 getdata 都回复 notfound 的节点
+	fake, err := net.Dial(protocol, c.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fake.Close()
+	writeMessage(fake, &message{"version", gobEncode(version{nodeVersion, 5, "localhost:3969", SFNodeFull, userAgent, time.Now().Unix(), 7})})
+	writeMessage(fake, &message{"verack", nil})
+	writeMessage(fake, &message{"getdata", gobEncode(getdata{"", "tx", []byte("missing")})})
+	txNotFound := make(chan bool, 1)
+	go func() {
+		for {
+			msg, err := readMessage(fake)
+			if err != nil {
+				return
+			}
+			var req getdata
+			switch msg.Command {
+			case "getdata":
+				gob.NewDecoder(bytes.NewReader(msg.Payload)).Decode(&req)
+				writeMessage(fake, &message{"notfound", gobEncode(notfound{"", req.Type, req.ID})})
+			case "notfound":
+				gob.NewDecoder(bytes.NewReader(msg.Payload)).Decode(&req)
+				txNotFound <- req.Type == "tx" && string(req.ID) == "missing"
+			}
+		}
+	}()
+	select {
+	case ok := <-txNotFound:
+		if !ok {
+			t.Fatal("unexpected notfound reply")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notfound reply for a missing transaction")
+	}
+
+	c.peerByAddr(a.Address)
+	waitFor(t, "c to download all blocks", func() bool {
+		return c.BestHeight() == 5 && c.downloader.idle()
+	})
+}
+
+func TestBlockDownloaderBuffer(t *testing.T) {
+	d := newBlockDownloader(&Node{peers: make(map[*Peer]bool)})
+	from, other := &Peer{}, &Peer{}
+	newTestBlock := func(name string, parent *Block) *Block {
+		b := &Block{Hash: []byte(name)}
+		b.PrevBlockHash, b.Height = []byte("tip"), 1
+		if parent != nil {
+			b.PrevBlockHash, b.Height = parent.Hash, parent.Height+1
+		}
+		return b
+	}
+	a1 := newTestBlock("a1", nil)
+	a2, b2 := newTestBlock("a2", a1), newTestBlock("b2", a1)
+	a3 := newTestBlock("a3", a2)
+
+	//已经缓存或者在下载的区块不会重复请求
+	d.buffer(a2, from)
+	d.add([]*blockRequest{{hash: a2.Hash, height: 2}, {hash: a1.Hash, height: 1}, {hash: a1.Hash, height: 1}})
+	if len(d.queue) != 1 || !d.received(a1.Hash) || d.received(a1.Hash) {
+		t.Fatalf("queue = %d requests, want only a1 once", len(d.queue))
+	}
+
+	//同一个父区块的两个子区块都被保留
+	d.buffer(b2, other)
+	d.buffer(a3, from)
+	if children := d.takeChildren(a1.Hash); len(children) != 2 {
+		t.Fatalf("takeChildren(a1) = %d blocks, want a2 and b2", len(children))
+	}
+	if children := d.takeChildren(a2.Hash); len(children) != 1 || children[0].block != a3 {
+		t.Fatalf("takeChildren(a2) = %v, want a3", children)
+	}
+	if !d.idle() {
+		t.Fatal("downloader not idle after taking all buffered blocks")
+	}
+
+	//父区块被拒绝时丢弃所有后代
+	d.buffer(a2, from)
+	d.buffer(a3, from)
+	d.rejected(a1.Hash)
+	if !d.idle() {
+		t.Fatalf("%d blocks still buffered after the parent was rejected", len(d.buffered))
+	}
+
+	//连接断开时它发来的缓存区块重新排队下载
+	d.buffer(a2, from)
+	d.buffer(b2, other)
+	d.removePeer(from)
+	if len(d.buffered) != 1 || len(d.queue) != 1 || !bytes.Equal(d.queue[0].hash, a2.Hash) {
+		t.Fatalf("after removePeer: %d buffered, queue %v", len(d.buffered), d.queue)
+	}
+	d.received(a2.Hash)
+
+	//等待父区块超时的缓存区块被丢弃
+	d.checkTimeouts(time.Now().Add(blockBufferTimeout))
+	if !d.idle() {
+		t.Fatalf("%d blocks still buffered after the timeout", len(d.buffered))
+	}
+}
+
+func TestCompactBlockReconstruction(t *testing.T) {
+	bc, alice := newTestBlockchain(t)
+	utxo := UTXOSet{bc}
+	bob, carol := NewWallet(), NewWallet()
+	split := NewUTXOTransaction(alice, string(bob.GetAddress()), 5, 0, &utxo)
+	bc.MineBlock([]*Transaction{NewCoinbaseTX(string(alice.GetAddress()), "", 1, 0), split})
+	fromAlice := NewUTXOTransaction(alice, string(carol.GetAddress()), 2, 1, &utxo)
+	fromBob := NewUTXOTransaction(bob, string(carol.GetAddress()), 2, 1, &utxo)
+	b := bc.NewBlockOn(bc.findHeader(bc.tip), []*Transaction{NewCoinbaseTX(string(alice.GetAddress()), "", 2, 2), fromAlice, fromBob})
+
+	cb := newCmpctBlock("", b)
+	if len(cb.ShortIDs) != 2 || len(cb.Prefilled) != 1 {
+		t.Fatalf("compact block has %d short IDs and %d prefilled txs", len(cb.ShortIDs), len(cb.Prefilled))
+	}
+	//内存池中只有一笔交易，缺少的交易通过 blocktxn 补全
+	txs, missing, err := cb.reconstruct(b.Hash, []*Transaction{fromBob})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != 1 || missing[0] != 1 {
+		t.Fatalf("missing = %v, want [1]", missing)
+	}
+	txs[1] = fromAlice
+	pb := &partialBlock{b.BlockHeader, txs, nil, time.Now()}
+	rebuilt := pb.block(b.Hash)
+	if rebuilt == nil || !bytes.Equal(rebuilt.Serialize(), b.Serialize()) {
+		t.Fatal("reconstructed block does not match the original")
+	}
+	//填错交易时默克尔根不一致
+	txs[1] = fromBob
+	if pb.block(b.Hash) != nil {
+		t.Fatal("block with wrong transactions accepted")
+	}
+}
+
+func TestCompactBlockRelay(t *testing.T) {
+	bc, alice := newTestBlockchain(t)
+	utxo := UTXOSet{bc}
+	bob, carol, miner := NewWallet(), NewWallet(), NewWallet()
+	split := NewUTXOTransaction(alice, string(bob.GetAddress()), 5, 0, &utxo)
+	bc.MineBlock([]*Transaction{NewCoinbaseTX(string(alice.GetAddress()), "", 1, 0), split})
+	fromAlice := NewUTXOTransaction(alice, string(carol.GetAddress()), 2, 1, &utxo)
+	fromBob := NewUTXOTransaction(bob, string(carol.GetAddress()), 2, 1, &utxo)
+	//与 fromBob 花费同一个输出，只用于紧凑区块中 b 没有的交易
+	extra := NewUTXOTransaction(bob, string(alice.GetAddress()), 1, 0, &utxo)
+	bc.db.Close()
+	copyTestChain(t, "3980", "3981")
+
+	defer func(d time.Duration) { partialBlockTimeout = d }(partialBlockTimeout)
+	partialBlockTimeout = time.Minute
+
+	a := StartServer("3980", string(miner.GetAddress()), nil)
+	defer a.Stop()
+	b := StartServer("3981", "", nil)
+	defer b.Stop()
+	b.peerByAddr(a.Address)
+	waitFor(t, "nodes to connect", func() bool { return connectedTo(a, b.Address) && connectedTo(b, a.Address) })
+
+	//b 的内存池中只有 fromAlice，收到紧凑区块后通过 getblocktxn 向 a 请求 fromBob
+	b.chainMu.Lock()
+	if err := b.mempool.Add(*fromAlice); err != nil {
+		t.Fatalf("Mempool.Add: %v", err)
+	}
+	b.chainMu.Unlock()
+	a.chainMu.Lock()
+	for _, tnx := range []*Transaction{fromAlice, fromBob} {
+		if err := a.mempool.Add(*tnx); err != nil {
+			t.Fatalf("Mempool.Add: %v", err)
+		}
+	}
+	a.chainMu.Unlock()
+	a.miner.Notify()
+	waitFor(t, "b to reconstruct the mined block", func() bool {
+		return b.BestHeight() == 2 && b.MempoolCount() == 0
+	})
+
+	//两个假节点：fake 发送紧凑区块并被请求缺少的交易，other 的 blocktxn 被忽略
+	b.chainMu.Lock()
+	prev := b.bc.findHeader(b.bc.tip)
+	b.chainMu.Unlock()
+	next := b.bc.NewBlockOn(prev, []*Transaction{NewCoinbaseTX(string(miner.GetAddress()), "", 3, 0), extra})
+	dialFake := func(addrFrom string) net.Conn {
+		conn, err := net.Dial(protocol, b.Address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeMessage(conn, &message{"version", gobEncode(version{nodeVersion, 3, addrFrom, SFNodeFull, userAgent, time.Now().Unix(), 7})})
+		writeMessage(conn, &message{"verack", nil})
+		waitFor(t, addrFrom+" handshake", func() bool { return connectedTo(b, addrFrom) })
+		return conn
+	}
+	fake, other := dialFake("localhost:3988"), dialFake("localhost:3989")
+	defer fake.Close()
+	defer other.Close()
+	go io.Copy(ioutil.Discard, other)
+
+	writeMessage(fake, &message{"cmpctblock", gobEncode(newCmpctBlock("", next))})
+	fake.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		msg, err := readMessage(fake)
+		if err != nil {
+			t.Fatalf("waiting for getblocktxn: %v", err)
+		}
+		if msg.Command != "getblocktxn" {
+			continue
+		}
+		var req getblocktxn
+		gob.NewDecoder(bytes.NewReader(msg.Payload)).Decode(&req)
+		if !bytes.Equal(req.BlockHash, next.Hash) || len(req.Indexes) != 1 || req.Indexes[0] != 1 {
+			t.Fatalf("getblocktxn = %x %v, want transaction 1 of %x", req.BlockHash, req.Indexes, next.Hash)
+		}
+		break
+	}
+	go io.Copy(ioutil.Discard, fake)
+
+	writeMessage(other, &message{"blocktxn", gobEncode(blocktxn{"", next.Hash, [][]byte{extra.Serialize()}})})
+	time.Sleep(200 * time.Millisecond)
+	b.chainMu.Lock()
+	pending := len(b.partialBlocks)
+	b.chainMu.Unlock()
+	if pending != 1 {
+		t.Fatalf("blocktxn from a peer that was not asked completed the block")
+	}
+
+	//等不到 blocktxn 时丢弃紧凑区块，改为下载完整区块
+	b.expirePartialBlocks(time.Now().Add(partialBlockTimeout))
+	b.chainMu.Lock()
+	pending = len(b.partialBlocks)
+	b.chainMu.Unlock()
+	if pending != 0 || b.downloader.idle() {
+		t.Fatalf("expired compact block was not requested as a full block")
+	}
+}
+
+func TestSPVNodeTracksWalletBalance(t *testing.T) {
+	bc, alice := newTestBlockchain(t)
+	bc.db.Close()
+	copyTestChain(t, "3971")
+	bc = PositioningBlockchain("test")
+	utxo := UTXOSet{bc}
+	bob, carol := NewWallet(), NewWallet()
+	split := NewUTXOTransaction(alice, string(bob.GetAddress()), 5, 0, &utxo)
+	bc.MineBlock([]*Transaction{NewCoinbaseTX(string(alice.GetAddress()), "", 1, 0), split})
+	fromBob := NewUTXOTransaction(bob, string(carol.GetAddress()), 2, 1, &utxo)
+	bc.MineBlock([]*Transaction{NewCoinbaseTX(string(alice.GetAddress()), "", 2, 1), fromBob})
+	bc.MineBlock([]*Transaction{NewCoinbaseTX(string(carol.GetAddress()), "", 3, 0)})
+	bc.db.Close()
+	copyTestChain(t, "3970")
+	full := StartServer("3970", "", nil)
+	defer full.Stop()
+	//轻节点只跟踪 bob 的地址
+	light := StartSPVNode("3971", [][]byte{bob.PublicKey}, []string{full.Address})
+	defer light.Stop()
+
+	//bob 收到5个币，花掉2个并支付1个手续费，找零2个
+	waitFor(t, "light client to track bob's outputs", func() bool {
+		return light.SPVBalance() == 2
+	})
+	//轻节点只同步区块头，没有下载区块体
+	if light.BestHeight() != 0 {
+		t.Fatalf("light client has block bodies up to height %d", light.BestHeight())
+	}
+	light.chainMu.Lock()
+	headerHeight := light.bc.findHeader(light.bc.BestHeaderHash()).Height
+	light.chainMu.Unlock()
+	if headerHeight != 3 {
+		t.Fatalf("light client synced headers to height %d, want 3", headerHeight)
+	}
+	//全节点不把轻节点当作区块来源
+	if hasNode(full.KnownNodes(), light.Address) {
+		t.Fatal("full node registered the light client as a peer address")
+	}
+}
+
+func TestFullNodeRejectsUnrequestedMerkleBlock(t *testing.T) {
+	node := startTestNode(t, "3975")
+	conn, err := net.Dial(protocol, node.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := clientHandshake(conn); err != nil {
+		t.Fatalf("clientHandshake: %v", err)
+	}
+
+	//全节点没有轻节点钱包，收到 merkleblock 时给对方加违规分数而不是崩溃
+	writeMessage(conn, &message{"merkleblock", gobEncode(merkleblock{Total: 1})})
+	waitFor(t, "merkleblock to be scored", func() bool {
+		for _, p := range node.Peers() {
+			if p.addBanScore(0) == banScoreUnrequested {
+				return true
+			}
+		}
+		return false
+	})
+	if _, err := net.Dial(protocol, node.Address); err != nil {
+		t.Fatalf("node stopped accepting connections: %v", err)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"log"
+	mrand "math/rand"
+)
+
+// 轻节点保存自己的未花费输出的bucket，键为 outpointKey
+const spvOutputsBucket = "spvoutputs"
+
+// 轻节点已经扫描过的区块，键为区块哈希
+const spvBlocksBucket = "spvblocks"
+
+// 轻节点过滤器的误判率，越高越能隐藏自己的地址，但会收到更多无关的交易
+const spvFalsePositiveRate = 0.0001
+
+// 轻节点模式下处理的命令，其他命令需要完整的区块链，直接忽略
+var spvCommands = map[string]bool{
+	"version": true, "verack": true, "addr": true, "getaddr": true,
+	"inv": true, "headers": true, "merkleblock": true, "tx": true, "notfound": true,
+}
+
+// 过滤后的区块：区块头加上匹配交易的部分默克尔树证明，匹配的交易随后用 tx 消息发送
+type merkleblock struct {
+	AddrFrom string
+	Header   []byte
+	Total    int
+	Hashes   [][]byte
+	Flags    []bool
+}
+
+// 轻节点拥有的一个未花费输出
+type spvOutput struct {
+	Txid   []byte
+	Vout   int
+	Output TXOutput
+	Height int
+}
+
+func (o spvOutput) Serialize() []byte {
+	var buff bytes.Buffer
+	enc := gob.NewEncoder(&buff)
+	err := enc.Encode(o)
+	if err != nil {
+		log.Panic(err)
+	}
+	return buff.Bytes()
+}
+
+func DeserializeSPVOutput(data []byte) spvOutput {
+	var o spvOutput
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	err := dec.Decode(&o)
+	if err != nil {
+		log.Panic(err)
+	}
+	return o
+}
+
+// 轻节点的钱包状态：只同步区块头，通过布隆过滤器从全节点获取与自己地址相关的交易
+// 所有方法都在 chainMu 下调用
+type spvWallet struct {
+	node         *Node
+	pubKeyHashes [][]byte
+	filter       *bloomFilter
+	//已经请求但还没有收到的过滤区块，值为请求的连接
+	requested map[string]*Peer
+	//merkleblock 中匹配、还没有收到的交易，键为交易的默克尔叶子哈希，值为区块高度
+	pending map[string]int
+}
+
+// 创建跟踪pubKeys对应地址的轻节点钱包
+func newSPVWallet(n *Node, pubKeys [][]byte) *spvWallet {
+	w := &spvWallet{node: n, requested: make(map[string]*Peer), pending: make(map[string]int)}
+	var elements [][]byte
+	for _, pubKey := range pubKeys {
+		pubKeyHash := HashPubKey(pubKey)
+		w.pubKeyHashes = append(w.pubKeyHashes, pubKeyHash)
+		elements = append(elements, pubKeyHash, pubKey)
+	}
+	w.filter = newBloomFilter(len(elements), spvFalsePositiveRate, mrand.Uint32())
+	for _, e := range elements {
+		w.filter.Add(e)
+	}
+	err := n.bc.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{spvOutputsBucket, spvBlocksBucket} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	return w
+}
+
+// 与全节点握手后加载过滤器，然后同步区块头
+func (w *spvWallet) onHandshake(p *Peer) {
+	p.Send("filterload", filterload{w.node.Address, *w.filter})
+	w.node.sendGetHeaders(p)
+}
+
+// 向p请求最佳区块头链上还没有扫描过的区块，按高度从低到高排列
+// 扫描过的区块被重组出主链时不会回滚其中的输出
+func (w *spvWallet) requestFiltered(p *Peer) {
+	bc := w.node.bc
+	var hashes [][]byte
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		scanned := tx.Bucket([]byte(spvBlocksBucket))
+		hash := bc.BestHeaderHash()
+		for len(hash) > 0 && scanned.Get(hash) == nil {
+			header := bc.findHeader(hash)
+			if header == nil {
+				break
+			}
+			hashes = append([][]byte{hash}, hashes...)
+			hash = header.PrevBlockHash
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	for _, hash := range hashes {
+		//请求过的连接断开之后换一个连接重新请求
+		id := hex.EncodeToString(hash)
+		if q := w.requested[id]; q == nil || q.closed() {
+			w.requested[id] = p
+			w.node.sendGetData(p, "filtered", hash)
+		}
+	}
+}
+
+// 验证过滤区块的默克尔证明，记下匹配的交易等待随后的 tx 消息
+func (w *spvWallet) handleMerkleBlock(p *Peer, request []byte) {
+	var buff bytes.Buffer
+	var payload merkleblock
+
+	buff.Write(request)
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		w.node.misbehaving(p, banScoreMalformed, fmt.Sprintf("malformed merkleblock: %v", err))
+		return
+	}
+
+	header := DeserializeHeader(payload.Header)
+	if header == nil {
+		w.node.misbehaving(p, banScoreMalformed, "malformed merkleblock header")
+		return
+	}
+	hash := header.Hash()
+	if w.node.bc.findHeader(hash) == nil {
+		fmt.Printf("Ignoring merkleblock %x with unknown header\n", hash)
+		return
+	}
+	root, matched, err := VerifyPartialProof(payload.Total, payload.Hashes, payload.Flags)
+	if err == nil && !bytes.Equal(root, header.MerkleRoot) {
+		err = fmt.Errorf("merkle root mismatch")
+	}
+	if err != nil {
+		w.node.misbehaving(p, banScoreInvalidBlock, fmt.Sprintf("bad merkleblock %x: %v", hash, err))
+		return
+	}
+
+	fmt.Printf("Merkleblock %x at height %d matched %d transactions\n", hash, header.Height, len(matched))
+	for _, leaf := range matched {
+		w.pending[hex.EncodeToString(leaf)] = header.Height
+	}
+	delete(w.requested, hex.EncodeToString(hash))
+	err = w.node.bc.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(spvBlocksBucket)).Put(hash, []byte{})
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// 处理 merkleblock 之后收到的匹配交易，记录付给自己的输出，删除被花费的输出
+// 不在任何 merkleblock 中的交易无法证明已经打包，直接忽略
+func (w *spvWallet) receiveTx(tnx *Transaction) {
+	leaf := sha256.Sum256(tnx.Serialize())
+	height, ok := w.pending[hex.EncodeToString(leaf[:])]
+	if !ok {
+		return
+	}
+	delete(w.pending, hex.EncodeToString(leaf[:]))
+	err := w.node.bc.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(spvOutputsBucket))
+		if !tnx.IsCoinbase() {
+			for _, vin := range tnx.Vin {
+				if err := b.Delete(outpointKey(vin.Txid, vin.Vout)); err != nil {
+					return err
+				}
+			}
+		}
+		for i, out := range tnx.Vout {
+			if w.owns(&out) {
+				o := spvOutput{tnx.ID, i, out, height}
+				if err := b.Put(outpointKey(tnx.ID, i), o.Serialize()); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Printf("SPV balance: %d\n", spvBalance(w.node.bc.db, nil))
+}
+
+// 对方没有请求的区块，下一次收到区块头或 inv 时重新请求
+func (w *spvWallet) notFound(hash []byte) {
+	delete(w.requested, hex.EncodeToString(hash))
+}
+
+func (w *spvWallet) owns(out *TXOutput) bool {
+	for _, h := range w.pubKeyHashes {
+		if out.IsLockedWithKey(h) {
+			return true
+		}
+	}
+	return false
+}
+
+// 轻节点数据库中pubKeyHash拥有的余额，pubKeyHash 为 nil 时返回所有地址的余额之和
+func spvBalance(db *bolt.DB, pubKeyHash []byte) int {
+	balance := 0
+	db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(spvOutputsBucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			o := DeserializeSPVOutput(v)
+			if pubKeyHash == nil || o.Output.IsLockedWithKey(pubKeyHash) {
+				balance += o.Output.Value
+			}
+			return nil
+		})
+	})
+	return balance
+}
+
+// 全节点回复轻节点的 getdata filtered：发送 merkleblock，然后发送匹配的交易
+func (n *Node) sendMerkleBlock(p *Peer, b *Block) {
+	var data [][]byte
+	var matches []bool
+	var matchedTxs []*Transaction
+	for _, tnx := range b.Transactions {
+		data = append(data, tnx.Serialize())
+		match := p.filterMatch(tnx)
+		matches = append(matches, match)
+		if match {
+			matchedTxs = append(matchedTxs, tnx)
+		}
+	}
+	hashes, flags := NewMerkleTree(data).PartialProof(matches)
+	p.Send("merkleblock", merkleblock{n.Address, b.BlockHeader.Serialize(), len(b.Transactions), hashes, flags})
+	for _, tnx := range matchedTxs {
+		n.sendTx(p, tnx)
+	}
+}
+
+// 以轻节点模式启动：只同步区块头，通过布隆过滤器跟踪pubKeys对应地址的余额
+// 数据库中至少要有创世区块(和全节点一样从 blockchain_genesis.db 复制)
+func StartSPVNode(nodeID string, pubKeys [][]byte, seeds []string) *Node {
+	return startNode(nodeID, "", seeds, pubKeys)
+}
+
+// 轻节点监视的所有地址的余额
+func (n *Node) SPVBalance() int {
+	n.chainMu.Lock()
+	defer n.chainMu.Unlock()
+	return spvBalance(n.bc.db, nil)
+}
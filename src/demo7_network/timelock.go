@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+)
+
+// 交易的锁定时间小于这个值时为区块高度，否则为 Unix 时间(秒)
+const lockTimeThreshold = 500000000
+
+// 输入的序列号
+const (
+	// 所有输入的序列号都为这个值时交易的锁定时间不生效
+	sequenceFinal = 0xffffffff
+	// 设置锁定时间但不使用相对锁定时间的输入的序列号
+	sequenceLockTimeOnly = 0xfffffffe
+	// 设置这一位时输入没有相对锁定时间
+	sequenceLockTimeDisabled = 1 << 31
+	// 设置这一位时相对锁定时间的单位为 512 秒，否则为区块数
+	sequenceLockTimeIsSeconds = 1 << 22
+	// 相对锁定时间的数值部分
+	sequenceLockTimeMask = 0x0000ffff
+	// 时间单位为 2^9 = 512 秒
+	sequenceLockTimeGranularity = 9
+)
+
+// 返回相对锁定时间为blocks个区块的序列号
+func SequenceBlocks(blocks int) uint32 {
+	return uint32(blocks) & sequenceLockTimeMask
+}
+
+// 返回相对锁定时间至少为seconds秒的序列号(向上取整到 512 秒)
+func SequenceSeconds(seconds int64) uint32 {
+	units := (seconds + 1<<sequenceLockTimeGranularity - 1) >> sequenceLockTimeGranularity
+	return sequenceLockTimeIsSeconds | uint32(units)&sequenceLockTimeMask
+}
+
+// 交易能否打包进高度为height的区块，mtp 为父区块的时间中位数
+// 锁定时间为 0 或者所有输入的序列号都为 sequenceFinal 时不受限制
+func (tx *Transaction) IsFinal(height int, mtp int64) bool {
+	if tx.LockTime == 0 {
+		return true
+	}
+	limit := int64(height)
+	if tx.LockTime >= lockTimeThreshold {
+		limit = mtp
+	}
+	if tx.LockTime < limit {
+		return true
+	}
+	for _, vin := range tx.Vin {
+		if vin.Sequence != sequenceFinal {
+			return false
+		}
+	}
+	return true
+}
+
+// 检查交易能否打包进父区块为prev的区块：绝对锁定时间已过，并且每个输入的相对锁定时间已过
+// 相对锁定时间从被花费的输出所在的区块开始计算
+// 输出不在UTXO集中的输入在这里跳过，调用者的输入检查会拒绝这笔交易(不支持花费同一区块中的输出)
+func (bc *Blockchain) checkTransactionLocks(tx *Transaction, prev *BlockHeader) error {
+	height := prev.Height + 1
+	mtp := bc.medianTimePast(prev)
+	if !tx.IsFinal(height, mtp) {
+		return fmt.Errorf("%w: lock time %d, height %d, median time %d", ErrNonFinalTx, tx.LockTime, height, mtp)
+	}
+	if tx.IsCoinbase() {
+		return nil
+	}
+	utxoSet := UTXOSet{bc}
+	for _, vin := range tx.Vin {
+		if vin.Sequence&sequenceLockTimeDisabled != 0 {
+			continue
+		}
+		outs, ok := utxoSet.FindOutputs(vin.Txid)
+		if !ok {
+			continue
+		}
+		prevHeight := outs.Height
+		value := int64(vin.Sequence & sequenceLockTimeMask)
+		if vin.Sequence&sequenceLockTimeIsSeconds == 0 {
+			if int64(height) < int64(prevHeight)+value {
+				return fmt.Errorf("%w: input %s needs height %d", ErrSequenceLocked, vin.Outpoint(), int64(prevHeight)+value)
+			}
+			continue
+		}
+		//从输出所在区块的父区块的时间中位数开始计算
+		start := mtp
+		if prevHeight < height {
+			startHeight := prevHeight - 1
+			if startHeight < 0 {
+				startHeight = 0
+			}
+			start = bc.medianTimePast(bc.findHeader(bc.mainChainHash(startHeight)))
+		}
+		if mtp < start+value<<sequenceLockTimeGranularity {
+			return fmt.Errorf("%w: input %s needs median time %d", ErrSequenceLocked, vin.Outpoint(), start+value<<sequenceLockTimeGranularity)
+		}
+	}
+	return nil
+}
@@ -3,53 +3,84 @@ package main
 import (
 	"bytes"
 	"crypto/ecdsa"
-	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/gob"
 	"encoding/hex"
 	"fmt"
 	"log"
-	"math/big"
 )
 
-// coinbase奖励
-const subsidy = 10
+// 创世区块的coinbase奖励，之后每 subsidyHalvingInterval 个区块减半
+const initialSubsidy = 10
 
-// Transaction 由交易 ID，输入和输出构成
+// 出块奖励减半的间隔(区块数)
+var subsidyHalvingInterval = 210
+
+// 返回指定高度区块的出块奖励
+func GetBlockSubsidy(height int) int {
+	halvings := height / subsidyHalvingInterval
+	if halvings >= 63 {
+		return 0
+	}
+	return initialSubsidy >> uint(halvings)
+}
+
+// 按减半规则计算币的最大发行量(所有区块的出块奖励之和)
+func MaxSupply() int {
+	supply := 0
+	for height := 0; GetBlockSubsidy(height) > 0; height += subsidyHalvingInterval {
+		supply += GetBlockSubsidy(height) * subsidyHalvingInterval
+	}
+	return supply
+}
+
+// Transaction 由交易 ID，输入，输出和锁定时间构成
+// LockTime 不为 0 时交易只能打包进高度(或父区块时间中位数)大于它的区块，见 IsFinal
 type Transaction struct {
-	ID   []byte
-	Vin  []TXInput
-	Vout []TXOutput
+	ID       []byte
+	Vin      []TXInput
+	Vout     []TXOutput
+	LockTime int64
 }
 
-// 创建一笔新的交易
-func NewUTXOTransaction(wallet *Wallet, to string, amount int, UTXOSet *UTXOSet) *Transaction {
+// 创建一笔新的交易(fee为支付给矿工的手续费，即输入金额与输出金额之差)
+func NewUTXOTransaction(wallet *Wallet, to string, amount, fee int, UTXOSet *UTXOSet) *Transaction {
+	return NewTimelockedTransaction(wallet, to, amount, fee, 0, UTXOSet)
+}
+
+// 创建一笔锁定时间为lockTime的交易，lockTime 小于 lockTimeThreshold 时为区块高度，否则为 Unix 时间
+func NewTimelockedTransaction(wallet *Wallet, to string, amount, fee int, lockTime int64, UTXOSet *UTXOSet) *Transaction {
 	var inputs []TXInput
 	var outputs []TXOutput
 	//获取from地址的公钥的hash
 	pubKeyHash := HashPubKey(wallet.PublicKey)
-	//找到至少 amount 的 UTXO
-	acc, vaildOutputs := UTXOSet.FindSpendableOutputs(pubKeyHash, amount)
+	//找到至少 amount+fee 的 UTXO
+	acc, vaildOutputs := UTXOSet.FindSpendableOutputs(pubKeyHash, amount+fee)
 	//不足够支付
-	if acc < amount {
+	if acc < amount+fee {
 		log.Panic("ERROR:Not enough funds")
 	}
+	//锁定时间只有在有输入的序列号不为 sequenceFinal 时才生效
+	sequence := uint32(sequenceFinal)
+	if lockTime != 0 {
+		sequence = sequenceLockTimeOnly
+	}
 	//足够支付(遍历含有from地址输出的交易)
 	for txid, outs := range vaildOutputs {
 		txID, _ := hex.DecodeString(txid)
 		for _, out := range outs {
 			//存入到这笔交易的输入里
-			input := TXInput{txID, out, nil, wallet.PublicKey}
+			input := TXInput{txID, out, nil, sequence}
 			inputs = append(inputs, input)
 		}
 	}
 	from := fmt.Sprintf("%s", wallet.GetAddress())
 	outputs = append(outputs, *NewTXOutput(amount, to))
-	if acc > amount {
-		outputs = append(outputs, *NewTXOutput(acc-amount, from))
+	if acc > amount+fee {
+		outputs = append(outputs, *NewTXOutput(acc-amount-fee, from))
 	}
-	tx := Transaction{nil, inputs, outputs}
+	tx := Transaction{nil, inputs, outputs, lockTime}
 	tx.ID = tx.Hash()
 	//签名交易
 	UTXOSet.Blockchain.SignTransaction(&tx, wallet.PrivateKey)
@@ -57,6 +88,7 @@ func NewUTXOTransaction(wallet *Wallet, to string, amount int, UTXOSet *UTXOSet)
 }
 
 // 签名交易(接受一个私钥和一个之前交易的 map)
+// 只签名锁定到这个私钥的公钥哈希的输入，解锁脚本为 <签名> <公钥>
 func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transaction) {
 	if tx.IsCoinbase() {
 		return
@@ -66,26 +98,38 @@ func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transac
 			log.Panic("ERROR: Previous transaction is not correct")
 		}
 	}
-	txCopy := tx.TrimmedCopy()
-	//迭代副本交易中每一个输入
-	for inID, vin := range txCopy.Vin {
-		prevTx := prevTXs[hex.EncodeToString(vin.Txid)]
-		txCopy.Vin[inID].Signature = nil
-		txCopy.Vin[inID].PubKey = prevTx.Vout[vin.Vout].PubKeyHash
-		dataToSign := fmt.Sprintf("%x\n", txCopy)
-		//使用私钥对任意长度的hash值（必须是较大信息的hash结果）进行签名，返回签名结果（一对大整数）
-		r, s, err := ecdsa.Sign(rand.Reader, &privKey, []byte(dataToSign))
-		if err != nil {
-			log.Panic(err)
+	pubKey := PaddedConcat(privKey.PublicKey.X, privKey.PublicKey.Y, (privKey.Curve.Params().BitSize+7)/8)
+	pubKeyHash := HashPubKey(pubKey)
+	for inID, vin := range tx.Vin {
+		prevOut := prevTXs[hex.EncodeToString(vin.Txid)].Vout[vin.Vout]
+		if !prevOut.IsLockedWithKey(pubKeyHash) {
+			continue
 		}
-		signature := append(r.Bytes(), s.Bytes()...)
-		tx.Vin[inID].Signature = signature
-		//在获取完哈希，我们应该重置 PubKey 字段，以便于它不会影响后面的迭代。
-		txCopy.Vin[inID].PubKey = nil
+		signature := tx.SignInput(inID, privKey, prevOut.ScriptPubKey)
+		tx.Vin[inID].ScriptSig = P2PKHScriptSig(signature, pubKey)
+	}
+}
+
+// 用私钥对第inID个输入签名，subscript 为签名覆盖的脚本(被花费输出的锁定脚本)
+func (tx *Transaction) SignInput(inID int, privKey ecdsa.PrivateKey, subscript []byte) []byte {
+	//使用私钥对hash值进行签名，返回签名结果（一对大整数）
+	r, s, err := ecdsa.Sign(rand.Reader, &privKey, tx.SigHash(inID, subscript))
+	if err != nil {
+		log.Panic(err)
 	}
+	return PaddedConcat(r, s, (privKey.Curve.Params().BitSize+7)/8)
+}
+
+// 第inID个输入的签名哈希：去掉所有解锁脚本，把这个输入的解锁脚本换成subscript后取哈希
+// 签名因此覆盖了交易的所有输入和输出
+func (tx *Transaction) SigHash(inID int, subscript []byte) []byte {
+	txCopy := tx.TrimmedCopy()
+	txCopy.Vin[inID].ScriptSig = subscript
+	hash := sha256.Sum256(txCopy.Serialize())
+	return hash[:]
 }
 
-// 验证函数
+// 验证函数：对每个输入执行解锁脚本和被花费输出的锁定脚本
 func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
 	if tx.IsCoinbase() {
 		return true
@@ -95,48 +139,24 @@ func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
 			log.Panic("ERROR: Previous transaction is not correct")
 		}
 	}
-	txCopy := tx.TrimmedCopy()
-	//返回一个实现了P-256的曲线
-	curve := elliptic.P256()
 	for inID, vin := range tx.Vin {
-		//检查每个输入的签名
 		prevTX := prevTXs[hex.EncodeToString(vin.Txid)]
-		txCopy.Vin[inID].Signature = nil
-		txCopy.Vin[inID].PubKey = prevTX.Vout[vin.Vout].PubKeyHash
-
-		//这个部分跟 Sign 方法一模一样，因为在验证阶段，我们需要的是与签名相同的数据。
-		r := big.Int{}
-		s := big.Int{}
-		sigLen := len(vin.Signature)
-		r.SetBytes(vin.Signature[:(sigLen / 2)])
-		s.SetBytes(vin.Signature[(sigLen / 2):])
-
-		x := big.Int{}
-		y := big.Int{}
-		keyLen := len(vin.PubKey)
-		x.SetBytes(vin.PubKey[:(keyLen / 2)])
-		y.SetBytes(vin.PubKey[(keyLen / 2):])
-
-		dataToVerify := fmt.Sprintf("%x\n", txCopy)
-
-		//使用公钥验证hash值和两个大整数r、s构成的签名，并返回签名是否合法。
-		rawPubKey := ecdsa.PublicKey{curve, &x, &y}
-		if ecdsa.Verify(&rawPubKey, []byte(dataToVerify), &r, &s) == false {
+		if err := VerifyScript(vin.ScriptSig, prevTX.Vout[vin.Vout].ScriptPubKey, tx, inID); err != nil {
 			return false
 		}
-		txCopy.Vin[inID].PubKey = nil
 	}
 	return true
 }
 
-// 构建 coinbase 交易
-func NewCoinbaseTX(to, data string) *Transaction {
+// 构建高度为height的区块的 coinbase 交易(矿工可以领取出块奖励和区块中所有交易的手续费)
+func NewCoinbaseTX(to, data string, height, fees int) *Transaction {
+	//默认数据中带上高度，避免同一个矿工的 coinbase 交易ID重复
 	if data == "" {
-		data = fmt.Sprintf("Reward to '%s'", to)
+		data = fmt.Sprintf("Reward to '%s' at height %d", to, height)
 	}
-	txin := TXInput{[]byte{}, -1, nil, []byte(data)}
-	txout := NewTXOutput(subsidy, to)
-	tx := Transaction{nil, []TXInput{txin}, []TXOutput{*txout}}
+	txin := TXInput{[]byte{}, -1, []byte(data), sequenceFinal}
+	txout := NewTXOutput(GetBlockSubsidy(height)+fees, to)
+	tx := Transaction{nil, []TXInput{txin}, []TXOutput{*txout}, 0}
 	tx.ID = tx.Hash()
 	return &tx
 }
@@ -146,26 +166,44 @@ func (tx Transaction) IsCoinbase() bool {
 	return len(tx.Vin) == 1 && len(tx.Vin[0].Txid) == 0 && tx.Vin[0].Vout == -1
 }
 
-// 返回交易的哈希值
+// 检查交易ID是否为交易的哈希(交易ID在签名之前计算)
+func (tx *Transaction) HasValidID() bool {
+	return bytes.Equal(tx.Hash(), tx.ID)
+}
+
+// 返回交易所有输出的金额之和
+func (tx Transaction) OutputValue() int {
+	value := 0
+	for _, out := range tx.Vout {
+		value += out.Value
+	}
+	return value
+}
+
+// 返回交易的哈希值，不包括解锁脚本(coinbase 的数据除外)，所以签名不会改变交易ID
 func (tx *Transaction) Hash() []byte {
 	var hash [32]byte
 	txCopy := *tx
 	txCopy.ID = []byte{}
+	if !tx.IsCoinbase() {
+		txCopy = tx.TrimmedCopy()
+		txCopy.ID = []byte{}
+	}
 	hash = sha256.Sum256(txCopy.Serialize())
 	return hash[:]
 }
 
-// 获取交易副本
+// 获取去掉解锁脚本的交易副本
 func (tx *Transaction) TrimmedCopy() Transaction {
 	var inputs []TXInput
 	var outputs []TXOutput
 	for _, vin := range tx.Vin {
-		inputs = append(inputs, TXInput{vin.Txid, vin.Vout, nil, nil})
+		inputs = append(inputs, TXInput{vin.Txid, vin.Vout, nil, vin.Sequence})
 	}
 	for _, vout := range tx.Vout {
-		outputs = append(outputs, TXOutput{vout.Value, vout.PubKeyHash})
+		outputs = append(outputs, TXOutput{vout.Value, vout.ScriptPubKey})
 	}
-	txCopy := Transaction{tx.ID, inputs, outputs}
+	txCopy := Transaction{tx.ID, inputs, outputs, tx.LockTime}
 	return txCopy
 }
 
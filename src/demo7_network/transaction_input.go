@@ -1,21 +1,33 @@
 package main
 
-import "bytes"
+import (
+	"bytes"
+	"fmt"
+)
 
-// TXInput 包含 3 部分
+// TXInput 包含 4 部分
 // Txid: 一个交易输入引用了之前一笔交易的一个输出, ID表明是之前哪笔交易
 // Vout: 一笔交易可能有多个输出，Vout 为输出的索引
-// Signature: 签名数据
-// PubKey: 公钥
+// ScriptSig: 解锁脚本，与被引用输出的锁定脚本一起执行；coinbase 交易中为任意数据
+// Sequence: 序列号，没有设置禁用位时低 16 位为输入的相对锁定时间
 type TXInput struct {
 	Txid      []byte
 	Vout      int
-	Signature []byte
-	PubKey    []byte
+	ScriptSig []byte
+	Sequence  uint32
 }
 
-// 检查输入使用了指定密钥来解锁一个输出
+// 检查输入使用了指定密钥来解锁一个输出(解锁脚本的最后一个数据为公钥)
 func (in *TXInput) UsesKey(pubKeyHash []byte) bool {
-	lockingHash := HashPubKey(in.PubKey)
+	pushes := scriptPushes(in.ScriptSig)
+	if len(pushes) == 0 {
+		return false
+	}
+	lockingHash := HashPubKey(pushes[len(pushes)-1])
 	return bytes.Compare(lockingHash, pubKeyHash) == 0
 }
+
+// 输入引用的输出(交易ID:输出索引)，同一个输出只能被花费一次
+func (in *TXInput) Outpoint() string {
+	return fmt.Sprintf("%x:%d", in.Txid, in.Vout)
+}
@@ -8,22 +8,28 @@ import (
 
 // TXOutput 包含两部分
 // Value: 有多少币，就是存储在 Value 里面
-// PubKeyHash: 锁定脚本
+// ScriptPubKey: 锁定脚本，花费时输入的解锁脚本必须让它执行成功
 type TXOutput struct {
-	Value      int
-	PubKeyHash []byte
+	Value        int
+	ScriptPubKey []byte
 }
 
-// 锁定一个输出
+// 锁定一个输出，按地址的版本选择锁定脚本：公钥哈希地址为 P2PKH，脚本哈希地址为 P2SH
 func (out *TXOutput) Lock(address []byte) {
-	pubKeyHash := Base58Decode(address)
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
-	out.PubKeyHash = pubKeyHash
+	version, hash := decodeAddress(string(address))
+	switch version {
+	case version_w:
+		out.ScriptPubKey = P2PKHScript(hash)
+	case version_p2sh:
+		out.ScriptPubKey = P2SHScript(hash)
+	default:
+		log.Panicf("ERROR: Unknown address version 0x%02x", version)
+	}
 }
 
 // 检查是否提供的公钥哈希被用于锁定输出
 func (out *TXOutput) IsLockedWithKey(pubkeyHash []byte) bool {
-	return bytes.Compare(out.PubKeyHash, pubkeyHash) == 0
+	return bytes.Compare(extractPubKeyHash(out.ScriptPubKey), pubkeyHash) == 0
 }
 
 // 创建一个新的输出交易
@@ -33,8 +39,24 @@ func NewTXOutput(value int, address string) *TXOutput {
 	return txo
 }
 
+// coinbase 交易的输出要经过多少个区块才能花费，防止分叉回滚后下游的交易失效
+var coinbaseMaturity = 10
+
+// 一笔交易中尚未花费的输出，键为输出在交易中的索引
+// Height 为交易所在区块的高度，Coinbase 表示是否为 coinbase 交易
 type TXOutputs struct {
-	Outputs []TXOutput
+	Outputs  map[int]TXOutput
+	Height   int
+	Coinbase bool
+}
+
+// 输出能否被高度为height的区块中的交易花费
+// 创世区块的 coinbase 是初始发行的币，不受成熟度限制
+func (outs TXOutputs) IsMature(height int) bool {
+	if !outs.Coinbase || outs.Height == 0 {
+		return true
+	}
+	return height-outs.Height >= coinbaseMaturity
 }
 
 func (outs TXOutputs) Serialize() []byte {
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"log"
+	"math/big"
 )
 
 // 将int64转换为字节数组
@@ -22,3 +23,12 @@ func ReverseBytes(data []byte) {
 		data[i], data[j] = data[j], data[i]
 	}
 }
+
+// 把两个大整数各自按size字节左侧补零后拼接起来
+// 签名(r,s)和公钥(X,Y)都按这种定长格式保存，验证时才能从中间正确拆开
+func PaddedConcat(a, b *big.Int, size int) []byte {
+	buf := make([]byte, 2*size)
+	a.FillBytes(buf[:size])
+	b.FillBytes(buf[size:])
+	return buf
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// 区块时间戳最多可以比本地时间超前多久
+const maxFutureBlockTime = 2 * time.Hour
+
+// 区块被拒绝的原因
+var (
+	ErrMalformedBlock   = errors.New("malformed block")
+	ErrOrphanBlock      = errors.New("previous block not found")
+	ErrBadHeight        = errors.New("block height does not follow previous block")
+	ErrBadProofOfWork   = errors.New("block hash does not satisfy proof of work")
+	ErrBadDifficulty    = errors.New("block target does not match required difficulty")
+	ErrBadTimestamp     = errors.New("block timestamp out of range")
+	ErrTimeTooNew       = errors.New("block timestamp too far in the future")
+	ErrBadBlockHash     = errors.New("block hash does not match its header")
+	ErrBadMerkleRoot    = errors.New("merkle root does not match transactions")
+	ErrNoTransactions   = errors.New("block has no transactions")
+	ErrBlockTooLarge    = errors.New("block exceeds maximum size")
+	ErrBadCoinbase      = errors.New("invalid coinbase transaction")
+	ErrBadTransaction   = errors.New("invalid transaction")
+	ErrBadTransactionID = errors.New("transaction ID does not match its contents")
+	ErrImmatureSpend    = errors.New("spends immature coinbase output")
+	ErrDoubleSpend      = errors.New("output spent more than once")
+	ErrNonFinalTx       = errors.New("transaction lock time not reached")
+	ErrSequenceLocked   = errors.New("input relative lock time not reached")
+)
+
+// 区块验证失败时返回的错误，Err 为上面定义的原因之一
+type BlockValidationError struct {
+	Hash   []byte
+	Err    error
+	Detail string
+}
+
+func (e *BlockValidationError) Error() string {
+	if e.Detail == "" {
+		return fmt.Sprintf("block %x rejected: %v", e.Hash, e.Err)
+	}
+	return fmt.Sprintf("block %x rejected: %v: %s", e.Hash, e.Err, e.Detail)
+}
+
+func (e *BlockValidationError) Unwrap() error {
+	return e.Err
+}
+
+func ruleError(block *Block, err error, format string, a ...interface{}) error {
+	var hash []byte
+	if block != nil {
+		hash = block.Hash
+	}
+	return &BlockValidationError{hash, err, fmt.Sprintf(format, a...)}
+}
+
+// 按共识规则检查区块头：父区块头存在，高度连续，时间戳合理，难度符合调整规则并满足工作量证明
+func (bc *Blockchain) ValidateHeader(header *BlockHeader) error {
+	hash := header.Hash()
+	prev := bc.findHeader(header.PrevBlockHash)
+	if prev == nil {
+		return &BlockValidationError{hash, ErrOrphanBlock, fmt.Sprintf("prev %x", header.PrevBlockHash)}
+	}
+	if header.Height != prev.Height+1 {
+		return &BlockValidationError{hash, ErrBadHeight, fmt.Sprintf("got %d, want %d", header.Height, prev.Height+1)}
+	}
+
+	//时间戳必须大于过去中位时间，并且不能超前本地时间太多
+	if header.Timestamp <= bc.medianTimePast(prev) {
+		return &BlockValidationError{hash, ErrBadTimestamp, "not after median time past"}
+	}
+	if header.Timestamp > time.Now().Add(maxFutureBlockTime).Unix() {
+		return &BlockValidationError{hash, ErrTimeTooNew, fmt.Sprintf("%d is more than %v ahead", header.Timestamp, maxFutureBlockTime)}
+	}
+
+	//难度必须符合该高度的要求，区块头哈希必须满足这个难度
+	requiredBits := bc.CalcNextRequiredBits(prev)
+	if header.Bits != requiredBits {
+		return &BlockValidationError{hash, ErrBadDifficulty, fmt.Sprintf("got %08x, want %08x", header.Bits, requiredBits)}
+	}
+	if !NewProofOfWork(header).Validate(requiredBits) {
+		return &BlockValidationError{hash, ErrBadProofOfWork, ""}
+	}
+	return nil
+}
+
+// 按共识规则检查区块，只有通过检查的区块才能写入数据库
+// 交易的输入和签名依赖于父区块时的UTXO状态，在区块连接到主链时由 validateTransactions 检查
+func (bc *Blockchain) ValidateBlock(block *Block) error {
+	if block == nil || len(block.Hash) == 0 {
+		return ruleError(block, ErrMalformedBlock, "")
+	}
+	if len(block.Transactions) == 0 {
+		return ruleError(block, ErrNoTransactions, "")
+	}
+	if size := len(block.Serialize()); size > maxBlockSize {
+		return ruleError(block, ErrBlockTooLarge, "%d bytes", size)
+	}
+	coinbases := 0
+	//区块中的每个输出最多只能被花费一次
+	spent := make(map[string]bool)
+	for _, tx := range block.Transactions {
+		if tx == nil {
+			return ruleError(block, ErrMalformedBlock, "nil transaction")
+		}
+		if !tx.HasValidID() {
+			return ruleError(block, ErrBadTransactionID, "tx %x", tx.ID)
+		}
+		if tx.IsCoinbase() {
+			coinbases++
+			continue
+		}
+		for _, vin := range tx.Vin {
+			if spent[vin.Outpoint()] {
+				return ruleError(block, ErrDoubleSpend, "tx %x spends %s", tx.ID, vin.Outpoint())
+			}
+			spent[vin.Outpoint()] = true
+		}
+	}
+	if coinbases != 1 {
+		return ruleError(block, ErrBadCoinbase, "%d coinbase transactions", coinbases)
+	}
+
+	//交易必须与区块头中的默克尔根一致，区块哈希必须由区块头算出
+	if !bytes.Equal(block.MerkleRoot, block.HashTransactions()) {
+		return ruleError(block, ErrBadMerkleRoot, "")
+	}
+	if !bytes.Equal(block.BlockHeader.Hash(), block.Hash) {
+		return ruleError(block, ErrBadBlockHash, "")
+	}
+	if err := bc.ValidateHeader(&block.BlockHeader); err != nil {
+		return err
+	}
+	//区块体只能接在已有区块体的父区块之后
+	if !bc.hasBlock(block.PrevBlockHash) {
+		return ruleError(block, ErrOrphanBlock, "prev %x has no body", block.PrevBlockHash)
+	}
+	return nil
+}
+
+// 检查区块中交易的锁定时间、签名和金额，区块的父区块必须是当前链尖
+// coinbase 最多只能领取出块奖励加上区块中所有交易的手续费
+func (bc *Blockchain) validateTransactions(block *Block) error {
+	var coinbase *Transaction
+	fees := 0
+	prev := bc.findHeader(block.PrevBlockHash)
+	for _, tx := range block.Transactions {
+		//错误原因为 ErrNonFinalTx 或 ErrSequenceLocked
+		if err := bc.checkTransactionLocks(tx, prev); err != nil {
+			return ruleError(block, errors.Unwrap(err), "tx %x: %v", tx.ID, err)
+		}
+		if tx.IsCoinbase() {
+			coinbase = tx
+			continue
+		}
+		fee, err := bc.checkTransactionInputs(tx)
+		if err != nil {
+			return ruleError(block, ErrBadTransaction, "tx %x: %v", tx.ID, err)
+		}
+		if !bc.VerifyTransaction(tx) {
+			return ruleError(block, ErrBadTransaction, "tx %x: bad signature", tx.ID)
+		}
+		fees += fee
+	}
+	allowed := GetBlockSubsidy(block.Height) + fees
+	if value := coinbase.OutputValue(); value > allowed {
+		return ruleError(block, ErrBadCoinbase, "pays %d, allowed %d", value, allowed)
+	}
+	return nil
+}
+
+// 检查交易的输入都指向存在的输出，并且输出金额不超过输入金额，返回交易的手续费
+func (bc *Blockchain) checkTransactionInputs(tx *Transaction) (int, error) {
+	if len(tx.Vin) == 0 || len(tx.Vout) == 0 {
+		return 0, errors.New("empty inputs or outputs")
+	}
+	for _, out := range tx.Vout {
+		if out.Value < 0 {
+			return 0, errors.New("negative output value")
+		}
+	}
+	inputValue := 0
+	for _, vin := range tx.Vin {
+		prevTX, err := bc.FindTransaction(vin.Txid)
+		if err != nil {
+			return 0, fmt.Errorf("input %x:%d: %v", vin.Txid, vin.Vout, err)
+		}
+		if vin.Vout < 0 || vin.Vout >= len(prevTX.Vout) {
+			return 0, fmt.Errorf("input %x:%d: output index out of range", vin.Txid, vin.Vout)
+		}
+		inputValue += prevTX.Vout[vin.Vout].Value
+	}
+	outputValue := tx.OutputValue()
+	if outputValue > inputValue {
+		return 0, fmt.Errorf("outputs %d exceed inputs %d", outputValue, inputValue)
+	}
+	return inputValue - outputValue, nil
+}
@@ -11,6 +11,9 @@ import (
 )
 
 const version_w = byte(0x00)
+
+// 支付到脚本哈希(P2SH)地址的版本，地址中编码的是赎回脚本的哈希
+const version_p2sh = byte(0x05)
 const addressChecksumLen = 4
 
 // ecdsa.PrivateKey代表一个ECDSA私钥
@@ -34,7 +37,7 @@ func newKeyPair() (ecdsa.PrivateKey, []byte) {
 	if err != nil {
 		log.Panic(err)
 	}
-	pubKey := append(private.PublicKey.X.Bytes(), private.PublicKey.Y.Bytes()...)
+	pubKey := PaddedConcat(private.PublicKey.X, private.PublicKey.Y, (curve.Params().BitSize+7)/8)
 	return *private, pubKey
 }
 
@@ -42,8 +45,17 @@ func newKeyPair() (ecdsa.PrivateKey, []byte) {
 func (w Wallet) GetAddress() []byte {
 	//使用 RIPEMD160(SHA256(PubKey)) 哈希算法
 	pubKeyHash := HashPubKey(w.PublicKey)
+	return encodeAddress(version_w, pubKeyHash)
+}
+
+// 赎回脚本的 P2SH 地址，哈希算法与公钥哈希相同
+func ScriptAddress(redeemScript []byte) []byte {
+	return encodeAddress(version_p2sh, HashPubKey(redeemScript))
+}
+
+func encodeAddress(version byte, hash []byte) []byte {
 	//给哈希加上地址生成算法版本的前缀
-	versionedPayload := append([]byte{version_w}, pubKeyHash...)
+	versionedPayload := append([]byte{version}, hash...)
 	//计算校验和
 	checksum := checksum(versionedPayload)
 	fullPayload := append(versionedPayload, checksum...)
@@ -52,6 +64,16 @@ func (w Wallet) GetAddress() []byte {
 	return address
 }
 
+// 解码地址，返回版本和其中的哈希(公钥哈希或脚本哈希)
+func decodeAddress(address string) (byte, []byte) {
+	payload := Base58Decode([]byte(address))
+	//至少要有版本字节和校验和，否则下面的切片会越界
+	if len(payload) < 1+addressChecksumLen {
+		log.Panicf("ERROR: Address %s is too short", address)
+	}
+	return payload[0], payload[1 : len(payload)-addressChecksumLen]
+}
+
 // 对公钥取哈希
 func HashPubKey(pubKey []byte) []byte {
 	publicSHA256 := sha256.Sum256(pubKey)
@@ -71,11 +93,17 @@ func checksum(payload []byte) []byte {
 	return secondSHA[:addressChecksumLen]
 }
 
-// 检查地址
+// 检查地址：校验和正确，版本为公钥哈希或脚本哈希，哈希为20个字节
 func ValidateAddress(address string) bool {
 	pubKeyHash := Base58Decode([]byte(address))
+	if len(pubKeyHash) != 1+20+addressChecksumLen {
+		return false
+	}
 	actualChecksum := pubKeyHash[len(pubKeyHash)-addressChecksumLen:]
 	version := pubKeyHash[0]
+	if version != version_w && version != version_p2sh {
+		return false
+	}
 	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-addressChecksumLen]
 	targetChecksum := checksum(append([]byte{version}, pubKeyHash...))
 	return bytes.Compare(actualChecksum, targetChecksum) == 0
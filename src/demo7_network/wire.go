@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// 网络标识，放在每条消息的开头，不同网络的节点不会接受彼此的消息
+const networkMagic uint32 = 0xd9b4bef9
+
+// 消息头的长度：magic(4) + 命令(12) + 消息体长度(4) + 校验和(4)
+const messageHeaderSize = 4 + commandLength + 4 + 4
+
+// 消息体长度上限，需要能放下最大的区块
+const maxPayloadSize = 2 * maxBlockSize
+
+// 消息帧被拒绝的原因，出现这些错误后连接上的数据已经不可信，需要断开连接
+var (
+	ErrBadMagic        = errors.New("message has wrong network magic")
+	ErrPayloadTooLarge = errors.New("message payload too large")
+	ErrBadChecksum     = errors.New("message checksum mismatch")
+	ErrBadCommand      = errors.New("message command is malformed")
+)
+
+// 一条网络消息，Payload 为gob编码的消息体
+type message struct {
+	Command string
+	Payload []byte
+}
+
+// 消息体的校验和：两次SHA-256的前4个字节
+func payloadChecksum(payload []byte) []byte {
+	first := sha256.Sum256(payload)
+	second := sha256.Sum256(first[:])
+	return second[:4]
+}
+
+// 把消息编码成一帧写入w
+func writeMessage(w io.Writer, msg *message) error {
+	if len(msg.Command) > commandLength {
+		return fmt.Errorf("%w: %q", ErrBadCommand, msg.Command)
+	}
+	if len(msg.Payload) > maxPayloadSize {
+		return fmt.Errorf("%w: %d bytes", ErrPayloadTooLarge, len(msg.Payload))
+	}
+	frame := make([]byte, messageHeaderSize, messageHeaderSize+len(msg.Payload))
+	binary.LittleEndian.PutUint32(frame[0:4], networkMagic)
+	copy(frame[4:4+commandLength], msg.Command)
+	binary.LittleEndian.PutUint32(frame[4+commandLength:8+commandLength], uint32(len(msg.Payload)))
+	copy(frame[8+commandLength:], payloadChecksum(msg.Payload))
+	frame = append(frame, msg.Payload...)
+	_, err := w.Write(frame)
+	return err
+}
+
+// 从r读取一帧消息
+// 先读消息头，长度超过上限时直接返回错误，不会读取和缓存消息体
+func readMessage(r io.Reader) (*message, error) {
+	header := make([]byte, messageHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if magic := binary.LittleEndian.Uint32(header[0:4]); magic != networkMagic {
+		return nil, fmt.Errorf("%w: %08x", ErrBadMagic, magic)
+	}
+	command := header[4 : 4+commandLength]
+	//命令以0填充，填充之后不能再出现非0字节
+	name := bytes.TrimRight(command, "\x00")
+	if len(name) == 0 || bytes.IndexByte(name, 0) >= 0 {
+		return nil, fmt.Errorf("%w: %x", ErrBadCommand, command)
+	}
+	length := binary.LittleEndian.Uint32(header[4+commandLength : 8+commandLength])
+	if length > maxPayloadSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrPayloadTooLarge, length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(payloadChecksum(payload), header[8+commandLength:]) {
+		return nil, fmt.Errorf("%w: command %s", ErrBadChecksum, name)
+	}
+	return &message{string(name), payload}, nil
+}